@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Downloads every link, at most opts.maxParallelFiles at a time and each with its own downloader.
+// A failing link doesn't stop the others, the outcome of each one is reported once all of them are done.
+// Links ending in the same file name are saved as name-1, name-2 and so on, like DownloadAll does.
+func runBatch(ctx context.Context, opts downloadOptions, links []string) error {
+	if opts.maxPerHost > 0 {
+		opts.hostLimiter = NewHostLimiter(opts.maxPerHost)
+	}
+	if opts.json {
+		opts.events = newEventWriter(os.Stdout)
+	}
+	if len(links) == 1 {
+		return run(ctx, opts, links[0], "")
+	}
+	opts.names = &nameClaims{claimed: map[string]bool{}}
+
+	// Several files can't be saved under the same name
+	if opts.output != "" && !os.IsPathSeparator(opts.output[len(opts.output)-1]) {
+		if info, err := os.Stat(opts.output); err != nil || !info.IsDir() {
+			return fmt.Errorf("output %s should be a directory when downloading several files", opts.output)
+		}
+	}
+
+	errs := make([]error, len(links))
+	slots := make(chan struct{}, max(opts.maxParallelFiles, 1))
+	var wg sync.WaitGroup
+	for i, link := range links {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, link string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			errs[i] = run(ctx, opts, link, link+": ")
+		}(i, link)
+	}
+	wg.Wait()
+
+	var failed []error
+	for i, err := range errs {
+		switch {
+		// Each download already reported how it went
+		case opts.json:
+			if err != nil {
+				failed = append(failed, err)
+			}
+		case err != nil && opts.quiet:
+			failed = append(failed, err)
+			fmt.Fprintf(os.Stderr, "failed: %s: %v\n", links[i], err)
+		case err != nil:
+			failed = append(failed, err)
+			fmt.Printf("failed: %s: %v\n", links[i], err)
+		case !opts.quiet:
+			fmt.Printf("done: %s\n", links[i])
+		}
+	}
+
+	if len(failed) > 0 {
+		return &batchError{errs: failed, total: len(links)}
+	}
+	return nil
+}
+
+// Returned by runBatch once the failures were reported, it unwraps to them so their exit code still applies.
+type batchError struct {
+	errs  []error
+	total int
+}
+
+func (e *batchError) Error() string {
+	return fmt.Sprintf("%d of %d downloads failed", len(e.errs), e.total)
+}
+
+func (e *batchError) Unwrap() []error {
+	return e.errs
+}
+
+// Reads the links of the --input file, one per line, "-" reads them from stdin.
+func readLinksFile(name string) ([]string, error) {
+	if name == "-" {
+		return readLinks(os.Stdin)
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readLinks(file)
+}
+
+// Returns the links listed in r, one per line, skipping blank lines and # comments.
+func readLinks(r io.Reader) ([]string, error) {
+	var links []string
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if u, err := url.Parse(line); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("line %d: %q isn't a valid URL", lineNumber, line)
+		}
+		links = append(links, line)
+	}
+
+	return links, scanner.Err()
+}
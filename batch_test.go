@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	dir := t.TempDir()
+	srv := serveContent(testContent(3000))
+	defer srv.Close()
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	missing := notFound.URL
+
+	stdout, stderr, code := runCommand(t, dir, nil, "download", "-p=false", "--max-parallel-files", "2",
+		srv.URL+"/a.bin", missing+"/b.bin", srv.URL+"/c.bin")
+	if code != exitFailure {
+		t.Errorf("exited with %d, want %d, stderr: %s", code, exitFailure, stderr)
+	}
+	for _, name := range []string{"a.bin", "c.bin"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("the failure stopped the others: %v", err)
+		}
+		if !strings.Contains(stdout, "done: "+srv.URL+"/"+name) {
+			t.Errorf("%s isn't reported done in %q", name, stdout)
+		}
+	}
+	if !strings.Contains(stdout, "failed: "+missing+"/b.bin") {
+		t.Errorf("the failure isn't reported in %q", stdout)
+	}
+	if !strings.Contains(stderr, "1 of 3 downloads failed") {
+		t.Errorf("got stderr %q", stderr)
+	}
+}
+
+func TestBatchSameName(t *testing.T) {
+	dir := t.TempDir()
+	first, second := testContent(3000), testContent(5000)[1000:]
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := first
+		if strings.HasPrefix(r.URL.Path, "/b/") {
+			data = second
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	_, stderr, code := runCommand(t, dir, nil, "download", "-p=false", "--max-parallel-files", "2",
+		srv.URL+"/a/file.bin", srv.URL+"/b/file.bin")
+	if code != 0 {
+		t.Fatalf("exited with %d, stderr: %s", code, stderr)
+	}
+	// Either of them can get the plain name
+	a, _ := os.ReadFile(filepath.Join(dir, "file.bin"))
+	b, _ := os.ReadFile(filepath.Join(dir, "file-1.bin"))
+	if !(bytes.Equal(a, first) && bytes.Equal(b, second) || bytes.Equal(a, second) && bytes.Equal(b, first)) {
+		t.Errorf("got files of %d and %d bytes, want the two downloads apart", len(a), len(b))
+	}
+}
+
+func TestReadLinks(t *testing.T) {
+	links, err := readLinks(strings.NewReader("# comment\n\n  http://example.com/a  \nhttps://example.com/b?x=1\n"))
+	if err != nil || !slices.Equal(links, []string{"http://example.com/a", "https://example.com/b?x=1"}) {
+		t.Fatalf("got %q, %v", links, err)
+	}
+
+	_, err = readLinks(strings.NewReader("http://example.com/a\nnot a url\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("got %v, want the invalid line reported", err)
+	}
+}
+
+func TestBatchInput(t *testing.T) {
+	srv := serveContent(testContent(3000))
+	defer srv.Close()
+	list := "# files\n" + srv.URL + "/a.bin\n\n" + srv.URL + "/b.bin\n"
+
+	tests := []struct {
+		name  string
+		stdin bool
+	}{
+		{"file", false},
+		{"stdin", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			input := "-"
+			var stdin io.Reader = strings.NewReader(list)
+			if !tt.stdin {
+				input, stdin = filepath.Join(dir, "links.txt"), nil
+				if err := os.WriteFile(input, []byte(list), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, stderr, code := runCommand(t, dir, stdin, "download", "-p=false", "--input", input)
+			if code != 0 {
+				t.Fatalf("exited with %d: %s", code, stderr)
+			}
+			for _, name := range []string{"a.bin", "b.bin"} {
+				if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// Returned when the downloaded file doesn't have the checksum given with WithChecksum.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Verifies the downloaded file against the expected hex digest, algo is one of md5, sha1, sha256 or sha512.
+// A file that doesn't match is removed and Download returns an error.
+// An existing output file that already matches is kept and the download skipped, whatever the existing file policy.
+// Without it, the file is verified against the digest the server advertised with Repr-Digest or Content-MD5, if any.
+func (d *downloader) WithChecksum(algo, expected string) {
+	d.checksumAlgo = strings.ToLower(algo)
+	d.checksumExpected = strings.ToLower(expected)
+}
+
+// Computes the digest of every downloaded file with each of algos as well, in the same pass as the verification
+// if there is one, so the file isn't read again. LastChecksum and DownloadResult.Checksums return them.
+func (d *downloader) WithComputedChecksums(algos ...string) {
+	d.computedAlgos = nil
+	for _, algo := range algos {
+		d.computedAlgos = append(d.computedAlgos, strings.ToLower(algo))
+	}
+}
+
+// Returns the hex digest the last download computed with algo, one of WithComputedChecksums
+// or the one of WithChecksum. A download that was skipped computes none.
+func (d *downloader) LastChecksum(algo string) (string, error) {
+	sum, ok := d.checksums[strings.ToLower(algo)]
+	if !ok {
+		return "", fmt.Errorf("no %s checksum was computed by the last download", algo)
+	}
+	return sum, nil
+}
+
+// Accepts the ALGO:HEX form used by the --checksum flag.
+func parseChecksum(value string) (algo, expected string, err error) {
+	algo, expected, ok := strings.Cut(value, ":")
+	if !ok || algo == "" || expected == "" {
+		return "", "", fmt.Errorf("checksum %q should be in the form algorithm:hex", value)
+	}
+	if _, err := newHash(strings.ToLower(algo)); err != nil {
+		return "", "", err
+	}
+	return algo, expected, nil
+}
+
+func newHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algo)
+	}
+}
+
+// Returns the checksum the download is verified against, the one given with WithChecksum
+// or else the one the server advertised for the file, algo is empty when there's neither.
+func (d *downloader) checksum() (algo, expected string) {
+	if d.checksumAlgo != "" {
+		return d.checksumAlgo, d.checksumExpected
+	}
+	return d.advertisedAlgo, d.advertisedDigest
+}
+
+// Returns the hashes the written file should be fed into, keyed by algorithm, or nil when there's nothing to compute.
+func (d *downloader) fileHashes() (map[string]hash.Hash, error) {
+	hashes := map[string]hash.Hash{}
+	add := func(algo string) error {
+		if algo == "" || hashes[algo] != nil {
+			return nil
+		}
+		h, err := newHash(algo)
+		hashes[algo] = h
+		return err
+	}
+
+	verified, _ := d.checksum()
+	if err := add(verified); err != nil {
+		return nil, err
+	}
+	for _, algo := range d.computedAlgos {
+		if err := add(algo); err != nil {
+			return nil, err
+		}
+	}
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	return hashes, nil
+}
+
+// Returns a writer feeding every one of hashes.
+func hashesWriter(hashes map[string]hash.Hash) io.Writer {
+	writers := make([]io.Writer, 0, len(hashes))
+	for _, h := range hashes {
+		writers = append(writers, h)
+	}
+	return io.MultiWriter(writers...)
+}
+
+// Keeps the digests of the file for LastChecksum and verifies it against the expected one, if any.
+func (d *downloader) finishChecksums(hashes map[string]hash.Hash) error {
+	d.checksums = make(map[string]string, len(hashes))
+	for algo, h := range hashes {
+		d.checksums[algo] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	if algo, _ := d.checksum(); algo != "" {
+		return d.verifyChecksum(hashes[algo])
+	}
+	return nil
+}
+
+// Reports whether the file at filePath already has the expected checksum.
+func (d *downloader) matchesChecksum(filePath string) (bool, error) {
+	algo, expected := d.checksum()
+	if algo == "" {
+		return false, nil
+	}
+
+	sum, err := fileChecksum(d.fs, filePath, algo)
+	if err != nil {
+		return false, err
+	}
+	return sum == expected, nil
+}
+
+// Reads the file at filePath through and returns its hex digest with algo.
+func fileChecksum(fs FileSystem, filePath, algo string) (string, error) {
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := fs.OpenFile(filePath, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (d *downloader) verifyChecksum(h hash.Hash) error {
+	algo, expected := d.checksum()
+	if got := hex.EncodeToString(h.Sum(nil)); got != expected {
+		return fmt.Errorf("%s %w: got %s want %s", algo, ErrChecksumMismatch, got, expected)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	data := testContent(5000)
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	tests := []struct {
+		name, digest string
+		ok           bool
+	}{
+		{"correct", digest, true},
+		{"upper case", strings.ToUpper(digest), true},
+		{"incorrect", strings.Repeat("0", 64), false},
+	}
+
+	// Streamed to disk and buffered in memory
+	for _, memory := range []int{0, 1 << 20} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/%d", tt.name, memory), func(t *testing.T) {
+				inTempDir(t)
+				srv := serveContent(data)
+				defer srv.Close()
+
+				d := newTestDownloader(3)
+				d.WithMemoryBuffering(memory)
+				d.WithChecksum("SHA256", tt.digest)
+				_, err := d.Download(srv.URL + "/file.bin")
+				if tt.ok && err != nil {
+					t.Fatal(err)
+				}
+				if !tt.ok && !errors.Is(err, ErrChecksumMismatch) {
+					t.Fatalf("got %v, want ErrChecksumMismatch", err)
+				}
+				// Nothing is left of a file that doesn't match
+				names, _ := filepath.Glob("*")
+				if tt.ok != (len(names) == 1) {
+					t.Errorf("left %v", names)
+				}
+			})
+		}
+	}
+}
+
+func TestChecksumSkipsMatchingFile(t *testing.T) {
+	data := testContent(3000)
+	sum := sha256.Sum256(data)
+	tests := []struct {
+		name     string
+		existing []byte
+		policy   ExistingFilePolicy
+		// Whether the local file is kept without a GET, otherwise it's downloaded again unless err is set
+		skipped bool
+		err     error
+	}{
+		{"matching", data, ExistingFileError, true, nil},
+		{"matching with overwrite", data, ExistingFileOverwrite, true, nil},
+		{"different", []byte("old"), ExistingFileError, false, ErrFileExists},
+		{"different with skip", []byte("old"), ExistingFileSkip, false, nil},
+		{"different with overwrite", []byte("old"), ExistingFileOverwrite, false, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			var gets atomic.Int64
+			srv := getCountingServer(data, &gets)
+			defer srv.Close()
+			if err := os.WriteFile("file.bin", tt.existing, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			d := newTestDownloader(2)
+			d.WithChecksum("sha256", hex.EncodeToString(sum[:]))
+			d.WithExistingFilePolicy(tt.policy)
+			result, err := d.DownloadWithResult(context.Background(), srv.URL+"/file.bin")
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Skipped != tt.skipped || (gets.Load() == 0) != tt.skipped {
+				t.Errorf("got skipped %v after %d GETs, want skipped %v", result.Skipped, gets.Load(), tt.skipped)
+			}
+			if got, _ := os.ReadFile("file.bin"); !bytes.Equal(got, data) {
+				t.Error("the file doesn't match the checksum")
+			}
+		})
+	}
+}
+
+func TestComputedChecksums(t *testing.T) {
+	srv := serveContent([]byte("hello world"))
+	defer srv.Close()
+	const want = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+	for _, memory := range []int{0, 1 << 20} {
+		t.Run(fmt.Sprintf("memory %d", memory), func(t *testing.T) {
+			inTempDir(t)
+			d := newTestDownloader(2)
+			d.WithMinChunkSize(2)
+			d.WithMemoryBuffering(memory)
+			// Any case of the names will do
+			d.WithComputedChecksums("SHA256", "md5")
+			result, err := d.DownloadWithResult(context.Background(), srv.URL+"/hello.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := d.LastChecksum("sha256"); err != nil || got != want {
+				t.Errorf("got %q, %v, want %s", got, err, want)
+			}
+			if result.Checksums["sha256"] != want || len(result.Checksums) != 2 {
+				t.Errorf("got %v in the result", result.Checksums)
+			}
+			if _, err := d.LastChecksum("sha1"); err == nil {
+				t.Error("got a digest that wasn't computed")
+			}
+		})
+	}
+
+	t.Run("unknown algorithm", func(t *testing.T) {
+		inTempDir(t)
+		d := newTestDownloader(2)
+		d.WithComputedChecksums("nope")
+		if _, err := d.Download(srv.URL + "/hello.txt"); err == nil {
+			t.Error("downloaded with an unknown algorithm")
+		}
+	})
+}
+
+func TestPrintHash(t *testing.T) {
+	srv := serveContent([]byte("hello world"))
+	defer srv.Close()
+	const want = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hello.txt")
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"quiet", []string{"--quiet"}, want + "  " + path + "\n"},
+		// The file is already there, so the hash is of the one on disk
+		{"skipped", []string{"--quiet", "--if-exists", "skip"}, want + "  " + path + "\n"},
+		{"verbose", []string{"--if-exists", "overwrite", "-p=false"}, "sha256: " + want + "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"download", "--print-hash", "sha256", "--min-chunk-size", "1", "-w", "2"}, tt.args...)
+			stdout, stderr, code := runCommand(t, dir, nil, append(args, srv.URL+"/hello.txt")...)
+			if code != 0 {
+				t.Fatalf("exited with %d: %s", code, stderr)
+			}
+			if !strings.HasSuffix(stdout, tt.want) {
+				t.Errorf("got %q, want it to end with %q", stdout, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// Returned by the Download methods once the downloader is closed.
+var ErrClosed = errors.New("downloader is closed")
+
+// Releases what the downloader holds, it's meant for services creating many of them.
+// A running download is cancelled and waited for, so its partial file is gone by the time Close returns,
+// unless WithResume or WithKeepPartialOnError kept it on purpose. Idle connections of the client are closed too.
+// Close is idempotent, it's fine to call it after a failed or cancelled download, or more than once.
+func (d *downloader) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	cancel, done := d.cancel, d.done
+	d.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+
+	d.removeTempFile()
+	// Progress readers of a downloader closed before it downloaded anything would wait forever otherwise
+	d.closeProgress()
+	d.client.CloseIdleConnections()
+	return nil
+}
+
+// Cancels the running download, if any, which then returns context.Canceled like it would for a cancelled context.
+// Unlike Close it doesn't wait for the download to clean up and the downloader can be used again afterwards,
+// calling it while nothing is running does nothing, it doesn't cancel the next download.
+func (d *downloader) Cancel() {
+	d.mu.Lock()
+	cancel := d.cancel
+	d.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// Registers a starting download so Close can cancel it, it fails once the downloader is closed
+// or while another download is running.
+// The returned function must be called when the download returns.
+func (d *downloader) track(cancel context.CancelFunc) (untrack func(), err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	if d.cancel != nil {
+		return nil, errors.New("another download is already running on this downloader")
+	}
+
+	done := make(chan struct{})
+	d.cancel, d.done = cancel, done
+	return func() {
+		// What the download didn't read of the custom request, see customDetails
+		d.dropFirstResponse()
+		d.mu.Lock()
+		d.cancel, d.done = nil, nil
+		d.mu.Unlock()
+		close(done)
+	}, nil
+}
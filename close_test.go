@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClose(t *testing.T) {
+	inTempDir(t)
+	srv := stallingServer(testContent(1<<20), 5*time.Second)
+	defer srv.Close()
+	before := runtime.NumGoroutine()
+
+	d := newTestDownloader(4)
+	d.WithProgress(true, 5)
+	// Streamed to a partial file Close has to remove
+	d.WithMemoryBuffering(0)
+	errc := make(chan error)
+	go func() {
+		_, err := d.Download(srv.URL + "/file.bin")
+		errc <- err
+	}()
+	waitFor(t, func() bool {
+		_, err := os.Stat("file.bin.part")
+		return err == nil
+	})
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if names, _ := filepath.Glob("*"); len(names) != 0 {
+		t.Errorf("left %v behind", names)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Errorf("closing again failed: %v", err)
+	}
+	if _, err := d.Download(srv.URL + "/file.bin"); !errors.Is(err, ErrClosed) {
+		t.Errorf("got %v, want ErrClosed", err)
+	}
+
+	srv.CloseClientConnections()
+	waitFor(t, func() bool { return runtime.NumGoroutine() <= before })
+}
+
+// Waits up to a few seconds for done to report true.
+func waitFor(t *testing.T, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !done(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	inTempDir(t)
+	srv := stallingServer(testContent(1<<20), 5*time.Second)
+	defer srv.Close()
+	fast := serveContent(testContent(1 << 20))
+	defer fast.Close()
+
+	d := newTestDownloader(2)
+	// Nothing is running, so the next download isn't affected
+	d.Cancel()
+	if _, err := d.Download(fast.URL + "/a.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		d.Cancel()
+	}()
+	started := time.Now()
+	if _, err := d.Download(srv.URL + "/b.bin"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want the download cancelled", err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("took %v to return after the cancel", elapsed)
+	}
+	if _, err := os.Stat("b.bin.part"); err == nil {
+		t.Error("the partial file is left")
+	}
+
+	// Calling it after the download is done is harmless too, the downloader still works
+	d.Cancel()
+	if _, err := d.Download(fast.URL + "/c.bin"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownloadsInterrupted(t *testing.T) {
+	inTempDir(t)
+	srv := serveContent(testContent(1000))
+	defer srv.Close()
+	url := srv.URL + "/file.bin"
+	downloads := map[string]func(d *downloader, ctx context.Context) error{
+		"Download": func(d *downloader, ctx context.Context) error {
+			_, err := d.DownloadContext(ctx, url)
+			return err
+		},
+		"DownloadToWriter": func(d *downloader, ctx context.Context) error {
+			return d.DownloadToWriter(ctx, url, io.Discard)
+		},
+		"RetryRanges": func(d *downloader, ctx context.Context) error {
+			_, err := d.RetryRanges(ctx, url, [][2]int{{0, 99}})
+			return err
+		},
+	}
+
+	for name, download := range downloads {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			d := newTestDownloader(2)
+			err := download(d, ctx)
+			if !errors.Is(err, context.Canceled) || !strings.Contains(err.Error(), "interrupted") {
+				t.Errorf("got %v, want the download interrupted", err)
+			}
+
+			d.Close()
+			if err := download(d, context.Background()); !errors.Is(err, ErrClosed) {
+				t.Errorf("got %v, want ErrClosed", err)
+			}
+		})
+	}
+}
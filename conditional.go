@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Returned when the server answered 304 to the If-Modified-Since of WithIfModifiedSince,
+// Download reports it as a skipped download instead since the file it would replace is already there.
+var ErrNotModified = errors.New("file not modified on the server")
+
+// Asks the server to only send the file if it changed after t, a download of an unchanged file
+// returns the path it would have been saved to without touching it, see DownloadResult.NotModified.
+// It's most useful with ExistingFileOverwrite and t being the modification time of the local copy.
+func (d *downloader) WithIfModifiedSince(t time.Time) {
+	d.ifModifiedSince = t
+}
+
+// Adds If-Modified-Since to the requests asking about the file, the workers don't need it
+// since they only start once the server said there's something to download.
+func (d *downloader) setIfModifiedSince(request *http.Request) {
+	if !d.ifModifiedSince.IsZero() {
+		request.Header.Set("If-Modified-Since", d.ifModifiedSince.UTC().Format(http.TimeFormat))
+	}
+}
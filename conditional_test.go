@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIfModifiedSince(t *testing.T) {
+	data := testContent(5000)
+	modified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var notModified, gets atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+		}
+		http.ServeContent(w, r, "file.bin", modified, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name  string
+		since time.Time
+		// Whether the server answers 304 and the old file stays
+		unchanged bool
+	}{
+		{"unchanged", modified.Add(time.Hour), true},
+		{"changed", modified.Add(-time.Hour), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			notModified.Store(0)
+			gets.Store(0)
+			if err := os.WriteFile("file.bin", []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			d := newTestDownloader(3)
+			d.WithExistingFilePolicy(ExistingFileOverwrite)
+			d.WithIfModifiedSince(tt.since)
+			result, err := d.DownloadWithResult(context.Background(), srv.URL+"/file.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := os.ReadFile("file.bin")
+			if tt.unchanged {
+				if !result.NotModified || !result.Skipped || string(got) != "old" {
+					t.Errorf("got %+v and %q, want the old file left alone", result, got)
+				}
+				if notModified.Load() != 1 || gets.Load() != 0 {
+					t.Errorf("got %d 304s and %d GETs, want only the 304", notModified.Load(), gets.Load())
+				}
+				return
+			}
+			if result.NotModified || !bytes.Equal(got, data) {
+				t.Errorf("got %+v, want the changed file downloaded", result)
+			}
+		})
+	}
+}
+
+func TestIfModifiedSinceBytes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(3)
+	d.WithIfModifiedSince(time.Now())
+	if _, err := d.DownloadBytes(context.Background(), srv.URL+"/file.bin"); !errors.Is(err, ErrNotModified) {
+		t.Errorf("got %v, want ErrNotModified", err)
+	}
+}
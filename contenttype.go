@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Returned when the server sends something else than the type set by WithExpectedContentType.
+var ErrUnexpectedContentType = errors.New("unexpected content type")
+
+// Makes the download fail with ErrUnexpectedContentType when the Content-Type of the response doesn't start
+// with prefix, like application/zip or video/, or when the start of the file looks like an HTML page while
+// something else was expected, the login or error page a server answered with instead of the file.
+// A response without Content-Type is only checked by its content. It's off by default, the empty prefix.
+func (d *downloader) WithExpectedContentType(prefix string) {
+	d.expectedContentType = strings.ToLower(prefix)
+}
+
+// Checks the Content-Type of a response against the expected one, if any.
+func (d *downloader) checkContentType(header http.Header) error {
+	contentType := header.Get("Content-Type")
+	if d.expectedContentType == "" || contentType == "" {
+		return nil
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+	if !strings.HasPrefix(strings.ToLower(contentType), d.expectedContentType) {
+		return fmt.Errorf("%w: expected %s, the server sent %s", ErrUnexpectedContentType, d.expectedContentType, contentType)
+	}
+	return nil
+}
+
+// Wraps w, where the file is written from offset on, so the start of the file is checked for an HTML page.
+func (d *downloader) sniffed(w io.Writer, offset int) io.Writer {
+	if d.expectedContentType == "" || offset != 0 || strings.HasPrefix("text/html", d.expectedContentType) {
+		return w
+	}
+	return &sniffingWriter{w: w, expected: d.expectedContentType}
+}
+
+// Looks at the first bytes written through it and fails when they're HTML.
+type sniffingWriter struct {
+	w        io.Writer
+	expected string
+	checked  bool
+}
+
+func (s *sniffingWriter) Write(p []byte) (int, error) {
+	if !s.checked && len(p) > 0 {
+		s.checked = true
+		if strings.HasPrefix(http.DetectContentType(p), "text/html") {
+			return 0, fmt.Errorf("%w: expected %s, the file looks like an HTML page", ErrUnexpectedContentType, s.expected)
+		}
+	}
+	return s.w.Write(p)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExpectedContentType(t *testing.T) {
+	page := []byte("<!DOCTYPE html><html><body>Please log in</body></html>")
+	loginPage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	}))
+	defer loginPage.Close()
+	// Says it's a zip, the content tells otherwise
+	lying := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		http.ServeContent(w, r, "file.zip", time.Time{}, bytes.NewReader(append(page, bytes.Repeat([]byte(" "), 3<<20)...)))
+	}))
+	defer lying.Close()
+	archive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		http.ServeContent(w, r, "file.zip", time.Time{}, bytes.NewReader(testContent(3<<20)))
+	}))
+	defer archive.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		expected string
+		err      error
+	}{
+		{"not checked", loginPage.URL, "", nil},
+		{"HTML page", loginPage.URL, "application/zip", ErrUnexpectedContentType},
+		{"HTML page sent as a zip", lying.URL, "application/zip", ErrUnexpectedContentType},
+		{"zip", archive.URL, "application/zip", nil},
+		{"text expected", loginPage.URL, "text/", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			d := newTestDownloader(4)
+			// Fails the same with retries to spare
+			d.WithRetries(3, time.Millisecond)
+			d.WithExpectedContentType(tt.expected)
+			_, err := d.Download(tt.url + "/file.zip")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if tt.err == nil {
+				return
+			}
+			if _, err := os.Stat("file.zip"); err == nil {
+				t.Error("the page is saved as the file")
+			}
+			if exitCode(err) == 0 || errorHint(err) == "" {
+				t.Errorf("got the exit code %d and hint %q", exitCode(err), errorHint(err))
+			}
+		})
+	}
+}
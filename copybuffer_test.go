@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// Compares the copy buffer sizes on a body coming over loopback into a file, the default is 256 KB.
+func BenchmarkCopyBufferSize(b *testing.B) {
+	data := testContent(32 << 20)
+	srv := serveContent(data)
+	defer srv.Close()
+
+	for _, size := range []int{32 << 10, 64 << 10, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dK", size>>10), func(b *testing.B) {
+			d := NewDownloader(1)
+			d.WithCopyBufferSize(size)
+			file, err := os.Create(filepath.Join(b.TempDir(), "file.bin"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer file.Close()
+			w := &writeCounter{w: file}
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(srv.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := file.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				n, err := d.copyBody(w, resp.Body)
+				resp.Body.Close()
+				if err != nil || n != int64(len(data)) {
+					b.Fatal(n, err)
+				}
+			}
+			b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+// Counts the writes going to w.
+type writeCounter struct {
+	w      io.Writer
+	writes int
+}
+
+func (c *writeCounter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.w.Write(p)
+}
+
+// Compares the write buffer sizes on a file buffered in many small chunks, the default is 1 MB.
+func BenchmarkWriteBufferSize(b *testing.B) {
+	const chunkSize, chunks = 16 << 10, 1024
+	data := testContent(chunkSize * chunks)
+
+	for _, size := range []int{4 << 10, 64 << 10, 1 << 20, 4 << 20} {
+		b.Run(fmt.Sprintf("%dK", size>>10), func(b *testing.B) {
+			d := NewDownloader(1)
+			d.WithWriteBufferSize(size)
+			file, err := os.Create(filepath.Join(b.TempDir(), "file.bin"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer file.Close()
+			w := &writeCounter{w: file}
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				d.reset()
+				d.ranges = splitRanges(len(data), chunks)
+				d.written = make([]atomic.Int64, chunks)
+				d.chunks = make([]bytes.Buffer, chunks)
+				for j, r := range d.ranges {
+					d.chunks[j].Write(data[r[0] : r[1]+1])
+					d.written[j].Store(int64(r[1] - r[0] + 1))
+				}
+				if _, err := file.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+
+				buffered := d.bufferedWriter(w)
+				if err := d.writeChunks(buffered, nil, 0); err != nil {
+					b.Fatal(err)
+				}
+				if err := buffered.Flush(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Hash algorithms of Repr-Digest we can verify, the first one the server sent is used.
+var reprDigestAlgos = []struct{ name, algo string }{
+	{"sha-512", "sha512"},
+	{"sha-256", "sha256"},
+}
+
+// Returns the digest of the whole file the server advertised in header, as a hex string and the
+// algorithm WithChecksum would take, or empty strings when there's none we can check.
+// Repr-Digest covers the file whatever part of it a response carries, Content-MD5 only its body,
+// so the latter is only taken when whole says the response is for the whole file.
+func advertisedDigest(header http.Header, whole bool) (algo, digest string) {
+	if value := header.Get("Repr-Digest"); value != "" {
+		digests := parseReprDigest(value)
+		for _, known := range reprDigestAlgos {
+			if digest, ok := digests[known.name]; ok {
+				return known.algo, digest
+			}
+		}
+	}
+
+	if value := header.Get("Content-MD5"); value != "" && whole {
+		if sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value)); err == nil && len(sum) == 16 {
+			return "md5", hex.EncodeToString(sum)
+		}
+	}
+	return "", ""
+}
+
+// Parses a Repr-Digest header like "sha-256=:base64:, sha-512=:base64:" into hex digests by algorithm.
+func parseReprDigest(value string) map[string]string {
+	digests := map[string]string{}
+	for _, member := range strings.Split(value, ",") {
+		name, encoded, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || len(encoded) < 2 || encoded[0] != ':' || encoded[len(encoded)-1] != ':' {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(encoded[1 : len(encoded)-1])
+		if err != nil {
+			continue
+		}
+		digests[strings.ToLower(name)] = hex.EncodeToString(sum)
+	}
+	return digests
+}
+
+// Verifies the download against the digest the server advertised for it when WithChecksum wasn't used,
+// a decoded file can't be since the digest is of what was sent.
+func (d *downloader) useAdvertisedDigest(details rangeDetails, name string) {
+	if d.checksumAlgo != "" {
+		return
+	}
+	if details.digestAlgo == "" {
+		d.logger.Infof("the server advertised no digest for %s, it can't be verified", name)
+		return
+	}
+	if d.decompress && isEncoded(details.encoding) {
+		d.logger.Infof("%s is decoded, it can't be verified against the digest the server advertised", name)
+		return
+	}
+	d.logger.Debugf("verifying %s against the %s digest the server advertised", name, details.digestAlgo)
+	d.advertisedAlgo, d.advertisedDigest = details.digestAlgo, details.digest
+}
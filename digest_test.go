@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdvertisedDigest(t *testing.T) {
+	data := testContent(20000)
+	md5sum := md5.Sum(data)
+	sha256sum := sha256.Sum256(data)
+	tests := []struct {
+		name          string
+		header, value string
+		// Whether a byte of the body is flipped on the way
+		corrupt bool
+	}{
+		{"Content-MD5", "Content-MD5", base64.StdEncoding.EncodeToString(md5sum[:]), false},
+		{"corrupt Content-MD5", "Content-MD5", base64.StdEncoding.EncodeToString(md5sum[:]), true},
+		{"Repr-Digest", "Repr-Digest", "unknown=:AAAA:, sha-256=:" + base64.StdEncoding.EncodeToString(sha256sum[:]) + ":", false},
+		{"corrupt Repr-Digest", "Repr-Digest", "sha-256=:" + base64.StdEncoding.EncodeToString(sha256sum[:]) + ":", true},
+	}
+
+	for _, tt := range tests {
+		for _, workers := range []int{1, 4} {
+			t.Run(fmt.Sprintf("%s/%d", tt.name, workers), func(t *testing.T) {
+				inTempDir(t)
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set(tt.header, tt.value)
+					body := data
+					if tt.corrupt && r.Method == http.MethodGet {
+						body = bytes.Clone(data)
+						body[15000] ^= 1
+					}
+					http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(body))
+				}))
+				defer srv.Close()
+
+				_, err := newTestDownloader(workers).Download(srv.URL + "/file.bin")
+				if tt.corrupt != errors.Is(err, ErrChecksumMismatch) || !tt.corrupt && err != nil {
+					t.Errorf("got %v, corrupted: %v", err, tt.corrupt)
+				}
+			})
+		}
+	}
+}
+
+func TestAdvertisedDigestMissing(t *testing.T) {
+	inTempDir(t)
+	srv := serveContent(testContent(1000))
+	defer srv.Close()
+
+	logger := &capturingLogger{}
+	d := newTestDownloader(2)
+	d.WithLogger(logger)
+	if _, err := d.Download(srv.URL + "/file.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if !logger.logged("INFO", "the server advertised no digest") {
+		t.Errorf("got %q, want the missing digest told", logger.messages)
+	}
+}
+
+func TestAdvertisedDigestExplicitChecksum(t *testing.T) {
+	inTempDir(t)
+	data := testContent(1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Wrong, and not looked at since the checksum is given
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(make([]byte, 16)))
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	sum := sha256.Sum256(data)
+	d := newTestDownloader(2)
+	d.WithChecksum("sha256", hex.EncodeToString(sum[:]))
+	if _, err := d.Download(srv.URL + "/file.bin"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdvertisedDigestHeaders(t *testing.T) {
+	sum := sha256.Sum256([]byte("x"))
+	encoded := base64.StdEncoding.EncodeToString(sum[:])
+	tests := []struct {
+		name   string
+		header http.Header
+		whole  bool
+		algo   string
+	}{
+		{"Repr-Digest", http.Header{"Repr-Digest": {"sha-256=:" + encoded + ":"}}, false, "sha256"},
+		{"Content-MD5 of the file", http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:16])}}, true, "md5"},
+		// Only covers the part of the file in the response
+		{"Content-MD5 of a range", http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:16])}}, false, ""},
+		{"malformed", http.Header{"Repr-Digest": {"sha-256=" + encoded}}, true, ""},
+		{"none", http.Header{}, true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			algo, digest := advertisedDigest(tt.header, tt.whole)
+			if algo != tt.algo {
+				t.Errorf("got %q, want %q", algo, tt.algo)
+			}
+			if algo == "sha256" && digest != hex.EncodeToString(sum[:]) {
+				t.Errorf("got the digest %s", digest)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Returned when the destination doesn't have room for the file, before anything is downloaded.
+var ErrInsufficientSpace = errors.New("not enough free disk space")
+
+// Reports the bytes available to us on the filesystem holding dir, it's a variable so it can be replaced.
+// Platforms without a way to tell return errDiskSpaceUnknown.
+var freeDiskSpace = diskFreeSpace
+
+var errDiskSpaceUnknown = errors.New("free disk space is unknown on this platform")
+
+// Checks there's room for the file in its destination directory before downloading it, which is the default.
+// A long download of a big file would otherwise only fail once the disk fills up.
+func (d *downloader) WithPreflightDiskCheck(enabled bool) {
+	d.preflightDiskCheck = enabled
+}
+
+// Fails with ErrInsufficientSpace when dir can't hold size more bytes, a size or free space
+// that isn't known lets the download go ahead.
+func (d *downloader) checkDiskSpace(dir string, size int) error {
+	if !d.preflightDiskCheck || size <= 0 || !d.onDisk() {
+		return nil
+	}
+
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		d.logger.Debugf("skipping the disk space check of %s: %v", dir, err)
+		return nil
+	}
+
+	if uint64(size) > free {
+		return fmt.Errorf("%w in %s: %d bytes needed, %d available", ErrInsufficientSpace, dir, size, free)
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+func diskFreeSpace(dir string) (uint64, error) {
+	return 0, errDiskSpaceUnknown
+}
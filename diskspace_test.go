@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPreflightDiskCheck(t *testing.T) {
+	inTempDir(t)
+	var gets atomic.Int64
+	srv := getCountingServer(testContent(5000), &gets)
+	defer srv.Close()
+	original := freeDiskSpace
+	defer func() { freeDiskSpace = original }()
+	freeDiskSpace = func(string) (uint64, error) { return 100, nil }
+
+	if _, err := newTestDownloader(2).Download(srv.URL + "/file.bin"); !errors.Is(err, ErrInsufficientSpace) {
+		t.Fatalf("got %v, want ErrInsufficientSpace", err)
+	}
+	if gets.Load() != 0 {
+		t.Errorf("%d GETs went out for a file that doesn't fit", gets.Load())
+	}
+	if names, _ := filepath.Glob("*"); len(names) != 0 {
+		t.Errorf("left %v behind", names)
+	}
+
+	d := newTestDownloader(2)
+	d.WithPreflightDiskCheck(false)
+	if _, err := d.Download(srv.URL + "/file.bin"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFreeDiskSpace(t *testing.T) {
+	free, err := freeDiskSpace(t.TempDir())
+	if errors.Is(err, errDiskSpaceUnknown) {
+		t.Skip(err)
+	}
+	if err != nil || free == 0 {
+		t.Errorf("got %d bytes, %v", free, err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// How DownloadAll saves the files.
+type DownloadAllOptions struct {
+	// Directory the files are saved in, the output of the downloader or the current directory by default
+	Dir string
+	// How many files are downloaded at once, 3 by default
+	Parallel int
+	// Builds the name of each file out of {index}, its position in the URLs starting at 1, {name}, the name
+	// it would have on its own, {host} and {path}, the path of its URL with the slashes turned into underscores.
+	// For instance "{index}-{name}" or "{host}_{path}", empty means "{name}".
+	NameTemplate string
+}
+
+// Downloads every one of urls into a directory, a few of them at a time, each with its own copy of the options
+// of the downloader except for the checksum and progress, which only make sense for a single file.
+// Files that would end up with the same name get a -1, -2 and so on before their extension.
+// It returns the outcome of each URL in the same order, a failing one doesn't stop the others
+// and the error then joins the errors of all the failed ones.
+func (d *downloader) DownloadAll(ctx context.Context, urls []string, opts DownloadAllOptions) ([]DownloadResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	untrack, err := d.track(cancel)
+	if err != nil {
+		return nil, err
+	}
+	defer untrack()
+
+	dir := opts.Dir
+	if dir == "" {
+		dir = d.output
+	}
+	parallel := opts.Parallel
+	if parallel <= 0 {
+		parallel = 3
+	}
+	names := &nameClaims{claimed: map[string]bool{}}
+	// The files share the client, and its connections
+	d.growConnectionPool(parallel * max(d.workersCount, d.autoMaxWorkers, d.maxConcurrency))
+
+	results := make([]DownloadResult, len(urls))
+	errs := make([]error, len(urls))
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, fileURL := range urls {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, fileURL string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			file := d.batchCopy(dir)
+			file.nameFile = func(dirs, name string) string {
+				return names.claim(filepath.Join(dirs, expandNameTemplate(opts.NameTemplate, i+1, fileURL, name)))
+			}
+			results[i], errs[i] = file.DownloadWithResult(ctx, fileURL)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("%s: %w", redactURL(fileURL), errs[i])
+			}
+		}(i, fileURL)
+	}
+	wg.Wait()
+
+	return results, errors.Join(errs...)
+}
+
+// Returns a downloader with the options of d saving into dir, sharing its client and rate limit.
+func (d *downloader) batchCopy(dir string) *downloader {
+	c := withOptions(d.options)
+	// Progress and the checksum only make sense for a single file, DownloadAll names the files itself
+	c.progressEnabled, c.progressCallback, c.progressWriter, c.bytesCallback = false, nil, nil, nil
+	c.checksumAlgo, c.checksumExpected = "", ""
+	c.nameFile = nil
+	c.headers = d.headers.Clone()
+	// A trailing separator makes sure it's taken as a directory, even before it exists
+	if dir != "" && !os.IsPathSeparator(dir[len(dir)-1]) {
+		dir += string(filepath.Separator)
+	}
+	c.output = dir
+	return c
+}
+
+// Expands the placeholders of template for the file at position index, see DownloadAllOptions.NameTemplate.
+func expandNameTemplate(template string, index int, fileURL, name string) string {
+	if template == "" {
+		return name
+	}
+
+	host, urlPath := "", ""
+	if u, err := url.Parse(fileURL); err == nil {
+		host = u.Hostname()
+		urlPath = strings.ReplaceAll(strings.Trim(u.Path, "/"), "/", "_")
+	}
+
+	expanded := strings.NewReplacer(
+		"{index}", strconv.Itoa(index),
+		"{name}", name,
+		"{host}", host,
+		"{path}", urlPath,
+	).Replace(template)
+	if expanded = cleanFileName(expanded); expanded == "" {
+		return name
+	}
+	return expanded
+}
+
+// Names already taken by the files of a DownloadAll.
+type nameClaims struct {
+	mu      sync.Mutex
+	claimed map[string]bool
+}
+
+// Takes name, or the first of name-1, name-2 and so on that's still free, keeping the extension last.
+func (n *nameClaims) claim(name string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 1; n.claimed[candidate]; i++ {
+		candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	n.claimed[candidate] = true
+	return candidate
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serves a under /a/ and b under /b/, both named file.bin, and 404s the rest.
+func collidingServer(a, b []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/a/"):
+			http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(a))
+		case strings.HasPrefix(r.URL.Path, "/b/"):
+			http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(b))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestDownloadAll(t *testing.T) {
+	inTempDir(t)
+	a, b := testContent(3000), testContent(4000)
+	srv := collidingServer(a, b)
+	defer srv.Close()
+	if err := os.Mkdir("out", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	urls := []string{srv.URL + "/a/file.bin", srv.URL + "/missing/file.bin", srv.URL + "/b/file.bin"}
+	results, err := newTestDownloader(2).DownloadAll(context.Background(), urls, DownloadAllOptions{Dir: "out"})
+	if err == nil || !strings.Contains(err.Error(), "/missing/file.bin: unexpected status 404") {
+		t.Fatalf("got %v, want the missing file reported", err)
+	}
+	if strings.Contains(err.Error(), "/a/") || strings.Contains(err.Error(), "/b/") {
+		t.Errorf("got %v, the other files failed too", err)
+	}
+	if len(results) != len(urls) {
+		t.Fatalf("got %d results for %d URLs", len(results), len(urls))
+	}
+
+	for i, want := range map[int][]byte{0: a, 2: b} {
+		if got, _ := os.ReadFile(results[i].Path); !bytes.Equal(got, want) {
+			t.Errorf("%s doesn't match", urls[i])
+		}
+	}
+	// Whichever got there first keeps the name
+	names := []string{filepath.Base(results[0].Path), filepath.Base(results[2].Path)}
+	sort.Strings(names)
+	if names[0] != "file-1.bin" || names[1] != "file.bin" {
+		t.Errorf("got %v, want file.bin and file-1.bin", names)
+	}
+	if entries, _ := os.ReadDir("out"); len(entries) != 2 {
+		t.Errorf("got %d files in the directory, want 2", len(entries))
+	}
+}
+
+func TestDownloadAllNameTemplate(t *testing.T) {
+	inTempDir(t)
+	srv := collidingServer(testContent(3000), testContent(4000))
+	defer srv.Close()
+
+	d := newTestDownloader(2)
+	d.WithCreateDirs(true)
+	urls := []string{srv.URL + "/a/file.bin", srv.URL + "/b/file.bin"}
+	results, err := d.DownloadAll(context.Background(), urls, DownloadAllOptions{Dir: "out", NameTemplate: "{index}-{path}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"1-a_file.bin", "2-b_file.bin"} {
+		if got := results[i].Path; filepath.Base(got) != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+}
+
+func TestExpandNameTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"", "file.bin"},
+		{"{name}", "file.bin"},
+		{"{index}-{name}", "7-file.bin"},
+		{"{host}_{path}", "example.com_dir_sub_file.bin"},
+		// Nothing usable is left, so the name is kept
+		{"/", "file.bin"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			if got := expandNameTemplate(tt.template, 7, "https://example.com/dir/sub/file.bin?x=1", "file.bin"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNameClaims(t *testing.T) {
+	claims := &nameClaims{claimed: map[string]bool{}}
+	for _, want := range []string{"file.tar.gz", "file.tar-1.gz", "file.tar-2.gz"} {
+		if got := claims.claim("file.tar.gz"); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if got := claims.claim("other"); got != "other" {
+		t.Errorf("got %q, want other", got)
+	}
+	if got := claims.claim("other"); got != "other-1" {
+		t.Errorf("got %q, want other-1", got)
+	}
+}
+
+func TestBatchCopy(t *testing.T) {
+	d := newTestDownloader(3)
+	d.WithRetries(2, time.Second)
+	d.WithTempDir("partial")
+	d.WithComputedChecksums("md5")
+	d.WithChecksum("sha256", strings.Repeat("0", 64))
+	d.WithProgressCallback(func(Progress) {})
+	d.headers.Set("X-Test", "1")
+
+	c := d.batchCopy("out")
+	if c.checksumAlgo != "" || c.progressCallback != nil || c.progressEnabled {
+		t.Error("the checksum or the progress was copied")
+	}
+	if c.output != "out"+string(filepath.Separator) {
+		t.Errorf("got output %q", c.output)
+	}
+	c.headers.Set("X-Test", "2")
+	if d.headers.Get("X-Test") != "1" {
+		t.Error("the headers are shared")
+	}
+
+	// Everything else is the same
+	want, got := d.options, c.options
+	for _, o := range []*options{&want, &got} {
+		o.progressEnabled, o.progressCallback, o.progressWriter, o.bytesCallback = false, nil, nil, nil
+		o.checksumAlgo, o.checksumExpected = "", ""
+		o.nameFile, o.retryable = nil, nil
+		o.headers, o.output = nil, ""
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Decodes a body the server sent gzip or deflate encoded, which is the default, so the file is stored as it's meant to be.
+// Disabled, the encoded bytes are stored as they came.
+// Encoded files are always downloaded by a single worker, ranges of them can't be decoded on their own.
+func (d *downloader) WithDecompress(enabled bool) {
+	d.decompress = enabled
+}
+
+// Reports whether a Content-Encoding means the body isn't the file itself.
+func isEncoded(encoding string) bool {
+	return encoding != "" && encoding != "identity"
+}
+
+// Wraps r with a reader decoding encoding.
+func decoder(encoding string, r io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return zlib.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+}
+
+// Counts the bytes read through it, so progress follows the encoded body rather than what it decodes to.
+type countingReader struct {
+	r    io.Reader
+	read *atomic.Int64
+	// Given the bytes of every read when set, see bytesReporter.
+	report func(p []byte)
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.read.Add(int64(n))
+	if cr.report != nil {
+		cr.report(p[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDecompress(t *testing.T) {
+	data := bytes.Repeat([]byte("hello gzip world "), 20000)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(data)
+	zw.Close()
+	var ranged atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranged.Store(true)
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.Itoa(compressed.Len()))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(compressed.Bytes())
+	}))
+	defer srv.Close()
+
+	// Streamed to disk and buffered in memory
+	for _, memory := range []int{0, 1 << 30} {
+		t.Run(strconv.Itoa(memory), func(t *testing.T) {
+			inTempDir(t)
+			d := newTestDownloader(4)
+			d.WithMemoryBuffering(memory)
+			d.WithProgress(true, 1)
+			done := make(chan int)
+			go func() {
+				last := 0
+				for p := range d.ConsumeProgress() {
+					last = p
+				}
+				done <- last
+			}()
+
+			result, err := d.DownloadWithResult(context.Background(), srv.URL+"/file.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(result.Path); !bytes.Equal(got, data) {
+				t.Errorf("got %d bytes, want the %d decompressed ones", len(got), len(data))
+			}
+			if result.Multipart || ranged.Load() {
+				t.Error("encoded content was asked in ranges")
+			}
+			// Measured against the compressed bytes
+			if last := <-done; last != 100 {
+				t.Errorf("the last progress is %d, want 100", last)
+			}
+		})
+	}
+
+	d := newTestDownloader(4)
+	d.WithDecompress(false)
+	got, err := d.DownloadBytes(context.Background(), srv.URL+"/file.txt")
+	if err != nil || !bytes.Equal(got, compressed.Bytes()) {
+		t.Errorf("got %d bytes, %v, want the %d compressed ones", len(got), err, compressed.Len())
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Returned when the output file already exists and the policy is ExistingFileError.
+var ErrFileExists = errors.New("file already exists")
+
+// What Download does when the output file already exists.
+type ExistingFilePolicy int
+
+const (
+	// Fail the download without touching the existing file, it's the default.
+	ExistingFileError ExistingFilePolicy = iota
+	// Keep the existing file and return its path as if it was just downloaded,
+	// unless it doesn't match the checksum given with WithChecksum.
+	ExistingFileSkip
+	// Replace the existing file once the new one is completely downloaded.
+	ExistingFileOverwrite
+)
+
+func (d *downloader) WithExistingFilePolicy(policy ExistingFilePolicy) {
+	d.existingFilePolicy = policy
+}
+
+// Accepts the values of the --if-exists flag.
+func parseExistingFilePolicy(value string) (ExistingFilePolicy, error) {
+	switch strings.ToLower(value) {
+	case "error":
+		return ExistingFileError, nil
+	case "skip":
+		return ExistingFileSkip, nil
+	case "overwrite":
+		return ExistingFileOverwrite, nil
+	default:
+		return 0, fmt.Errorf("unknown policy %q, use error, skip or overwrite", value)
+	}
+}
+
+// Applies the existing file policy to filePath, skip tells the caller to stop and return filePath as is.
+// With a checksum, a file matching it is kept whatever the policy, and one that doesn't is never skipped.
+func (d *downloader) checkExisting(filePath string) (skip bool, err error) {
+	if _, err := d.fs.Stat(filePath); err != nil {
+		return false, nil
+	}
+
+	if d.checksumAlgo != "" {
+		matches, err := d.matchesChecksum(filePath)
+		if err != nil {
+			return false, err
+		}
+		if matches {
+			d.logger.Infof("%s already matches the checksum, skipping", filePath)
+			return true, nil
+		}
+		if d.existingFilePolicy == ExistingFileSkip {
+			d.logger.Infof("%s doesn't match the checksum, downloading it again", filePath)
+			return false, nil
+		}
+	}
+
+	switch d.existingFilePolicy {
+	case ExistingFileSkip:
+		d.logger.Infof("%s already exists, skipping", filePath)
+		return true, nil
+	case ExistingFileOverwrite:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%s: %w", filePath, ErrFileExists)
+	}
+}
+
+// Reports whether WithOutput names the file itself, so its path is known before asking the server anything.
+func (d *downloader) outputIsFile() bool {
+	if d.output == "" || os.IsPathSeparator(d.output[len(d.output)-1]) {
+		return false
+	}
+	info, err := d.fs.Stat(d.output)
+	return err != nil || !info.IsDir()
+}
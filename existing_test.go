@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExistingFilePolicy(t *testing.T) {
+	data := testContent(1000)
+	old := []byte("old")
+	tests := []struct {
+		name   string
+		policy ExistingFilePolicy
+		err    error
+		want   []byte
+		// Whether the server is asked anything.
+		requests bool
+	}{
+		{"error", ExistingFileError, ErrFileExists, old, false},
+		{"skip", ExistingFileSkip, nil, old, false},
+		{"overwrite", ExistingFileOverwrite, nil, data, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			var requests atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+			}))
+			defer srv.Close()
+			if err := os.WriteFile("out.bin", old, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			d := newTestDownloader(2)
+			d.WithOutput("out.bin")
+			d.WithExistingFilePolicy(tt.policy)
+			path, err := d.Download(srv.URL + "/file.bin")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err == nil && path != "out.bin" {
+				t.Errorf("got %q, want out.bin", path)
+			}
+			if got, _ := os.ReadFile("out.bin"); !bytes.Equal(got, tt.want) {
+				t.Errorf("the file holds %d bytes, want %d", len(got), len(tt.want))
+			}
+			if tt.requests != (requests.Load() > 0) {
+				t.Errorf("the server got %d requests", requests.Load())
+			}
+			if names, _ := filepath.Glob("*"); len(names) != 1 {
+				t.Errorf("left %v behind", names)
+			}
+		})
+	}
+}
+
+// The name of the file is only known once the server was asked about it.
+func TestExistingFilePolicyDerivedName(t *testing.T) {
+	inTempDir(t)
+	srv := serveContent(testContent(1000))
+	defer srv.Close()
+	if err := os.WriteFile("file.bin", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newTestDownloader(2).Download(srv.URL + "/file.bin"); !errors.Is(err, ErrFileExists) {
+		t.Errorf("got %v, want ErrFileExists", err)
+	}
+
+	d := newTestDownloader(2)
+	d.WithExistingFilePolicy(ExistingFileSkip)
+	path, err := d.Download(srv.URL + "/file.bin")
+	if got, _ := os.ReadFile("file.bin"); err != nil || filepath.Base(path) != "file.bin" || string(got) != "old" {
+		t.Errorf("got %q, %v, holding %q", path, err, got)
+	}
+}
+
+func TestParseExistingFilePolicy(t *testing.T) {
+	for value, want := range map[string]ExistingFilePolicy{"error": ExistingFileError, "skip": ExistingFileSkip, "Overwrite": ExistingFileOverwrite} {
+		if got, err := parseExistingFilePolicy(value); err != nil || got != want {
+			t.Errorf("%q: got %v, %v, want %v", value, got, err, want)
+		}
+	}
+	if _, err := parseExistingFilePolicy("replace"); err == nil {
+		t.Error("an unknown policy parsed")
+	}
+}
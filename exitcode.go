@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// Exit codes of the CLI, 1 is for any other failure and 130 for an interrupted download.
+const (
+	exitFailure          = 1
+	exitUsage            = 2
+	exitNetwork          = 3
+	exitChecksumMismatch = 4
+	exitFileExists       = 5
+	exitIncomplete       = 6
+	exitRangeUnsupported = 7
+)
+
+// Marks an error in how the CLI was called, like a missing link or an invalid flag value.
+type usageError struct {
+	err error
+}
+
+func (e *usageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *usageError) Unwrap() error {
+	return e.err
+}
+
+func usagef(format string, args ...any) error {
+	return &usageError{fmt.Errorf(format, args...)}
+}
+
+// Picks the exit code of err, the first of its causes that has one wins.
+func exitCode(err error) int {
+	var usageErr *usageError
+	var rangesErr *RangesError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &usageErr):
+		return exitUsage
+	case errors.Is(err, ErrChecksumMismatch):
+		return exitChecksumMismatch
+	case errors.Is(err, ErrFileExists):
+		return exitFileExists
+	case errors.Is(err, ErrRangeNotSupported):
+		return exitRangeUnsupported
+	case errors.Is(err, ErrSizeMismatch), errors.Is(err, ErrFileChanged), errors.As(err, &rangesErr):
+		return exitIncomplete
+	case errors.As(err, &netErr), isThrottled(err):
+		return exitNetwork
+	default:
+		return exitFailure
+	}
+}
+
+// Tells what can be done about err, if anything.
+func errorHint(err error) string {
+	var usageErr *usageError
+	switch {
+	case errors.As(err, &usageErr):
+		return "see --help for how to use it"
+	case errors.Is(err, ErrChecksumMismatch):
+		return "the file was removed, check the expected digest or try again"
+	case errors.Is(err, ErrFileExists):
+		return "use --if-exists skip or --if-exists overwrite to go on anyway"
+	case errors.Is(err, ErrRangeNotSupported):
+		return "the server can't send parts of the file, try again with --workers-count 1"
+	case errors.Is(err, ErrFileChanged):
+		return "the file changed on the server, downloading it again starts it over"
+	case errors.Is(err, ErrSizeMismatch):
+		return "the connection may have been cut, try again with --retries or --resume"
+	case errors.Is(err, ErrUnexpectedContentType):
+		return "the server may have sent an error or login page, check the link and the credentials passed with it"
+	default:
+		return ""
+	}
+}
+
+// Prints err and what to do about it to stderr, then exits with its exit code.
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "error:", err)
+	if hint := errorHint(err); hint != "" {
+		fmt.Fprintln(os.Stderr, hint)
+	}
+	os.Exit(exitCode(err))
+}
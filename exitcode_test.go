@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTypedErrors(t *testing.T) {
+	data := testContent(3000)
+	srv := serveContent(data)
+	defer srv.Close()
+	noRanges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer noRanges.Close()
+	short := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", "3000")
+			return
+		}
+		// Sent chunked, so only the count of the bytes tells it came up short
+		w.Write(data[:1000])
+		w.(http.Flusher).Flush()
+	}))
+	defer short.Close()
+
+	tests := []struct {
+		name     string
+		download func() error
+		want     error
+		code     int
+	}{
+		{"checksum mismatch", func() error {
+			d := newTestDownloader(2)
+			d.WithChecksum("sha256", strings.Repeat("0", 64))
+			_, err := d.Download(srv.URL + "/file.bin")
+			return err
+		}, ErrChecksumMismatch, exitChecksumMismatch},
+		{"file exists", func() error {
+			if err := os.WriteFile("file.bin", nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := newTestDownloader(2).Download(srv.URL + "/file.bin")
+			return err
+		}, ErrFileExists, exitFileExists},
+		{"range not supported", func() error {
+			_, err := newTestDownloader(2).RetryRanges(context.Background(), noRanges.URL+"/file.bin", [][2]int{{0, 5}})
+			return err
+		}, ErrRangeNotSupported, exitRangeUnsupported},
+		{"size mismatch", func() error {
+			_, err := newTestDownloader(1).Download(short.URL + "/file.bin")
+			return err
+		}, ErrSizeMismatch, exitIncomplete},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			err := tt.download()
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if code := exitCode(err); code != tt.code {
+				t.Errorf("got the exit code %d, want %d", code, tt.code)
+			}
+			if errorHint(err) == "" {
+				t.Error("got no hint")
+			}
+		})
+	}
+}
+
+func TestExitCodeOfBatch(t *testing.T) {
+	tests := []struct {
+		name string
+		errs []error
+		want int
+	}{
+		{"same cause", []error{fmt.Errorf("a: %w", ErrFileExists), fmt.Errorf("b: %w", ErrFileExists)}, exitFileExists},
+		{"first cause", []error{fmt.Errorf("a: %w", ErrChecksumMismatch), errors.New("b: failed")}, exitChecksumMismatch},
+		{"no cause", []error{errors.New("a: failed")}, exitFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(&batchError{errs: tt.errs, total: 3}); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandExitCodes(t *testing.T) {
+	data := testContent(3000)
+	srv := serveContent(data)
+	defer srv.Close()
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name string
+		args []string
+		// Written to the directory beforehand
+		existing bool
+		code     int
+	}{
+		{"success", []string{srv.URL + "/file.bin"}, false, 0},
+		{"no link", nil, false, exitUsage},
+		{"unknown flag", []string{"--no-such-flag", srv.URL + "/file.bin"}, false, exitUsage},
+		{"connection refused", []string{closed.URL + "/file.bin"}, false, exitNetwork},
+		{"checksum mismatch", []string{"--checksum", "sha256:" + strings.Repeat("0", 64), srv.URL + "/file.bin"}, false, exitChecksumMismatch},
+		{"file exists", []string{srv.URL + "/file.bin"}, true, exitFileExists},
+		{"not found", []string{notFound.URL + "/file.bin"}, false, exitFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.existing {
+				if err := os.WriteFile(filepath.Join(dir, "file.bin"), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, stderr, code := runCommand(t, dir, nil, append([]string{"download", "-p=false"}, tt.args...)...)
+			if code != tt.code {
+				t.Errorf("exited with %d, want %d, stderr: %s", code, tt.code, stderr)
+			}
+			// The errors are printed as they are, without the timestamp of the log package
+			if code != 0 && !strings.HasPrefix(stderr, "error: ") {
+				t.Errorf("got %q on stderr", stderr)
+			}
+		})
+	}
+}
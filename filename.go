@@ -0,0 +1,106 @@
+package main
+
+import (
+	"mime"
+	"net/url"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// Used when nothing sensible can be derived from the URL.
+const defaultFileName = "download"
+
+// Prefers the name the server suggests through Content-Disposition and falls back to the URL.
+func fileName(rawURL string, details rangeDetails) string {
+	if name := cleanFileName(details.fileName); name != "" {
+		return name
+	}
+	return fileNameFromURL(rawURL)
+}
+
+// Derives the name to save a download under from the last segment of the URL path,
+// ignoring the query string and fragment and decoding percent-encoded characters.
+func fileNameFromURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return defaultFileName
+	}
+
+	name := path.Base(u.EscapedPath())
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		name = unescaped
+	}
+
+	if name = cleanFileName(name); name == "" {
+		return defaultFileName
+	}
+
+	return name
+}
+
+// Extracts the file name of a Content-Disposition header, both the plain filename
+// and the RFC 5987 encoded filename* forms are supported, the latter wins if both are present.
+func fileNameFromContentDisposition(header string) string {
+	if header == "" {
+		return ""
+	}
+
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+
+	return params["filename"]
+}
+
+// Makes the names derived from the URLs or the server valid on Windows, whatever the platform,
+// so the files can be copied there later. It's always done on Windows itself.
+func (d *downloader) WithPortableNames(enabled bool) {
+	d.portableNames = enabled
+}
+
+func (d *downloader) usesPortableNames() bool {
+	return d.portableNames || runtime.GOOS == "windows"
+}
+
+// Names Windows keeps for devices, with or without an extension.
+var reservedFileNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Replaces what Windows doesn't allow in a file name with underscores, its reserved characters,
+// control characters and trailing dots or spaces, and moves reserved names like CON or nul.txt out of the way.
+func portableFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 32 || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	if trimmed := strings.TrimRight(name, ". "); trimmed != name {
+		name = trimmed + "_"
+	}
+
+	stem, ext, _ := strings.Cut(name, ".")
+	if reservedFileNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		name = stem + "_"
+		if ext != "" {
+			name += "." + ext
+		}
+	}
+	return name
+}
+
+// Makes sure a name coming from the network can't point outside the output directory,
+// it returns an empty string when nothing usable is left.
+func cleanFileName(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+	if strings.Trim(name, "._ ") == "" {
+		return ""
+	}
+	return name
+}
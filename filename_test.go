@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestFileNameFromURL(t *testing.T) {
+	tests := []struct {
+		url, want string
+	}{
+		{"https://example.com/file.zip?token=abc", "file.zip"},
+		{"https://example.com/my%20file.zip", "my file.zip"},
+		{"https://example.com/dir/", "dir"},
+		{"https://example.com/", "download"},
+		{"https://example.com", "download"},
+		{"https://example.com/#fragment", "download"},
+		{"https://example.com/file.zip#fragment", "file.zip"},
+		{"https://example.com/a%2Fb", "a_b"},
+		{"https://example.com/..", "download"},
+	}
+
+	for _, tt := range tests {
+		if got := fileNameFromURL(tt.url); got != tt.want {
+			t.Errorf("fileNameFromURL(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestFileNameFromContentDisposition(t *testing.T) {
+	tests := []struct {
+		header, want string
+	}{
+		{`attachment; filename="real-name.pdf"`, "real-name.pdf"},
+		{`attachment; filename=plain.pdf`, "plain.pdf"},
+		{`attachment; filename*=UTF-8''na%C3%AFve%20file.txt`, "naïve file.txt"},
+		{`attachment; filename="fallback.txt"; filename*=UTF-8''better.txt`, "better.txt"},
+		{`attachment; filename="../../etc/passwd"`, ".._.._etc_passwd"},
+		{`inline`, ""},
+	}
+
+	for _, tt := range tests {
+		if got := cleanFileName(fileNameFromContentDisposition(tt.header)); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadContentDispositionName(t *testing.T) {
+	inTempDir(t)
+	data := testContent(1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="real-name.pdf"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	path, err := newTestDownloader(3).Download(srv.URL + "/download?id=1")
+	if err != nil || filepath.Base(path) != "real-name.pdf" {
+		t.Fatalf("got %q, %v", path, err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatal("downloaded file doesn't match")
+	}
+}
+
+func TestPortableFileName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"normal.zip", "normal.zip"},
+		{"a:b?c*.txt", "a_b_c_.txt"},
+		{`x"<>|.bin`, "x____.bin"},
+		{"tab\there", "tab_here"},
+		{"trail. . ", "trail_"},
+		{"CON", "CON_"},
+		{"nul.txt", "nul_.txt"},
+		{"com1.tar.gz", "com1_.tar.gz"},
+		{"lpt9 .log", "lpt9 _.log"},
+		// Only the exact names are reserved
+		{"CONSOLE.txt", "CONSOLE.txt"},
+	}
+
+	for _, tt := range tests {
+		if got := portableFileName(tt.name); got != tt.want {
+			t.Errorf("portableFileName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPortableNames(t *testing.T) {
+	tests := []struct {
+		url         string
+		disposition string
+		// The name without and with WithPortableNames
+		plain, portable string
+	}{
+		{"https://example.com/a%3Fb%3Ac.txt", "", "a?b:c.txt", "a_b_c.txt"},
+		{"https://example.com/report%7C2024%2A.csv", "", "report|2024*.csv", "report_2024_.csv"},
+		{"https://example.com/download", "AUX.pdf", "AUX.pdf", "AUX_.pdf"},
+		{"https://example.com/NUL", "", "NUL", "NUL_"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			details := rangeDetails{fileName: tt.disposition}
+			d := NewDownloader(1)
+			// Windows always gets the portable names
+			if runtime.GOOS != "windows" {
+				if got := d.saveName(tt.url, details); got != tt.plain {
+					t.Errorf("got %q, want %q", got, tt.plain)
+				}
+			}
+			d.WithPortableNames(true)
+			if got := d.saveName(tt.url, details); got != tt.portable {
+				t.Errorf("got %q with portable names, want %q", got, tt.portable)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+	"sync"
+)
+
+// What the chunks after one that failed fail with when they're written out as they arrive.
+var errChunkMissing = errors.New("an earlier chunk is missing")
+
+// Caps how many bytes DownloadToWriter, DownloadBytes and DownloadRange hold in memory at once, 0 means no cap.
+// The chunks are then written out in order as they arrive instead of all at the end, and a worker that gets
+// max bytes ahead of the writer waits for the chunks before its own to be written. The chunk being written
+// out never waits, so it works with any max, though one below the copy buffer size holds back all but that chunk.
+// A waiting worker gives its concurrency and WithHostLimiter slots back meanwhile, so the chunk being written out always
+// gets one. Adaptive work stealing hands out the chunks in order with it, so the next chunk to write is never left waiting.
+// Download and the other methods saving a file don't use it, the files they buffer are under WithMemoryBuffering.
+func (d *downloader) WithMaxBufferedBytes(max int) {
+	d.maxBufferedBytes = max
+}
+
+// Writes the in-memory chunks of a download to w in order while they arrive, holding on to the bytes of the
+// chunks after the one being written out, up to limit of them.
+type chunkFlusher struct {
+	d     *downloader
+	w     io.Writer
+	limit int64
+	stop  func() bool
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// The chunk being written out, every chunk before it is already written.
+	head int
+	// Bytes waiting in the buffers of the chunks after head.
+	buffered int64
+	// Bytes of each chunk written to w.
+	flushed []int64
+	// What the request of each chunk holds, see holdSlot.
+	slots [][]*heldSlot
+	// Set once writing to w failed or a chunk couldn't be downloaded, every write fails with it from then on.
+	err error
+}
+
+func (d *downloader) newChunkFlusher(ctx context.Context, w io.Writer, limit int) *chunkFlusher {
+	f := &chunkFlusher{d: d, w: w, limit: int64(limit), flushed: make([]int64, len(d.ranges)), slots: make([][]*heldSlot, len(d.ranges))}
+	f.cond = sync.NewCond(&f.mu)
+	// Wakes the waiting writes up, so a cancelled download doesn't stay stuck
+	f.stop = context.AfterFunc(ctx, func() {
+		f.fail(ctx.Err())
+	})
+	return f
+}
+
+// Fails the writes waiting and still to come, the chunks after a missing one can't be written out anymore.
+func (f *chunkFlusher) fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		f.err = err
+	}
+	f.cond.Broadcast()
+}
+
+// Reports whether every chunk was written out, once the download is over.
+func (f *chunkFlusher) complete() bool {
+	f.stop()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err == nil && f.head == len(f.flushed)
+}
+
+// Returns the writer of the chunk at index, for bytes starting at pos within it.
+func (f *chunkFlusher) chunkWriter(index int, pos int64) io.Writer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// What a chunk that starts over already holds past pos comes again
+	if chunk := &f.d.chunks[index]; index > f.head && pos < int64(chunk.Len()) {
+		f.buffered -= int64(chunk.Len()) - pos
+		chunk.Truncate(int(pos))
+		f.cond.Broadcast()
+	}
+	return &flushedChunk{f: f, index: index, pos: pos}
+}
+
+type flushedChunk struct {
+	f     *chunkFlusher
+	index int
+	pos   int64
+}
+
+func (c *flushedChunk) Write(p []byte) (int, error) {
+	f := c.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// A chunk started over sends again what was already written out
+	n := 0
+	if skip := f.flushed[c.index] - c.pos; skip > 0 {
+		n = int(min(skip, int64(len(p))))
+		c.pos += int64(n)
+		p = p[n:]
+	}
+
+	if err := f.waitForRoom(c.index, int64(len(p))); err != nil {
+		return n, err
+	}
+	if len(p) == 0 {
+		return n, nil
+	}
+
+	if c.index != f.head {
+		written, _ := f.d.chunks[c.index].Write(p)
+		f.buffered += int64(written)
+		c.pos += int64(written)
+		return n + written, nil
+	}
+
+	written, err := f.w.Write(p)
+	f.flushed[c.index] += int64(written)
+	c.pos += int64(written)
+	if err == nil {
+		err = f.advance()
+	}
+	if err != nil {
+		f.err = err
+		f.cond.Broadcast()
+	}
+	return n + written, err
+}
+
+// Reports whether size more bytes of the chunk at index can be taken, the head one is written out right away.
+func (f *chunkFlusher) fits(index int, size int64) bool {
+	return index == f.head || f.buffered+size <= f.limit
+}
+
+// Waits for size bytes of the chunk at index to fit, with f.mu held. The slots of the chunk are given back
+// while it waits and taken again before it goes on, otherwise the head chunk could be left without any.
+func (f *chunkFlusher) waitForRoom(index int, size int64) error {
+	for f.err == nil && !f.fits(index, size) {
+		slots := f.giveBack(index)
+		for f.err == nil && !f.fits(index, size) {
+			f.cond.Wait()
+		}
+		if err := f.takeBack(slots); err != nil {
+			return err
+		}
+	}
+	return f.err
+}
+
+// A slot of a limit on the requests, like the concurrency gate or HostLimiter, taken by a chunk's request.
+type heldSlot struct {
+	acquire func() (release func(), err error)
+	// Nil while the slot is given back.
+	release func()
+}
+
+// Takes a slot with acquire for the running request of the chunk at index, which the flusher can give back
+// while the chunk waits for room. The returned function releases it for good.
+func (d *downloader) holdSlot(index int, acquire func() (release func(), err error)) (release func(), err error) {
+	if d.flusher == nil {
+		return acquire()
+	}
+	f := d.flusher
+	slot := &heldSlot{acquire: acquire}
+	if slot.release, err = acquire(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	f.slots[index] = append(f.slots[index], slot)
+	f.mu.Unlock()
+	return func() {
+		f.mu.Lock()
+		f.slots[index] = slices.DeleteFunc(f.slots[index], func(s *heldSlot) bool { return s == slot })
+		release := slot.release
+		slot.release = nil
+		f.mu.Unlock()
+		if release != nil {
+			release()
+		}
+	}, nil
+}
+
+// Releases the slots of the chunk at index, with f.mu held, and returns them for takeBack.
+func (f *chunkFlusher) giveBack(index int) []*heldSlot {
+	slots := slices.Clone(f.slots[index])
+	var releases []func()
+	for _, slot := range slots {
+		if slot.release != nil {
+			releases = append(releases, slot.release)
+			slot.release = nil
+		}
+	}
+	f.mu.Unlock()
+	defer f.mu.Lock()
+	// The other way round from how they were taken
+	for i := len(releases) - 1; i >= 0; i-- {
+		releases[i]()
+	}
+	return slots
+}
+
+// Takes the slots giveBack released again, in the order they were first taken, with f.mu held.
+func (f *chunkFlusher) takeBack(slots []*heldSlot) error {
+	f.mu.Unlock()
+	defer f.mu.Lock()
+	for _, slot := range slots {
+		release, err := slot.acquire()
+		if err != nil {
+			return err
+		}
+		f.mu.Lock()
+		slot.release = release
+		f.mu.Unlock()
+	}
+	return nil
+}
+
+// Moves on past the chunks that are completely written out, writing out what the next ones already hold.
+func (f *chunkFlusher) advance() error {
+	defer f.cond.Broadcast()
+	for f.head < len(f.flushed) {
+		r := f.d.ranges[f.head]
+		// A chunk of unknown size is the only one, it's never done before the download is
+		if r[1] < 0 || f.flushed[f.head] < int64(r[1]-r[0]+1) {
+			return nil
+		}
+		f.head++
+		if f.head == len(f.flushed) {
+			return nil
+		}
+
+		chunk := &f.d.chunks[f.head]
+		held := int64(chunk.Len())
+		written, err := chunk.WriteTo(f.w)
+		f.flushed[f.head] += written
+		f.buffered -= held
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Makes sure the chunks written out while they arrived add up to the whole file and verifies its checksum.
+func (d *downloader) finishFlushing(hashes map[string]hash.Hash, from int) error {
+	if err := d.checkChunks(from); err != nil {
+		return err
+	}
+	if !d.flusher.complete() {
+		return fmt.Errorf("%w: not every chunk was written out", ErrSizeMismatch)
+	}
+	if hashes != nil {
+		return d.finishChecksums(hashes)
+	}
+	return nil
+}
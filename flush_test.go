@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Serves data slowly, holding the requests for the start of the file back by firstDelay.
+func trickleServer(data []byte, firstDelay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") {
+			time.Sleep(firstDelay)
+		}
+		http.ServeContent(trickleWriter{w}, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+}
+
+func TestMaxBufferedBytesPeak(t *testing.T) {
+	data := testContent(4 << 20)
+	srv := trickleServer(data, 50*time.Millisecond)
+	defer srv.Close()
+
+	for _, limit := range []int{16 << 10, 64 << 10, 1 << 20} {
+		d := newTestDownloader(4)
+		d.WithMaxBufferedBytes(limit)
+		var mu sync.Mutex
+		var peak int64
+		d.WithBytesCallback(func(int) {
+			d.flusher.mu.Lock()
+			buffered := d.flusher.buffered
+			d.flusher.mu.Unlock()
+			mu.Lock()
+			peak = max(peak, buffered)
+			mu.Unlock()
+		})
+
+		var out bytes.Buffer
+		if err := d.DownloadToWriter(context.Background(), srv.URL+"/file.bin", &out); err != nil {
+			t.Fatalf("limit %d: %v", limit, err)
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("limit %d: the written file differs", limit)
+		}
+		if peak > int64(limit) {
+			t.Errorf("limit %d: %d bytes were buffered at once", limit, peak)
+		}
+	}
+}
+
+func TestMaxBufferedBytesHostLimit(t *testing.T) {
+	data := testContent(2 << 20)
+	// The first chunk fails once, so the others take the host slots while it waits to be retried
+	var failed atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") && !failed.Swap(true) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(trickleWriter{w}, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(4)
+	d.WithRetries(1, 100*time.Millisecond)
+	d.WithHostConcurrencyLimit("", 2)
+	d.WithMaxBufferedBytes(64 << 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var out bytes.Buffer
+	if err := d.DownloadToWriter(ctx, srv.URL+"/file.bin", &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("the written file differs")
+	}
+}
+
+func TestMaxBufferedBytesFailedChunk(t *testing.T) {
+	data := testContent(2 << 20)
+	var ranged atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" && ranged.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(trickleWriter{w}, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(4)
+	d.WithMaxBufferedBytes(64 << 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := d.DownloadToWriter(ctx, srv.URL+"/file.bin", io.Discard)
+	var rangesErr *RangesError
+	if !errors.As(err, &rangesErr) {
+		t.Fatalf("got %v, want a RangesError", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("the download only stopped at the deadline")
+	}
+}
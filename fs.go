@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// Where downloads are saved, made of the few calls the downloader needs.
+// It defaults to the OS filesystem, see WithFileSystem.
+type FileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Rename(oldPath, newPath string) error
+	Remove(name string) error
+	MkdirAll(path string, perm os.FileMode) error
+}
+
+// File of a FileSystem, *os.File is one. The workers write their chunks at their own offsets with WriteAt.
+type File interface {
+	io.ReadWriteCloser
+	io.ReaderAt
+	io.WriterAt
+	Name() string
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// Saves the downloads, their partial files and resume states through fsys instead of the OS filesystem,
+// for instance to keep them in memory. The disk space check and preallocation only apply to the OS filesystem.
+func (d *downloader) WithFileSystem(fsys FileSystem) {
+	d.fs = fsys
+}
+
+type osFileSystem struct{}
+
+func (osFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	// A nil *os.File would turn into a File that isn't nil
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFileSystem) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (osFileSystem) Rename(oldPath, newPath string) error         { return os.Rename(oldPath, newPath) }
+func (osFileSystem) Remove(name string) error                     { return os.Remove(name) }
+func (osFileSystem) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+
+// Reports whether the downloads go to the OS filesystem, the only one whose disk can be asked about.
+func (d *downloader) onDisk() bool {
+	_, ok := d.fs.(osFileSystem)
+	return ok
+}
+
+// Same as os.Create, through fsys.
+func createFile(fsys FileSystem, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Same as os.ReadFile, through fsys.
+func readFile(fsys FileSystem, name string) ([]byte, error) {
+	f, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// Same as os.WriteFile, through fsys.
+func writeFile(fsys FileSystem, name string, data []byte, perm os.FileMode) error {
+	f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Keeps the files in memory, by their path.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+	dirs  map[string]bool
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: map[string]*memFile{}, dirs: map[string]bool{}}
+}
+
+type memFile struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+// Open memFile, with its own position for Read and Write.
+type memHandle struct {
+	*memFile
+	name string
+	pos  int64
+}
+
+type memInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i memInfo) Name() string       { return path.Base(i.name) }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() os.FileMode  { return 0644 }
+func (i memInfo) ModTime() time.Time { return time.Time{} }
+func (i memInfo) IsDir() bool        { return i.dir }
+func (i memInfo) Sys() any           { return nil }
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		f = &memFile{}
+		m.files[name] = f
+	}
+	if flag&os.O_TRUNC != 0 {
+		f.Truncate(0)
+	}
+	return &memHandle{memFile: f, name: name}, nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dirs[name] {
+		return memInfo{name: name, dir: true}, nil
+	}
+	if f, ok := m.files[name]; ok {
+		return memInfo{name: name, size: f.size()}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (m *memFS) Rename(oldPath, newPath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[oldPath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: os.ErrNotExist}
+	}
+	delete(m.files, oldPath)
+	m.files[newPath] = f
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *memFS) MkdirAll(dir string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for ; dir != "/" && dir != "."; dir = path.Dir(dir) {
+		m.dirs[dir] = true
+	}
+	return nil
+}
+
+// Returns the paths of the files it holds, sorted.
+func (m *memFS) names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *memFile) size() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return int64(len(f.data))
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	copy(f.data[off:], p)
+	return len(p), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if size <= int64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		f.data = append(f.data, make([]byte, size-int64(len(f.data)))...)
+	}
+	return nil
+}
+
+func (h *memHandle) Read(p []byte) (int, error) {
+	n, err := h.ReadAt(p, h.pos)
+	h.pos += int64(n)
+	return n, err
+}
+
+func (h *memHandle) Write(p []byte) (int, error) {
+	n, err := h.WriteAt(p, h.pos)
+	h.pos += int64(n)
+	return n, err
+}
+
+func (h *memHandle) Close() error { return nil }
+func (h *memHandle) Name() string { return h.name }
+
+func (h *memHandle) Stat() (os.FileInfo, error) {
+	return memInfo{name: h.name, size: h.size()}, nil
+}
+
+func TestFileSystem(t *testing.T) {
+	data := testContent(50000)
+	srv := serveContent(data)
+	defer srv.Close()
+
+	for _, memory := range []int{0, 1 << 20} {
+		for _, resume := range []bool{false, true} {
+			t.Run(fmt.Sprintf("memory %d resume %v", memory, resume), func(t *testing.T) {
+				inTempDir(t)
+				fsys := newMemFS()
+				d := newTestDownloader(4)
+				d.WithFileSystem(fsys)
+				d.WithMemoryBuffering(memory)
+				d.WithResume(resume)
+				d.WithCreateDirs(true)
+				d.WithOutput("/downloads/file.bin")
+				path, err := d.Download(srv.URL + "/file.bin")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if path != "/downloads/file.bin" {
+					t.Errorf("got %s, want /downloads/file.bin", path)
+				}
+				if names := fsys.names(); len(names) != 1 || names[0] != path {
+					t.Fatalf("got %v in the filesystem, want only %s", names, path)
+				}
+				if !bytes.Equal(fsys.files[path].data, data) {
+					t.Error("downloaded file doesn't match")
+				}
+				if entries, _ := os.ReadDir("."); len(entries) != 0 {
+					t.Error("the download touched the disk")
+				}
+			})
+		}
+	}
+}
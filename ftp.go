@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// Reports whether rawURL is downloaded over FTP rather than HTTP. The credentials come from the URL,
+// anonymous by default, and the options shaping HTTP requests, like headers and proxies, don't apply.
+func isFTP(rawURL string) bool {
+	return strings.HasPrefix(strings.ToLower(rawURL), "ftp://")
+}
+
+// Connects and logs in to the server of rawURL, returning the path of the file on it.
+// Every transfer needs its own connection, so each worker makes one.
+func (d *downloader) ftpConnect(ctx context.Context, rawURL string) (*ftp.ServerConn, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+	options := []ftp.DialOption{ftp.DialWithContext(ctx)}
+	if d.client.Timeout > 0 {
+		options = append(options, ftp.DialWithTimeout(d.client.Timeout))
+	}
+
+	conn, err := ftp.Dial(addr, options...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	user, password := "anonymous", "anonymous"
+	if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			password = p
+		}
+	}
+	if err := conn.Login(user, password); err != nil {
+		conn.Quit()
+		return nil, "", fmt.Errorf("FTP login as %s: %w", user, err)
+	}
+
+	return conn, u.Path, nil
+}
+
+// Asks the FTP server about the file, ranges are considered supported when it knows the size
+// and accepts REST, which is tried by fetching the very last byte.
+func (d *downloader) ftpDetails(ctx context.Context, rawURL string) (rangeDetails, error) {
+	conn, filePath, err := d.ftpConnect(ctx, rawURL)
+	if err != nil {
+		return rangeDetails{}, err
+	}
+	defer conn.Quit()
+
+	details := rangeDetails{length: -1, finalURL: rawURL}
+	if size, err := conn.FileSize(filePath); err == nil {
+		details.length = int(size)
+		details.supported = size > 0 && ftpRestSupported(conn, filePath, size)
+	} else {
+		d.logger.Debugf("FTP SIZE of %s failed: %v", redactURL(rawURL), err)
+	}
+	// Stands in for the ETag a resumed download is compared with
+	if conn.IsGetTimeSupported() {
+		if modified, err := conn.GetTime(filePath); err == nil {
+			details.lastModified = modified.UTC().Format(http.TimeFormat)
+		}
+	}
+
+	return details, nil
+}
+
+func ftpRestSupported(conn *ftp.ServerConn, filePath string, size int64) bool {
+	response, err := conn.RetrFrom(filePath, uint64(size-1))
+	if err != nil {
+		return false
+	}
+	_, err = io.Copy(io.Discard, response)
+	if closeErr := response.Close(); err == nil {
+		err = closeErr
+	}
+	return err == nil
+}
+
+// Starts a transfer of the file from offset, the returned body closes the connection as well.
+func (d *downloader) ftpRetrieve(ctx context.Context, rawURL string, offset int) (io.ReadCloser, error) {
+	conn, filePath, err := d.ftpConnect(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := conn.RetrFrom(filePath, uint64(offset))
+	if err != nil {
+		conn.Quit()
+		return nil, err
+	}
+
+	// Unblocks a read waiting for data once the download is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		response.SetDeadline(time.Now())
+	})
+	return &ftpBody{Response: response, conn: conn, stop: stop}, nil
+}
+
+type ftpBody struct {
+	*ftp.Response
+	conn *ftp.ServerConn
+	stop func() bool
+}
+
+// Closing a transfer before its end makes the server complain, which is of no interest to us
+// since the bytes received are counted anyway.
+func (b *ftpBody) Close() error {
+	b.stop()
+	// Quitting first so closing the transfer doesn't wait for the server to answer about it
+	b.conn.Quit()
+	b.Response.Close()
+	return nil
+}
+
+// Same as downloadFile over FTP, carrying on from where an earlier attempt stopped when ranges are supported.
+func (d *downloader) ftpDownloadFile(ctx context.Context, rawURL string) error {
+	done := int(d.written[0].Load())
+	body, err := d.ftpRetrieve(ctx, rawURL, done)
+	// A server refusing REST can still send the whole file again
+	if err != nil && done > 0 && ctx.Err() == nil {
+		d.logger.Debugf("FTP transfer from %d failed, starting over: %v", done, err)
+		done = 0
+		d.written[0].Store(0)
+		body, err = d.ftpRetrieve(ctx, rawURL, done)
+	}
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	d.logger.Debugf("started writing")
+	written, err := d.copyBody(d.chunkWriter(0, done), d.limitReader(ctx, body))
+	if err != nil {
+		return err
+	}
+	d.logger.Debugf("written %d bytes", written)
+	return nil
+}
+
+// Same as downloadFileForRange over FTP, the transfer starts at startRange and is cut once the range is complete.
+func (d *downloader) ftpDownloadRange(ctx context.Context, rawURL string, startRange, endRange, index int) error {
+	_range := fmt.Sprintf("%d-%d", startRange, endRange)
+	body, err := d.ftpRetrieve(ctx, rawURL, startRange)
+	if err != nil {
+		return fmt.Errorf("range %s: %w", _range, err)
+	}
+	defer body.Close()
+
+	expected := int64(endRange - startRange + 1)
+	d.logger.Debugf("range %s: started writing", _range)
+	written, err := d.copyBody(d.chunkWriter(index, startRange), io.LimitReader(d.limitReader(ctx, body), expected))
+	if err != nil {
+		return fmt.Errorf("range %s: %w", _range, err)
+	}
+
+	if written != expected {
+		return fmt.Errorf("range %s: %w, received %d bytes, expected %d", _range, ErrSizeMismatch, written, expected)
+	}
+
+	d.logger.Debugf("range %s: written %d bytes", _range, written)
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Just enough of an FTP server for the client, serving data at every path in passive mode,
+// accepting REST only when rest is set and counting the transfers it made.
+type ftpServer struct {
+	data      []byte
+	rest      bool
+	transfers atomic.Int64
+	// The last user that logged in
+	user atomic.Value
+}
+
+// Starts s on a local port, it's stopped at the end of the test, and returns its URL.
+func (s *ftpServer) start(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return "ftp://" + ln.Addr().String()
+}
+
+func (s *ftpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	reply("220 ready")
+
+	var passive net.Listener
+	offset := 0
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		command, arg, _ := strings.Cut(scanner.Text(), " ")
+		switch strings.ToUpper(command) {
+		case "USER":
+			s.user.Store(arg)
+			reply("331 password please")
+		case "PASS":
+			reply("230 logged in")
+		case "FEAT":
+			reply("211 no features")
+		case "TYPE", "OPTS":
+			reply("200 ok")
+		case "EPSV":
+			if passive, _ = net.Listen("tcp", "127.0.0.1:0"); passive == nil {
+				reply("425 can't open a data connection")
+				continue
+			}
+			reply(fmt.Sprintf("229 Entering Extended Passive Mode (|||%d|)", passive.Addr().(*net.TCPAddr).Port))
+		case "SIZE":
+			reply(fmt.Sprintf("213 %d", len(s.data)))
+		case "REST":
+			if !s.rest {
+				reply("502 REST not implemented")
+				continue
+			}
+			offset, _ = strconv.Atoi(arg)
+			reply("350 restarting")
+		case "RETR":
+			data, err := passive.Accept()
+			passive.Close()
+			if err != nil {
+				return
+			}
+			s.transfers.Add(1)
+			reply("150 sending")
+			_, err = data.Write(s.data[offset:])
+			data.Close()
+			offset = 0
+			if err != nil {
+				reply("426 transfer aborted")
+			} else {
+				reply("226 transfer complete")
+			}
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestFTP(t *testing.T) {
+	tests := []struct {
+		name string
+		rest bool
+		// The REST probe of the last byte and a transfer per worker, or the single one without REST
+		transfers int64
+	}{
+		{"resumable", true, 5},
+		{"not resumable", false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			data := testContent(300000)
+			s := &ftpServer{data: data, rest: tt.rest}
+			base := s.start(t)
+
+			result, err := newTestDownloader(4).DownloadWithResult(context.Background(), base+"/dir/file.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(result.Path); !bytes.Equal(got, data) || filepath.Base(result.Path) != "file.bin" {
+				t.Fatalf("got %s, want file.bin matching", result.Path)
+			}
+			if result.Multipart != tt.rest || s.transfers.Load() != tt.transfers {
+				t.Errorf("got multipart %v after %d transfers, want %v after %d", result.Multipart, s.transfers.Load(), tt.rest, tt.transfers)
+			}
+			if user := s.user.Load(); user != "anonymous" {
+				t.Errorf("logged in as %v, want anonymous", user)
+			}
+		})
+	}
+}
+
+func TestFTPCredentials(t *testing.T) {
+	inTempDir(t)
+	s := &ftpServer{data: testContent(1000)}
+	base := s.start(t)
+
+	_, err := newTestDownloader(1).Download(strings.Replace(base, "ftp://", "ftp://alice:secret@", 1) + "/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user := s.user.Load(); user != "alice" {
+		t.Errorf("logged in as %v, want alice", user)
+	}
+}
+
+func TestIsFTP(t *testing.T) {
+	for url, want := range map[string]bool{
+		"ftp://example.com/file.bin":  true,
+		"FTP://example.com/file.bin":  true,
+		"http://example.com/file.bin": false,
+		"sftp://example.com/file.bin": false,
+		"https://example.com/ftp://x": false,
+	} {
+		if got := isFTP(url); got != want {
+			t.Errorf("isFTP(%q) = %v, want %v", url, got, want)
+		}
+	}
+}
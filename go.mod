@@ -2,9 +2,12 @@ module multidownloader
 
 go 1.21.0
 
-require github.com/spf13/cobra v1.8.0
-
 require (
-	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/jlaffaye/ftp v0.2.4
+	github.com/spf13/cobra v1.8.0
+	github.com/spf13/pflag v1.0.5
+	golang.org/x/sys v0.20.0
+	golang.org/x/time v0.5.0
 )
+
+require github.com/inconshreveable/mousetrap v1.1.0 // indirect
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"sync"
+)
+
+// Caps how many requests run at once against each host, across every downloader sharing it, see WithHostLimiter.
+// Hosts without a limit of their own get the default one, 0 meaning no limit.
+type HostLimiter struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	defaultMax int
+	limits     map[string]int
+	active     map[string]int
+}
+
+// Returns a limiter letting at most defaultMax requests run at once against any single host, 0 for no limit.
+func NewHostLimiter(defaultMax int) *HostLimiter {
+	l := &HostLimiter{defaultMax: defaultMax, limits: map[string]int{}, active: map[string]int{}}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Sets the limit of host, matched against the host name of the URLs without the port, 0 removes it.
+// An empty host sets the default limit instead.
+func (l *HostLimiter) SetLimit(host string, max int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if host == "" {
+		l.defaultMax = max
+	} else {
+		l.limits[host] = max
+	}
+	// Requests waiting for a limit that just went up can go
+	l.cond.Broadcast()
+}
+
+func (l *HostLimiter) limit(host string) int {
+	if n, ok := l.limits[host]; ok {
+		return n
+	}
+	return l.defaultMax
+}
+
+// Waits for a free slot on host, the returned func gives it back. It fails only when ctx is done first.
+func (l *HostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	// Wakes the wait below up, so a cancelled download doesn't stay stuck behind the others
+	stop := context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.cond.Broadcast()
+	})
+	defer stop()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if n := l.limit(host); n <= 0 || l.active[host] < n {
+			break
+		}
+		l.cond.Wait()
+	}
+	l.active[host]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.active[host]--; l.active[host] == 0 {
+				delete(l.active, host)
+			}
+			l.cond.Broadcast()
+		})
+	}, nil
+}
+
+// Shares limiter with d, so the requests of every downloader given the same one count against the same
+// per host limits. DownloadAll hands the limiter of its downloader over to each file, nil removes it.
+func (d *downloader) WithHostLimiter(limiter *HostLimiter) {
+	d.hostLimiter = limiter
+}
+
+// Lets at most max requests of d run at once against host, or against any host when it's empty,
+// on top of the workers count. It sets the limit on the limiter of d, which is made if there's none yet.
+func (d *downloader) WithHostConcurrencyLimit(host string, max int) {
+	if d.hostLimiter == nil {
+		d.hostLimiter = NewHostLimiter(0)
+	}
+	d.hostLimiter.SetLimit(host, max)
+}
+
+// Holds a slot of the host of rawURL for as long as a request to it runs, release is a no-op without a limiter.
+func (d *downloader) holdHost(ctx context.Context, rawURL string) (release func(), err error) {
+	if d.hostLimiter == nil {
+		return func() {}, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return d.hostLimiter.acquire(ctx, u.Hostname())
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHostLimiter(t *testing.T) {
+	data := testContent(64 << 10)
+	var gets, peak atomic.Int64
+	srv := peakServer(data, &gets, &peak)
+	defer srv.Close()
+
+	limiter := NewHostLimiter(0)
+	limiter.SetLimit("127.0.0.1", 3)
+	// Two downloads of 4 workers each, 8 requests at once without the limit
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d := newTestDownloader(4)
+			d.WithHostLimiter(limiter)
+			var buf bytes.Buffer
+			if err := d.DownloadToWriter(context.Background(), srv.URL+"/file.bin", &buf); err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(buf.Bytes(), data) {
+				t.Error("downloaded bytes don't match")
+			}
+		}()
+	}
+	wg.Wait()
+	if peak.Load() > 3 {
+		t.Errorf("%d requests ran at once against the host, want at most 3", peak.Load())
+	}
+}
+
+func TestHostConcurrencyLimitDownloadAll(t *testing.T) {
+	inTempDir(t)
+	var gets, peak atomic.Int64
+	srv := peakServer(testContent(64<<10), &gets, &peak)
+	defer srv.Close()
+
+	d := newTestDownloader(4)
+	// The default of every host
+	d.WithHostConcurrencyLimit("", 2)
+	urls := []string{srv.URL + "/a.bin", srv.URL + "/b.bin", srv.URL + "/c.bin"}
+	if _, err := d.DownloadAll(context.Background(), urls, DownloadAllOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if peak.Load() > 2 {
+		t.Errorf("%d requests ran at once against the host, want at most 2", peak.Load())
+	}
+}
+
+func TestHostLimiterAcquire(t *testing.T) {
+	limiter := NewHostLimiter(1)
+	release, err := limiter.acquire(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Other hosts have slots of their own
+	other, err := limiter.acquire(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.acquire(ctx, "example.com"); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want the wait given up", err)
+	}
+
+	// Giving the slot back twice doesn't free a second one
+	release()
+	release()
+	first, err := limiter.acquire(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first()
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.acquire(ctx, "example.com"); err == nil {
+		t.Error("got a second slot of a limit of 1")
+	}
+}
+
+func TestHostLimiterRaised(t *testing.T) {
+	limiter := NewHostLimiter(1)
+	release, _ := limiter.acquire(context.Background(), "example.com")
+	defer release()
+
+	acquired := make(chan struct{})
+	go func() {
+		second, err := limiter.acquire(context.Background(), "example.com")
+		if err == nil {
+			second()
+		}
+		close(acquired)
+	}()
+	limiter.SetLimit("example.com", 2)
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiting request didn't get the slot the raised limit made")
+	}
+}
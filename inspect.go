@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// What the server tells about a file before it's downloaded, ContentLength is -1 when it didn't say.
+type FileInfo struct {
+	ContentLength int64
+	// Whether the file can be downloaded in several ranges and resumed
+	AcceptsRanges bool
+	ContentType   string
+	ETag          string
+	LastModified  string
+	// Where the redirects, if any, led to
+	FinalURL string
+}
+
+// Asks the server about the file at url without downloading it, with the same requests Download starts with.
+func (d *downloader) Inspect(ctx context.Context, url string) (FileInfo, error) {
+	d.logger.Infof("inspecting %s", redactURL(url))
+	ctx, cancel := d.downloadContext(ctx)
+	defer cancel()
+
+	untrack, err := d.track(cancel)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer untrack()
+
+	details, err := d.getRangeDetails(ctx, url)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	return FileInfo{
+		ContentLength: int64(details.length),
+		AcceptsRanges: details.supported,
+		ContentType:   details.contentType,
+		ETag:          details.etag,
+		LastModified:  details.lastModified,
+		FinalURL:      details.finalURL,
+	}, nil
+}
+
+// Prints what Inspect finds out about link.
+func runInspect(ctx context.Context, opts downloadOptions, link string) error {
+	d := NewDownloader(1)
+	if err := configureRequests(d, opts); err != nil {
+		return &usageError{err}
+	}
+
+	info, err := d.Inspect(ctx, link)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "URL:\t%s\n", redactURL(info.FinalURL))
+	fmt.Fprintf(w, "Size:\t%s\n", describeSize(info.ContentLength))
+	fmt.Fprintf(w, "Accepts ranges:\t%s\n", yesNo(info.AcceptsRanges))
+	fmt.Fprintf(w, "Content-Type:\t%s\n", info.ContentType)
+	fmt.Fprintf(w, "ETag:\t%s\n", info.ETag)
+	fmt.Fprintf(w, "Last-Modified:\t%s\n", info.LastModified)
+	return w.Flush()
+}
+
+// Shows a size in bytes and in a readable unit, or that it's unknown when negative.
+func describeSize(size int64) string {
+	if size < 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d bytes (%s)", size, formatBytes(size))
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	var gets int
+	mux := http.NewServeMux()
+	mux.Handle("/old.bin", http.RedirectHandler("/file.bin", http.StatusFound))
+	mux.HandleFunc("/file.bin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets++
+		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+		w.Header().Set("Content-Length", "12345")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	info, err := NewDownloader(1).Inspect(context.Background(), srv.URL+"/old.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FileInfo{
+		ContentLength: 12345,
+		AcceptsRanges: true,
+		ContentType:   "application/zip",
+		ETag:          `"v1"`,
+		LastModified:  "Mon, 01 Jan 2024 00:00:00 GMT",
+		FinalURL:      srv.URL + "/file.bin",
+	}
+	if info != want {
+		t.Errorf("got %+v, want %+v", info, want)
+	}
+	if gets != 0 {
+		t.Errorf("inspecting sent %d GETs", gets)
+	}
+}
+
+func TestInspectCommand(t *testing.T) {
+	srv := serveContent(testContent(2048))
+	defer srv.Close()
+
+	stdout, stderr, code := runCommand(t, t.TempDir(), nil, "inspect", srv.URL+"/file.bin")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+	// The columns are padded to line up, only the words are compared
+	got := strings.Join(strings.Fields(stdout), " ")
+	for _, line := range []string{"URL: " + srv.URL + "/file.bin", "Size: 2048 bytes (2.0 KiB)", "Accepts ranges: yes"} {
+		if !strings.Contains(got, line) {
+			t.Errorf("%q is missing from %q", line, stdout)
+		}
+	}
+}
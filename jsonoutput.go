@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Writes the events of --json, one JSON object per line, the downloads of a batch all writing to the same one.
+type eventWriter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func newEventWriter(w io.Writer) *eventWriter {
+	return &eventWriter{encoder: json.NewEncoder(w)}
+}
+
+func (e *eventWriter) emit(event any) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.encoder.Encode(event)
+}
+
+// The download of URL started, Size is -1 when the server didn't tell.
+type startEvent struct {
+	Event string `json:"event"`
+	URL   string `json:"url"`
+	Size  int64  `json:"size"`
+}
+
+// How far the download of URL got, Total and Percent are -1 when its size is unknown.
+// Speed is in bytes per second and ETA in seconds.
+type progressEvent struct {
+	Event      string  `json:"event"`
+	URL        string  `json:"url"`
+	Downloaded int64   `json:"downloaded"`
+	Total      int64   `json:"total"`
+	Percent    int64   `json:"percent"`
+	Speed      float64 `json:"speed"`
+	ETA        float64 `json:"eta"`
+}
+
+// The download of URL succeeded, Duration is in seconds.
+type resultEvent struct {
+	Event       string            `json:"event"`
+	URL         string            `json:"url"`
+	Path        string            `json:"path"`
+	Bytes       int64             `json:"bytes"`
+	Duration    float64           `json:"duration"`
+	Checksums   map[string]string `json:"checksums,omitempty"`
+	Multipart   bool              `json:"multipart"`
+	Workers     int               `json:"workers"`
+	ContentType string            `json:"content_type,omitempty"`
+	Skipped     bool              `json:"skipped,omitempty"`
+}
+
+// The download of URL failed, with the exit code and hint the CLI has for its error.
+// URL is empty when the command itself failed, like with a bad flag or some downloads of a batch failing.
+type errorEvent struct {
+	Event    string `json:"event"`
+	URL      string `json:"url,omitempty"`
+	Error    string `json:"error"`
+	Hint     string `json:"hint,omitempty"`
+	ExitCode int    `json:"exit_code"`
+}
+
+// Emits the start event once the size of the file is known.
+type jsonObserver struct {
+	noopObserver
+	events *eventWriter
+	url    string
+}
+
+func (o jsonObserver) OnStart(_ string, size int64) {
+	o.events.emit(startEvent{Event: "start", URL: o.url, Size: size})
+}
+
+// Downloads a single link like run, reporting everything as events instead of lines of text.
+func runJSON(ctx context.Context, opts downloadOptions, link string) error {
+	url := redactURL(link)
+	err := downloadJSON(ctx, opts, link, url)
+	if err != nil {
+		opts.events.emit(errorEvent{Event: "error", URL: url, Error: err.Error(), Hint: errorHint(err), ExitCode: exitCode(err)})
+		return &reportedError{err}
+	}
+	return nil
+}
+
+// Returned by runJSON once the error event of the download is out, so fatalJSON doesn't repeat it.
+type reportedError struct {
+	error
+}
+
+func (e *reportedError) Unwrap() error {
+	return e.error
+}
+
+// Like fatal, but err is printed to stdout as an error event unless it already was.
+func fatalJSON(err error) {
+	if _, reported := err.(*reportedError); !reported {
+		newEventWriter(os.Stdout).emit(errorEvent{Event: "error", Error: err.Error(), Hint: errorHint(err), ExitCode: exitCode(err)})
+	}
+	os.Exit(exitCode(err))
+}
+
+// Reports whether args ask for --json, so the errors of a command line that couldn't be parsed are events too.
+func jsonRequested(args []string) bool {
+	requested := false
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "--json" {
+			requested = true
+		} else if value, ok := strings.CutPrefix(arg, "--json="); ok {
+			requested, _ = strconv.ParseBool(value)
+		}
+	}
+	return requested
+}
+
+func downloadJSON(ctx context.Context, opts downloadOptions, link, url string) error {
+	d := NewDownloader(opts.workersCount)
+	if err := configureDownload(d, opts); err != nil {
+		return &usageError{err}
+	}
+	d.WithObserver(jsonObserver{events: opts.events, url: url})
+
+	progressDone := make(chan struct{})
+	if opts.progressEnabled {
+		progressChan := d.ConsumeProgressDetailed()
+		go func() {
+			defer close(progressDone)
+			for p := range progressChan {
+				opts.events.emit(progressEvent{
+					Event:      "progress",
+					URL:        url,
+					Downloaded: p.Downloaded,
+					Total:      p.Total,
+					Percent:    p.Percent(),
+					Speed:      p.Speed,
+					ETA:        p.ETA.Seconds(),
+				})
+			}
+		}()
+	} else {
+		close(progressDone)
+	}
+
+	result, err := d.DownloadWithResult(ctx, link)
+	<-progressDone
+	if err != nil {
+		return err
+	}
+
+	if algo := strings.ToLower(opts.printHash); algo != "" && result.Checksums[algo] == "" {
+		// A skipped file wasn't read by the download, so it's done here
+		sum, err := fileChecksum(d.fs, result.Path, algo)
+		if err != nil {
+			return err
+		}
+		if result.Checksums == nil {
+			result.Checksums = map[string]string{}
+		}
+		result.Checksums[algo] = sum
+	}
+
+	opts.events.emit(resultEvent{
+		Event:       "result",
+		URL:         url,
+		Path:        result.Path,
+		Bytes:       result.Size,
+		Duration:    result.Elapsed.Seconds(),
+		Checksums:   result.Checksums,
+		Multipart:   result.Multipart,
+		Workers:     result.Workers,
+		ContentType: result.ContentType,
+		Skipped:     result.Skipped,
+	})
+	return nil
+}
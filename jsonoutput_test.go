@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONOutput(t *testing.T) {
+	dir := t.TempDir()
+	data := testContent(1 << 20)
+	sum := sha256.Sum256(data)
+	// Slow enough for some progress to be reported on the way
+	srv := stallingServer(data, 150*time.Millisecond)
+	defer srv.Close()
+	closed := serveContent(data)
+	closed.Close()
+
+	stdout, stderr, code := runCommand(t, dir, nil, "download", "--json", "--print-hash", "sha256", "-i", "50", "-w", "2",
+		srv.URL+"/a.bin", srv.URL+"/b.bin", closed.URL+"/c.bin")
+	if code != exitNetwork {
+		t.Errorf("exited with %d, want %d, stderr: %s", code, exitNetwork, stderr)
+	}
+
+	events := map[string][]map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		var event map[string]any
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("%q isn't a JSON object: %v", line, err)
+		}
+		name, _ := event["event"].(string)
+		events[name] = append(events[name], event)
+	}
+	if len(events["start"]) != 2 || len(events["progress"]) == 0 || len(events["result"]) != 2 || len(events["error"]) != 2 {
+		t.Fatalf("got %d start, %d progress, %d result and %d error events:\n%s",
+			len(events["start"]), len(events["progress"]), len(events["result"]), len(events["error"]), stdout)
+	}
+
+	for _, result := range events["result"] {
+		path, _ := result["path"].(string)
+		if name := filepath.Base(path); filepath.Dir(path) != dir || (name != "a.bin" && name != "b.bin") {
+			t.Errorf("got the path %q", path)
+		}
+		if result["bytes"] != float64(len(data)) {
+			t.Errorf("got %v bytes, want %d", result["bytes"], len(data))
+		}
+		if duration, _ := result["duration"].(float64); duration <= 0 {
+			t.Errorf("got the duration %v", result["duration"])
+		}
+		if checksums, _ := result["checksums"].(map[string]any); checksums["sha256"] != hex.EncodeToString(sum[:]) {
+			t.Errorf("got the checksums %v", result["checksums"])
+		}
+	}
+	failed, summary := events["error"][0], events["error"][1]
+	if failed["url"] != closed.URL+"/c.bin" || failed["exit_code"] != float64(exitNetwork) || failed["error"] == "" {
+		t.Errorf("got %v", failed)
+	}
+	if _, ok := summary["url"]; ok || summary["error"] != "1 of 3 downloads failed" || summary["exit_code"] != float64(exitNetwork) {
+		t.Errorf("got the summary %v", summary)
+	}
+	if stderr != "" {
+		t.Errorf("got %q on stderr", stderr)
+	}
+}
+
+func TestJSONCommandErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"bad flag", []string{"download", "--json", "--bogus", "http://example.com/file.bin"}},
+		{"flag after a bad one", []string{"download", "--bogus", "--json", "http://example.com/file.bin"}},
+		{"no links", []string{"download", "--json"}},
+		{"json and dry run", []string{"download", "--json", "--dry-run", "http://example.com/file.bin"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runCommand(t, t.TempDir(), nil, tt.args...)
+			if code != exitUsage {
+				t.Errorf("exited with %d, want %d", code, exitUsage)
+			}
+			var event errorEvent
+			if err := json.Unmarshal([]byte(stdout), &event); err != nil {
+				t.Fatalf("%q isn't a JSON object: %v", stdout, err)
+			}
+			if event.Event != "error" || event.Error == "" || event.ExitCode != exitUsage || event.URL != "" {
+				t.Errorf("got %+v", event)
+			}
+			if stderr != "" {
+				t.Errorf("got %q on stderr", stderr)
+			}
+		})
+	}
+}
+
+func TestJSONRequested(t *testing.T) {
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"download", "--json", "x"}, true},
+		{[]string{"download", "--json=true"}, true},
+		{[]string{"download", "--json", "--json=false"}, false},
+		{[]string{"download", "--", "--json"}, false},
+		{[]string{"download", "x"}, false},
+	}
+	for _, tt := range tests {
+		if got := jsonRequested(tt.args); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
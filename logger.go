@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/url"
+)
+
+// Receives what the downloader has to say while it works, the default one discards everything.
+type Logger interface {
+	Debugf(format string, args ...any)
+	Infof(format string, args ...any)
+	Errorf(format string, args ...any)
+}
+
+type noopLogger struct{}
+
+func (noopLogger) Debugf(string, ...any) {}
+func (noopLogger) Infof(string, ...any)  {}
+func (noopLogger) Errorf(string, ...any) {}
+
+// Writes every message on its own line, prefixed with its level.
+type streamLogger struct {
+	l *log.Logger
+}
+
+func newStreamLogger(w io.Writer) Logger {
+	return &streamLogger{l: log.New(w, "", log.LstdFlags)}
+}
+
+func (s *streamLogger) Debugf(format string, args ...any) {
+	s.l.Printf("DEBUG "+format, args...)
+}
+
+func (s *streamLogger) Infof(format string, args ...any) {
+	s.l.Printf("INFO "+format, args...)
+}
+
+func (s *streamLogger) Errorf(format string, args ...any) {
+	s.l.Printf("ERROR "+format, args...)
+}
+
+// Hides the password of a URL carrying credentials, so it can be logged.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Keeps every message along with its level.
+type capturingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (c *capturingLogger) log(level, format string, args ...any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (c *capturingLogger) Debugf(format string, args ...any) { c.log("DEBUG", format, args...) }
+func (c *capturingLogger) Infof(format string, args ...any)  { c.log("INFO", format, args...) }
+func (c *capturingLogger) Errorf(format string, args ...any) { c.log("ERROR", format, args...) }
+
+// Reports whether one of the messages is at level and starts with prefix.
+func (c *capturingLogger) logged(level, prefix string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, message := range c.messages {
+		if strings.HasPrefix(message, level+" "+prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	inTempDir(t)
+	srv := httptest.NewServer(&flakyServer{data: testContent(1000), failures: 1})
+	defer srv.Close()
+
+	logger := &capturingLogger{}
+	d := newTestDownloader(2)
+	d.WithLogger(logger)
+	d.WithRetries(1, time.Millisecond)
+	if _, err := d.Download(srv.URL + "/file.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []struct{ level, prefix string }{
+		{"INFO", "downloading url: " + srv.URL + "/file.bin"},
+		{"DEBUG", "processing multiple"},
+		{"DEBUG", "range 0-499: written 500 bytes"},
+		{"ERROR", "range"},
+	} {
+		if !logger.logged(want.level, want.prefix) {
+			t.Errorf("no %s message starting with %q in %q", want.level, want.prefix, logger.messages)
+		}
+	}
+}
+
+func TestStreamLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := newStreamLogger(&out)
+	logger.Debugf("a %d", 1)
+	logger.Infof("b %d", 2)
+	logger.Errorf("c %d", 3)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %q, want 3 lines", lines)
+	}
+	for i, want := range []string{"DEBUG a 1", "INFO b 2", "ERROR c 3"} {
+		if !strings.HasSuffix(lines[i], want) {
+			t.Errorf("line %d is %q, want it to end with %q", i, lines[i], want)
+		}
+	}
+}
@@ -6,33 +6,251 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"log"
+	"math"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/time/rate"
 )
 
-type downloader struct {
+// Files up to this size are buffered in memory, bigger ones are streamed to a temp file on disk.
+const defaultMemoryBufferingMax = 16 << 20
+
+// How many bytes each worker gets when the CLI picks the workers count.
+const defaultAutoChunkSize = 4 << 20
+
+// Set at build time with -ldflags "-X main.version=...", see versionInfo.
+var version = "dev"
+
+// Smallest share of a file worth its own worker.
+const defaultMinChunkSize = 1 << 20
+
+// What NewDownloader and the With* funcs set up, a downloader of DownloadAll starts out with the same.
+type options struct {
 	client               *http.Client
 	workersCount         int
-	chunks               []bytes.Buffer
+	progressEnabled      bool
+	progressCalcInterval int
+	progressCallback     func(Progress)
+	memoryBufferingMax   int
+	maxInMemorySize      int
+	maxBufferedBytes     int
+	expectedContentType  string
+	requestMethod        string
+	requestBody          []byte
+	progressWriter       io.Writer
+	bytesCallback        func(n int)
+	decompress           bool
+	resumeEnabled        bool
+	keepPartial          bool
+	resumeSaveInterval   time.Duration
+	output               string
+	createDirs           bool
+	checksumAlgo         string
+	checksumExpected     string
+	computedAlgos        []string
+	retries              int
+	retryBaseDelay       time.Duration
+	logger               Logger
+	limiter              *rate.Limiter
+	autoMaxWorkers       int
+	autoChunkSize        int
+	minChunkSize         int
+	chunkSize            int
+	maxConcurrency       int
+	userAgent            string
+	preflightDiskCheck   bool
+	preallocate          bool
+	headers              http.Header
+	totalTimeout         time.Duration
+	probeTimeout         time.Duration
+	forceSingle          bool
+	existingFilePolicy   ExistingFilePolicy
+	maxRedirects         int
+	sameHostRedirects    bool
+	ifModifiedSince      time.Time
+	// Transport NewDownloader made, its pool follows the workers count until WithConnectionPool sets it.
+	pooledTransport *http.Transport
+	connectionPool  int
+	// Probes servers that don't send Accept-Ranges, see WithAggressiveRangeProbe.
+	aggressiveRangeProbe bool
+	// Set by DownloadAll to rename the file before its path is decided, dirs are the ones of PathModePreserve.
+	nameFile func(dirs, name string) string
+	observer Observer
+	// Buffers the bodies are copied through, see WithCopyBufferSize.
+	copyBuffers     *bufferPool
+	writeBufferSize int
+	// Where the partial files go, next to their destination when empty.
+	tempDir       string
+	staggerDelay  time.Duration
+	portableNames bool
+	pathMode      PathMode
+	workStealing  bool
+	retryable     func(response *http.Response, err error) bool
+	// Shared with other downloaders to cap the requests to each host, see WithHostLimiter.
+	hostLimiter *HostLimiter
+	fs          FileSystem
+}
+
+type downloader struct {
+	options
 	progressChan         chan int
+	progressDetailedChan chan Progress
+	percentRequested     atomic.Bool
+	detailedRequested    atomic.Bool
+
+	// Guards closed and the cancel func and done channel of the running download, see Close,
+	// as well as the progress channels, which are replaced for the next download once closed.
+	mu             sync.Mutex
+	closed         bool
+	cancel         context.CancelFunc
+	done           chan struct{}
+	progressClosed bool
+
+	// Per download state, tempFile is nil when the download is buffered in memory.
+	// ranges holds the inclusive [start, end] of every chunk and written how much of each is already saved.
+	tempFile File
+	ranges   [][2]int
+	written  []atomic.Int64
+	chunks   []bytes.Buffer
+	// Hashes a streamed download as it's written, nil when there's nothing to hash or it's read through afterwards.
+	streamHash *streamHash
+	// Set by DownloadReaderAt to hear about every write to the file.
+	onWrite func()
+	// Most bytes the in-memory chunks may hold together, 0 means no limit.
+	memoryLimit int
+	// Content-Encoding the server reported for the file, decoded is set once a body is being decoded
+	encoding string
+	decoded  bool
+	// Sent as If-Range with every ranged request, so a file changing on the server can't be mixed with its old bytes.
+	ifRange string
+	// Size of the whole file as the server first reported it, every Content-Range it sends has to agree.
+	contentLength int
+	// Digest the server advertised for the file, see useAdvertisedDigest.
+	advertisedAlgo   string
+	advertisedDigest string
+	// Hex digests of the last downloaded file by algorithm, see LastChecksum.
+	checksums map[string]string
+	// Writes the chunks out as they arrive, see WithMaxBufferedBytes.
+	flusher *chunkFlusher
+	// Whether downloadFile sends the request of WithRequestMethod, see rangeDetails.custom.
+	customServed bool
+	// The response to it that customDetails got, until downloadFile reads it.
+	firstResponse *firstResponse
+	// Makes the workers take turns writing to progressWriter.
+	progressWriterMu sync.Mutex
+}
+
+// What the HEAD request tells us about the file, length is -1 when the server didn't say.
+type rangeDetails struct {
+	supported    bool
+	length       int
+	etag         string
+	lastModified string
+	fileName     string
+	contentType  string
+	encoding     string
+	// Where the redirects, if any, led to, the workers request it directly.
+	finalURL string
+	// Set when the HEAD response had no Accept-Ranges at all, rather than one turning ranges down.
+	rangesUnknown bool
+	// Digest of the file the server advertised, in hex, see advertisedDigest.
+	digestAlgo string
+	digest     string
+	// Set when the file is served to the request of WithRequestMethod itself, rather than to a GET of finalURL.
+	custom bool
+}
+
+// Returned when the file changed on the server while it was being downloaded in several ranges.
+var ErrFileChanged = errors.New("file changed on the server during the download")
+
+// Returned when fewer or more bytes than expected arrived, for the whole file or one of its chunks.
+var ErrSizeMismatch = errors.New("size mismatch")
+
+// Returns what If-Range can be given to make sure ranges still come from the same file,
+// weak ETags can't be used for it so Last-Modified is the fallback, or empty if there's neither.
+func (details rangeDetails) validator() string {
+	if details.etag != "" && !strings.HasPrefix(details.etag, "W/") {
+		return details.etag
+	}
+	return details.lastModified
+}
+
+// Flags of the download command
+type downloadOptions struct {
+	workersCount         int
 	progressEnabled      bool
+	progressBar          bool
 	progressCalcInterval int
+	resume               bool
+	keepPartial          bool
+	output               string
+	createDirs           bool
+	checksum             string
+	printHash            string
+	retries              int
+	retryDelay           time.Duration
+	verbose              bool
+	quiet                bool
+	limitRate            string
+	minChunkSize         string
+	chunkSize            string
+	headers              []string
+	auto                 bool
+	maxParallelFiles     int
+	input                string
+	proxy                string
+	decompress           bool
+	diskCheck            bool
+	preallocate          bool
+	user                 string
+	userAgent            string
+	bearer               string
+	insecure             bool
+	caCert               string
+	maxRedirects         int
+	sameHostRedirects    bool
+	timeout              time.Duration
+	probeTimeout         time.Duration
+	single               bool
+	ifExists             string
+	dryRun               bool
+	probeRanges          bool
+	http1                bool
+	tempDir              string
+	stagger              time.Duration
+	portableNames        bool
+	preservePath         bool
+	maxPerHost           int
+	workStealing         bool
+	expectContentType    string
+	json                 bool
+	requestMethod        string
+	data                 string
+	// Made by runBatch out of maxPerHost, so all the downloads share it.
+	hostLimiter *HostLimiter
+	// Made by runBatch with --json, so the events of the downloads don't get mixed up.
+	events *eventWriter
+	// Made by runBatch, so links ending in the same file name don't write to the same file.
+	names *nameClaims
 }
 
 func main() {
-	var progressEnabled bool
-	var workersCount int
-	var progressCalcInterval int
+	var opts downloadOptions
 
 	var root = &cobra.Command{
 		Use:   "downloader",
@@ -40,68 +258,381 @@ func main() {
 	}
 
 	var cmd = &cobra.Command{
-		Use:   "download [link]",
-		Short: "downloading a file",
-		Run: func(cmd *cobra.Command, args []string) {
-			if len(args) != 1 {
-				log.Fatal("wrong number of arguments passed ", len(args))
+		Use:   "download [link...]",
+		Short: "downloading one or more files",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.input != "" {
+				links, err := readLinksFile(opts.input)
+				if err != nil {
+					return err
+				}
+				args = append(args, links...)
+			}
+			if len(args) == 0 {
+				return usagef("at least one link should be passed")
 			}
-			if workersCount <= 0 {
-				log.Fatal("workers count can't be less than 1, and 1 is used for non-concurrent mode")
+			if opts.workersCount <= 0 {
+				return usagef("workers count can't be less than 1, and 1 is used for non-concurrent mode")
+			}
+			if opts.quiet && opts.verbose {
+				return usagef("--quiet and --verbose can't be used together")
+			}
+			if opts.json && opts.dryRun {
+				return usagef("--json and --dry-run can't be used together")
+			}
+			if opts.quiet {
+				opts.progressEnabled = false
 			}
 			// Not to fast to consume all the resources
-			if progressCalcInterval < 50 {
-				progressCalcInterval = 50
+			if opts.progressCalcInterval < 50 {
+				opts.progressCalcInterval = 50
 			}
 
-			if err := run(workersCount, progressEnabled, progressCalcInterval, args[0]); err != nil {
-				log.Fatal(err)
+			ctx, stop := interruptContext()
+			defer stop()
+			err := runBatch(ctx, opts, args)
+			if err != nil && ctx.Err() != nil {
+				exitInterrupted(opts)
 			}
+			return err
+		},
+	}
+
+	cmd.Flags().IntVarP(&opts.workersCount, "workers-count", "w", 5, "number of workers (default is 5 and 1 can be used for non-concurrent code)")
+	cmd.Flags().IntVarP(&opts.progressCalcInterval, "progress-calc-interval", "i", 300, "the amount of time (in millisecond) in between of recalculating the progress of a downloading file")
+	cmd.Flags().BoolVarP(&opts.progressEnabled, "progress-enabled", "p", true, "show the progress or not (default is true)")
+	cmd.Flags().BoolVar(&opts.progressBar, "progress-bar", false, "show the progress as a bar updated in place, when the output is a terminal")
+	cmd.Flags().StringVar(&opts.input, "input", "", `file to read the links from, one per line, blank lines and lines starting with # are skipped, "-" reads stdin`)
+	cmd.Flags().IntVar(&opts.maxParallelFiles, "max-parallel-files", 3, "how many files are downloaded at the same time when several links are passed")
+	cmd.Flags().IntVar(&opts.maxPerHost, "max-per-host", 0, "most requests running at once against a single host, across all the files being downloaded (default is unlimited)")
+	cmd.Flags().BoolVarP(&opts.auto, "auto", "a", false, "pick the number of workers from the file size, one per 4MB, using --workers-count as the maximum")
+	cmd.Flags().BoolVarP(&opts.resume, "resume", "r", false, "keep the partial file if the download fails and continue it on the next run")
+	cmd.Flags().BoolVar(&opts.keepPartial, "keep-partial", false, "keep the partial file of a failed download, so a later run with --resume can continue it")
+	cmd.Flags().StringVarP(&opts.output, "output", "o", "", "file path to save the download to, or an existing directory to save it in (default is the current directory)")
+	cmd.Flags().StringVar(&opts.ifExists, "if-exists", "error", "what to do when the output file already exists: error, skip or overwrite")
+	cmd.Flags().BoolVar(&opts.createDirs, "create-dirs", false, "create the missing directories of the output path")
+	cmd.Flags().BoolVar(&opts.portableNames, "portable-names", false, "make the file names taken from the URLs valid on Windows too")
+	cmd.Flags().BoolVar(&opts.preservePath, "preserve-path", false, "save each file under the host and directories of its URL inside the output directory, instead of flat")
+	cmd.Flags().StringVar(&opts.tempDir, "temp-dir", "", "directory to write the partial files in (default is next to the output file)")
+	cmd.Flags().BoolVarP(&opts.quiet, "quiet", "q", false, "print nothing but the path of the downloaded file, and errors")
+	cmd.Flags().BoolVar(&opts.json, "json", false, "print the start, progress, result and errors of each download as JSON objects, one per line")
+	cmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "print how each file would be downloaded, its size, ranges and path, without downloading it")
+	cmd.Flags().BoolVar(&opts.decompress, "decompress", true, "decode gzip or deflate encoded responses, use --decompress=false to keep them as sent")
+	cmd.Flags().BoolVar(&opts.diskCheck, "disk-check", true, "make sure the file fits on the disk before downloading it")
+	cmd.Flags().BoolVar(&opts.preallocate, "preallocate", true, "reserve the disk space of big files before downloading them")
+	cmd.Flags().StringVar(&opts.minChunkSize, "min-chunk-size", "1M", "smallest part of a file a worker downloads, like 512k or 2M")
+	cmd.Flags().StringVar(&opts.chunkSize, "chunk-size", "", "split files into chunks of this size, like 8M, with -w of them downloaded at once")
+	cmd.Flags().BoolVar(&opts.single, "single", false, "download each file in a single request, even when the server supports ranges")
+	cmd.Flags().BoolVar(&opts.workStealing, "work-stealing", false, "split files into chunks shrinking towards the end, handing the smallest ones to the slowest workers")
+	cmd.Flags().DurationVar(&opts.stagger, "stagger", 0, "start the workers this long apart, like 200ms, instead of all at once")
+	cmd.Flags().StringVar(&opts.limitRate, "limit-rate", "", "maximum download speed in bytes per second, like 500k or 2M (default is unlimited)")
+	cmd.Flags().StringVar(&opts.checksum, "checksum", "", "verify the downloaded file against an expected digest, in the form sha256:HEX (md5, sha1, sha256 and sha512 are supported)")
+	cmd.Flags().StringVar(&opts.expectContentType, "expect-content-type", "", "fail when the server sends another type than this, like application/zip, or an HTML page instead of the file")
+	cmd.Flags().StringVar(&opts.printHash, "print-hash", "", "print the digest of the downloaded file with this algorithm, like sha256, as HASH  PATH with --quiet")
+
+	addRequestFlags(cmd.Flags(), &opts)
+
+	var inspect = &cobra.Command{
+		Use:   "inspect link",
+		Short: "showing what the server tells about a file, without downloading it",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := interruptContext()
+			defer stop()
+			return runInspect(ctx, opts, args[0])
 		},
 	}
+	addRequestFlags(inspect.Flags(), &opts)
 
-	cmd.Flags().IntVarP(&workersCount, "workers-count", "w", 5, "number of workers (default is 5 and 1 can be used for non-concurrent code)")
-	cmd.Flags().IntVarP(&progressCalcInterval, "progress-calc-interval", "i", 300, "the amount of time (in millisecond) in between of recalculating the progress of a downloading file")
-	cmd.Flags().BoolVarP(&progressEnabled, "progress-enabled", "p", true, "show the progress or not (default is true)")
+	// Anything failing before a command gets to run is down to how it was called
+	started := false
+	root.PersistentPreRun = func(*cobra.Command, []string) {
+		started = true
+	}
+	// Errors are printed by fatal, along with what to do about them
+	root.SilenceErrors = true
+	root.SilenceUsage = true
+
+	var versionCmd = &cobra.Command{
+		Use:   "version",
+		Short: "showing the version, commit and build date of the downloader",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Println("downloader", versionInfo())
+		},
+	}
+	root.Version = versionInfo()
+	root.SetVersionTemplate("downloader {{.Version}}\n")
 
-	root.AddCommand(cmd)
+	root.AddCommand(cmd, inspect, versionCmd)
 	if err := root.Execute(); err != nil {
-		log.Fatal(err)
+		if !started {
+			err = &usageError{err}
+		}
+		if opts.json || jsonRequested(os.Args[1:]) {
+			fatalJSON(err)
+		}
+		fatal(err)
+	}
+}
+
+// Registers the flags of configureRequests on flags.
+func addRequestFlags(flags *pflag.FlagSet, opts *downloadOptions) {
+	flags.BoolVarP(&opts.verbose, "verbose", "v", false, "log what the downloader is doing to stderr")
+	flags.IntVar(&opts.maxRedirects, "max-redirects", defaultMaxRedirects, "most redirects to follow, 0 disables them")
+	flags.BoolVar(&opts.sameHostRedirects, "same-host-redirects", false, "refuse redirects to another host")
+	flags.BoolVar(&opts.insecure, "insecure", false, "don't verify the TLS certificate of the server")
+	flags.StringVar(&opts.caCert, "cacert", "", "verify the server against the PEM certificates in this file instead of the system ones")
+	flags.StringVarP(&opts.user, "user", "u", "", "credentials for basic authentication, as user:password")
+	flags.StringVar(&opts.userAgent, "user-agent", "", "User-Agent to send (default is multipart-downloader/<version>)")
+	flags.StringVar(&opts.bearer, "bearer", "", "token to authenticate with as a bearer token")
+	flags.StringVar(&opts.proxy, "proxy", "", "proxy to send the requests through, like http://host:port or socks5://host:port (default is taken from HTTP_PROXY and HTTPS_PROXY)")
+	flags.StringVarP(&opts.requestMethod, "request", "X", "", "method of the request asking for the file, like POST, the download isn't split unless it redirects to a GET")
+	flags.StringVar(&opts.data, "data", "", "body to send with the request asking for the file, with POST unless --request says otherwise")
+	flags.StringArrayVarP(&opts.headers, "header", "H", nil, `extra header to send with every request, in the form "Key: Value", can be repeated`)
+	flags.DurationVar(&opts.timeout, "timeout", 0, "give up on a request taking longer than this, like 30s or 2m (default is no timeout)")
+	flags.DurationVar(&opts.probeTimeout, "probe-timeout", 30*time.Second, "give up on the requests asking the server about a file taking longer than this, 0 leaves them to --timeout")
+	flags.IntVar(&opts.retries, "retries", 0, "how many times a failed request is retried")
+	flags.DurationVar(&opts.retryDelay, "retry-delay", time.Second, "delay before the first retry, doubled after each attempt")
+	flags.BoolVar(&opts.probeRanges, "probe-ranges", false, "try a ranged request when the server doesn't say it supports ranges")
+	flags.BoolVar(&opts.http1, "http1", false, "use HTTP/1.1 only, for servers misbehaving over HTTP/2")
+}
+
+// Applies the flags shaping the requests themselves, shared by the download and inspect commands.
+func configureRequests(d *downloader, opts downloadOptions) error {
+	d.WithRetries(opts.retries, opts.retryDelay)
+	d.WithTimeout(opts.timeout)
+	d.WithProbeTimeout(opts.probeTimeout)
+	if opts.verbose {
+		d.WithLogger(newStreamLogger(os.Stderr))
+	}
+	if opts.insecure {
+		d.WithInsecureSkipVerify(true)
+	}
+	if opts.caCert != "" {
+		pool, err := loadCertPool(opts.caCert)
+		if err != nil {
+			return err
+		}
+		d.WithRootCAs(pool)
+	}
+	d.WithMaxRedirects(opts.maxRedirects)
+	d.WithSameHostRedirects(opts.sameHostRedirects)
+	if opts.proxy != "" {
+		if _, err := parseProxyURL(opts.proxy); err != nil {
+			return err
+		}
+		d.WithProxy(opts.proxy)
+	}
+	for _, header := range opts.headers {
+		key, value, ok := strings.Cut(header, ":")
+		if !ok || strings.TrimSpace(key) == "" {
+			return fmt.Errorf(`header %q should be in the form "Key: Value"`, header)
+		}
+		d.WithHeader(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+	if opts.user != "" {
+		user, password, ok := strings.Cut(opts.user, ":")
+		if !ok {
+			return fmt.Errorf("--user should be in the form user:password")
+		}
+		d.WithBasicAuth(user, password)
+	}
+	if opts.bearer != "" {
+		d.WithBearerToken(opts.bearer)
+	}
+	if opts.userAgent != "" {
+		d.WithUserAgent(opts.userAgent)
+	}
+	d.WithRequestMethod(opts.requestMethod)
+	if opts.data != "" {
+		d.WithRequestBody([]byte(opts.data))
 	}
+	d.WithAggressiveRangeProbe(opts.probeRanges)
+	if opts.http1 {
+		d.WithForceHTTP1(true)
+	}
+	return nil
 }
 
-func run(workersCount int, progressEnabled bool, progressCalcInterval int, link string) error {
-	d := NewDownloader(workersCount)
-	d.WithProgress(progressEnabled, progressCalcInterval)
-	if progressEnabled {
+// Downloads a single link, prefix is printed before each of its output lines.
+func run(ctx context.Context, opts downloadOptions, link, prefix string) error {
+	if opts.json {
+		return runJSON(ctx, opts, link)
+	}
+	d := NewDownloader(opts.workersCount)
+	if err := configureDownload(d, opts); err != nil {
+		return &usageError{err}
+	}
+	if opts.dryRun {
+		return printPlan(ctx, d, link, prefix)
+	}
+
+	progressDone := make(chan struct{})
+	if opts.progressEnabled {
 		// Consume progress in a separate goroutine
-		go func() {
-			for progress := range d.ConsumeProgress() {
-				fmt.Println(progress, "%", "downloaded")
-			}
-		}()
+		progressChan := d.ConsumeProgressDetailed()
+		// Bars of several files at once would overwrite each other, and redrawing is no use in a log
+		if opts.progressBar && prefix == "" && isTerminal(os.Stdout) {
+			go func() {
+				defer close(progressDone)
+				for progress := range progressChan {
+					fmt.Print(renderProgressBar(progress))
+				}
+				fmt.Println()
+			}()
+		} else {
+			go func() {
+				defer close(progressDone)
+				for progress := range progressChan {
+					// Without a total there's no percentage to show
+					if progress.Total < 0 {
+						fmt.Println(prefix+strconv.FormatInt(progress.Downloaded, 10), "bytes", "downloaded")
+						continue
+					}
+					fmt.Println(prefix+strconv.FormatInt(progress.Percent(), 10), "%", "downloaded")
+				}
+			}()
+		}
+	} else {
+		close(progressDone)
 	}
 
-	filePath, err := d.Download(link)
+	filePath, err := d.DownloadContext(ctx, link)
+	<-progressDone
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("file is successfully written to:", filePath)
+	sum := ""
+	if opts.printHash != "" {
+		// A skipped file wasn't read by the download, so it's done here
+		if sum, err = d.LastChecksum(opts.printHash); err != nil {
+			if sum, err = fileChecksum(d.fs, filePath, strings.ToLower(opts.printHash)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Scripts get just the path to work with, in the format of sha256sum and the like along with its hash
+	if opts.quiet {
+		if sum != "" {
+			fmt.Printf("%s  %s\n", sum, filePath)
+			return nil
+		}
+		fmt.Println(filePath)
+		return nil
+	}
+	fmt.Println(prefix+"file is successfully written to:", filePath)
+	if sum != "" {
+		fmt.Println(prefix+strings.ToLower(opts.printHash)+":", sum)
+	}
+	return nil
+}
+
+// Applies the download options of the flags to d.
+func configureDownload(d *downloader, opts downloadOptions) error {
+	d.WithProgress(opts.progressEnabled, opts.progressCalcInterval)
+	d.WithResume(opts.resume)
+	d.WithKeepPartialOnError(opts.keepPartial)
+	if opts.auto {
+		d.WithAutoWorkers(opts.workersCount, defaultAutoChunkSize)
+	}
+	d.WithOutput(opts.output)
+	d.WithCreateDirs(opts.createDirs)
+	d.WithTempDir(opts.tempDir)
+	d.WithPortableNames(opts.portableNames)
+	if opts.preservePath {
+		d.WithPathMode(PathModePreserve)
+	}
+	policy, err := parseExistingFilePolicy(opts.ifExists)
+	if err != nil {
+		return err
+	}
+	d.WithExistingFilePolicy(policy)
+	if err := configureRequests(d, opts); err != nil {
+		return err
+	}
+	d.WithDecompress(opts.decompress)
+	d.WithPreflightDiskCheck(opts.diskCheck)
+	d.WithPreallocate(opts.preallocate)
+	minChunkSize, err := parseByteSize(opts.minChunkSize)
+	if err != nil {
+		return err
+	}
+	d.WithMinChunkSize(minChunkSize)
+	d.WithStaggerStart(opts.stagger)
+	d.WithWorkStealing(opts.workStealing)
+	d.WithForceSingle(opts.single)
+	d.WithHostLimiter(opts.hostLimiter)
+	if opts.names != nil {
+		d.nameFile = func(dirs, name string) string {
+			return opts.names.claim(filepath.Join(dirs, name))
+		}
+	}
+	if opts.chunkSize != "" {
+		chunkSize, err := parseByteSize(opts.chunkSize)
+		if err != nil {
+			return err
+		}
+		d.WithChunkSize(chunkSize)
+	}
+	if opts.limitRate != "" {
+		limit, err := parseByteSize(opts.limitRate)
+		if err != nil {
+			return err
+		}
+		d.WithRateLimit(limit)
+	}
+	if opts.checksum != "" {
+		algo, expected, err := parseChecksum(opts.checksum)
+		if err != nil {
+			return err
+		}
+		d.WithChecksum(algo, expected)
+	}
+	if opts.printHash != "" {
+		if _, err := newHash(strings.ToLower(opts.printHash)); err != nil {
+			return err
+		}
+		d.WithComputedChecksums(opts.printHash)
+	}
+	d.WithExpectedContentType(opts.expectContentType)
 	return nil
 }
 
-// IMPORTANT: use one downloader per download or lock users to download only one file at a time.
-//
-//	One downloader downloading multiple files will may have unexpected behavior.
-//
-// TODO: Calculate workers count dynamically and combine its logic with process single
+// A downloader can be reused for any number of downloads as long as they run one after the other,
+// each of them starts from a clean state and closes its own progress channels when it returns.
+// It can't run several downloads at once, one started while another is running fails right away.
 func NewDownloader(workersCount int) *downloader {
+	d := withOptions(options{
+		workersCount:       workersCount,
+		client:             &http.Client{},
+		memoryBufferingMax: defaultMemoryBufferingMax,
+		logger:             noopLogger{},
+		headers:            http.Header{},
+		maxRedirects:       defaultMaxRedirects,
+		decompress:         true,
+		minChunkSize:       defaultMinChunkSize,
+		userAgent:          "multipart-downloader/" + version,
+		preflightDiskCheck: true,
+		preallocate:        true,
+		fs:                 osFileSystem{},
+		observer:           noopObserver{},
+		copyBuffers:        newBufferPool(defaultCopyBufferSize),
+		resumeSaveInterval: defaultResumeSaveInterval,
+	})
+	d.pooledTransport = d.transport()
+	d.growConnectionPool(workersCount)
+	return d
+}
+
+// Returns a downloader set up with o that hasn't downloaded anything yet.
+func withOptions(o options) *downloader {
 	return &downloader{
-		workersCount: workersCount,
-		chunks:       make([]bytes.Buffer, workersCount),
-		progressChan: make(chan int),
-		client:       &http.Client{},
+		options:              o,
+		progressChan:         make(chan int, 1),
+		progressDetailedChan: make(chan Progress, 1),
 	}
 }
 
@@ -109,170 +640,1420 @@ func (d *downloader) WithCustomHttpClient(client *http.Client) {
 	d.client = client
 }
 
+// Authenticates every request, including the HEAD one, with the basic scheme.
+func (d *downloader) WithBasicAuth(user, password string) {
+	credentials := base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+	d.headers.Set("Authorization", "Basic "+credentials)
+}
+
+// Authenticates every request, including the HEAD one, with token as a bearer token.
+func (d *downloader) WithBearerToken(token string) {
+	d.headers.Set("Authorization", "Bearer "+token)
+}
+
+// Sends userAgent as the User-Agent of every request, instead of the default multipart-downloader/<version>.
+func (d *downloader) WithUserAgent(userAgent string) {
+	d.userAgent = userAgent
+}
+
+// Adds a header to every request the downloader sends, including the HEAD one, like Authorization or Cookie.
+// Calling it again with the same key adds another value rather than replacing it.
+func (d *downloader) WithHeader(key, value string) {
+	d.headers.Add(key, value)
+}
+
+// Picks the workers count of each download from its size instead of the fixed one,
+// one worker per chunkSizeBytes, at most maxWorkers, files smaller than a chunk are downloaded by a single worker.
+func (d *downloader) WithAutoWorkers(maxWorkers, chunkSizeBytes int) {
+	d.autoMaxWorkers = maxWorkers
+	d.autoChunkSize = chunkSizeBytes
+	d.growConnectionPool(maxWorkers)
+}
+
+// Never gives a worker less than size bytes, so small files aren't split between workers that would
+// spend more on their requests than on the data, use 0 to split regardless of the size.
+func (d *downloader) WithMinChunkSize(size int) {
+	d.minChunkSize = size
+}
+
+// Splits files into chunks of size bytes, the last one holding whatever is left, instead of one chunk per worker.
+// How many of them are downloaded at once is up to WithMaxConcurrency.
+func (d *downloader) WithChunkSize(size int) {
+	d.chunkSize = size
+}
+
+// Downloads at most n chunks at once, whatever their number.
+// It defaults to the workers count given to NewDownloader once WithChunkSize is used.
+func (d *downloader) WithMaxConcurrency(n int) {
+	d.maxConcurrency = n
+	d.growConnectionPool(n)
+}
+
+// Routes the messages of the downloader to l, they are discarded by default.
+func (d *downloader) WithLogger(l Logger) {
+	d.logger = l
+}
+
 func (d *downloader) WithProgress(isEnabled bool, interval int) {
 	d.progressEnabled = isEnabled
 	d.progressCalcInterval = interval
 }
 
+// Files bigger than max bytes are written straight to a temp file next to the destination
+// instead of being held in memory, use 0 to always stream to disk.
+func (d *downloader) WithMemoryBuffering(max int) {
+	d.memoryBufferingMax = max
+}
+
+// Saves the download to path instead of the current directory, if path is an existing directory
+// (or ends with a separator) the file name is still derived from the URL.
+func (d *downloader) WithOutput(path string) {
+	d.output = path
+}
+
+// Creates the missing parent directories of the output path instead of failing.
+func (d *downloader) WithCreateDirs(enabled bool) {
+	d.createDirs = enabled
+}
+
+// Keeps the partial file of a failed or cancelled download and continues it on the next Download
+// of the same file, as long as the server still reports the same size and ETag.
+// Resumable downloads are always streamed to disk, regardless of WithMemoryBuffering.
+func (d *downloader) WithResume(enabled bool) {
+	d.resumeEnabled = enabled
+}
+
 // Downloads a file, store it in the file system and returns the path to the file,
 // or raise an error if it can't download the file or can't store it.
 func (d *downloader) Download(fileURL string) (string, error) {
-	fmt.Println("downloading podcast", "url:", fileURL)
-	isMultipartSupported, contentLength, err := d.getRangeDetails(fileURL)
+	return d.DownloadContext(context.Background(), fileURL)
+}
+
+// Same as Download, but cancelling ctx aborts all the in-flight requests,
+// removes the partial file and returns an error wrapping ctx.Err().
+func (d *downloader) DownloadContext(ctx context.Context, fileURL string) (string, error) {
+	result, err := d.DownloadWithResult(ctx, fileURL)
+	return result.Path, err
+}
+
+// Same as DownloadContext, but reports what happened along with the path.
+func (d *downloader) DownloadWithResult(ctx context.Context, fileURL string) (DownloadResult, error) {
+	return d.download(ctx, []string{fileURL}, nil)
+}
+
+// Downloads the file available at every one of fileURLs, it's named after the first of them.
+// When partial is set, the file is streamed to disk and partial is told about it before the chunks start.
+func (d *downloader) download(ctx context.Context, fileURLs []string, partial *PartialFile) (result DownloadResult, err error) {
+	fileURL := fileURLs[0]
+	started := time.Now()
+	d.logger.Infof("downloading url: %s", redactURL(fileURL))
+	ctx, finish, err := d.startDownload(ctx, fileURL)
 	if err != nil {
-		return "", err
+		return DownloadResult{}, err
+	}
+	defer finish(&err)
+	if partial != nil {
+		d.onWrite = partial.notify
+	}
+
+	// Fail on a bad checksum algorithm before downloading anything
+	if _, err := d.fileHashes(); err != nil {
+		return DownloadResult{}, err
+	}
+
+	// When the path doesn't depend on what the server says, an existing file is handled without any request
+	if d.outputIsFile() {
+		if skip, err := d.checkExisting(d.output); err != nil {
+			return DownloadResult{}, err
+		} else if skip {
+			return DownloadResult{Path: d.output, Skipped: true, Elapsed: time.Since(started)}, nil
+		}
+	}
+
+	details, urls, err := d.mirrorDetails(ctx, fileURLs)
+	if errors.Is(err, ErrNotModified) {
+		// A 304 doesn't say much about the file, so the path only comes from the URL and the options
+		filePath, err := d.outputPath(d.saveName(fileURL, rangeDetails{}))
+		if err != nil {
+			return DownloadResult{}, err
+		}
+		d.logger.Infof("%s not modified, skipping", redactURL(fileURL))
+		return DownloadResult{Path: filePath, Skipped: true, NotModified: true, Elapsed: time.Since(started)}, nil
+	}
+	if err != nil {
+		return DownloadResult{}, err
+	}
+	d.ifRange = details.validator()
+	d.encoding = details.encoding
+	d.customServed = details.custom
+	d.contentLength = details.length
+	contentLength := details.length
+	isMultipartSupported := details.supported
+	workersCount := d.effectiveWorkersCount(contentLength)
+
+	filePath, err := d.outputPath(d.saveName(fileURL, details))
+	if err != nil {
+		return DownloadResult{}, err
+	}
+
+	if skip, err := d.checkExisting(filePath); err != nil {
+		return DownloadResult{}, err
+	} else if skip {
+		return DownloadResult{Path: filePath, Skipped: true, Elapsed: time.Since(started), ContentType: details.contentType}, nil
+	}
+	d.useAdvertisedDigest(details, filepath.Base(filePath))
+
+	resumed := d.resumeEnabled && d.loadResumeState(filePath, fileURL, details)
+	// A resumed download carries on with the chunks it was started with.
+	multiple := resumed && len(d.ranges) > 1 || !resumed && isMultipartSupported && workersCount > 1
+	if !resumed {
+		if err := d.checkDiskSpace(filepath.Dir(d.partPath(filePath)), contentLength); err != nil {
+			return DownloadResult{}, err
+		}
+		if !multiple {
+			workersCount = 1
+		}
+		d.allocateChunks(workersCount, contentLength)
+		// A file of unknown size could be anything, so it's streamed to disk rather than risking the memory.
+		if partial != nil || d.keepsPartial() || contentLength < 0 || contentLength > d.memoryBufferingMax {
+			if err := d.createTempFile(filePath, contentLength); err != nil {
+				return DownloadResult{}, err
+			}
+		}
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if d.keepsPartial() && d.tempFile != nil {
+			d.saveResumeState(filePath, fileURL, details)
+			return
+		}
+		d.removeTempFile()
+	}()
+	stopSaving := func() {}
+	if d.keepsPartial() && d.tempFile != nil {
+		stopSaving = d.saveResumeStatePeriodically(ctx, filePath, fileURL, details)
+	}
+	// Runs before the state is saved one last time above
+	defer stopSaving()
+
+	if partial != nil {
+		decoded := d.decompress && isEncoded(d.encoding)
+		if err := partial.streaming(d.fs, d.tempFile.Name(), contentLength, d.ranges, d.written, decoded); err != nil {
+			return DownloadResult{}, err
+		}
+	}
+
+	if err := d.startStreamHash(); err != nil {
+		return DownloadResult{}, err
+	}
+
+	d.observer.OnStart(fileURL, int64(contentLength))
+	defer func() {
+		d.observer.OnComplete(result, err)
+	}()
+
+	stopProgress := d.startProgress(ctx, contentLength)
+	defer func() { stopProgress(err == nil) }()
+
+	if err = d.process(ctx, urls, multiple); err != nil {
+		return DownloadResult{}, err
 	}
+	// The state of a finished download is removed along with its partial file
+	stopSaving()
 
-	if d.progressEnabled {
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		go d.progress(ctx, contentLength)
+	if err := d.verifySize(contentLength); err != nil {
+		return DownloadResult{}, err
 	}
 
-	if isMultipartSupported && d.workersCount > 1 {
-		return d.processMultiple(contentLength, fileURL)
+	if partial != nil {
+		if err := partial.suspend(); err != nil {
+			return DownloadResult{}, err
+		}
+	}
+	filePath, err = d.combineChunks(filePath)
+	if err != nil {
+		return DownloadResult{}, err
 	}
 
-	return d.processSingle(fileURL)
+	return DownloadResult{
+		Path:        filePath,
+		Size:        d.downloadedBytes(),
+		Multipart:   multiple,
+		Workers:     d.concurrency(len(d.ranges)),
+		Elapsed:     time.Since(started),
+		ContentType: details.contentType,
+		Checksums:   d.checksums,
+	}, nil
 }
 
-// Returns a channel returning numerical values between 0 and 100 representing the percentage of file downloaded.
-func (d *downloader) ConsumeProgress() <-chan int {
-	return d.progressChan
+// Downloads the file like DownloadContext, but writes it to w in order instead of creating a file.
+// The chunks are held in memory until all of them have arrived, regardless of WithMemoryBuffering,
+// up to the limit of WithMaxInMemorySize, and resuming isn't possible.
+func (d *downloader) DownloadToWriter(ctx context.Context, url string, w io.Writer) error {
+	return d.downloadToWriter(ctx, url, w, nil)
+}
+
+// Downloads only the bytes of the file at url from start to end, both included, and writes them to w in order.
+// Like DownloadToWriter the chunks are held in memory, and the range is split across the workers when it's big enough.
+// The server has to support ranges and the range has to be within the file.
+func (d *downloader) DownloadRange(ctx context.Context, url string, start, end int64, w io.Writer) error {
+	return d.downloadToWriter(ctx, url, w, &[2]int{int(start), int(end)})
 }
 
-func (d *downloader) processSingle(url string) (filePath string, err error) {
-	fmt.Println("processing single")
-	d.chunks[0] = bytes.Buffer{}
-	request, err := http.NewRequest("GET", url, nil)
+// Writes the file at url to w, or only the inclusive byte range span of it when it's not nil.
+func (d *downloader) downloadToWriter(ctx context.Context, url string, w io.Writer, span *[2]int) (err error) {
+	d.logger.Infof("downloading url: %s", redactURL(url))
+	ctx, finish, err := d.startDownload(ctx, url)
 	if err != nil {
-		return
+		return err
 	}
+	defer finish(&err)
 
-	response, err := d.client.Do(request)
+	hashes, err := d.fileHashes()
 	if err != nil {
-		fmt.Println(err)
+		return err
 	}
-	defer response.Body.Close()
 
-	fmt.Println("started writing to buffer")
-	written, err := io.Copy(&d.chunks[0], response.Body)
+	details, err := d.getRangeDetails(ctx, url)
 	if err != nil {
-		fmt.Println(err)
+		return err
 	}
-	fmt.Printf("written %d bytes to the buffer\n", written)
+	d.ifRange = details.validator()
+	d.encoding = details.encoding
+	d.customServed = details.custom
+	d.contentLength = details.length
 
-	return d.combineChunks(url)
-}
+	length, from := details.length, 0
+	if span != nil {
+		if !details.supported {
+			return fmt.Errorf("%s: %w", redactURL(url), ErrRangeNotSupported)
+		}
+		if span[0] < 0 || span[1] < span[0] || span[1] >= details.length {
+			return fmt.Errorf("range %d-%d is outside of the %d bytes file", span[0], span[1], details.length)
+		}
+		length, from = span[1]-span[0]+1, span[0]
+	}
 
-func (d *downloader) processMultiple(contentLength int, url string) (filePath string, err error) {
-	fmt.Println("processing multiple")
-	partLength := contentLength / d.workersCount
-	var wg sync.WaitGroup
-	wg.Add(d.workersCount)
+	if d.maxInMemorySize > 0 && length > d.maxInMemorySize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrTooLarge, length, d.maxInMemorySize)
+	}
+	d.memoryLimit = d.maxInMemorySize
+
+	workersCount := d.effectiveWorkersCount(length)
+	// A single request for the whole file wouldn't stay within the span
+	multiple := details.supported && (workersCount > 1 || span != nil)
+	if !multiple {
+		workersCount = 1
+	}
 
-	for startRange, index := 0, 0; startRange < contentLength; startRange += partLength + 1 {
-		endRange := startRange + partLength
-		if endRange > contentLength {
-			endRange = contentLength
+	d.allocateChunks(workersCount, length)
+	for i := range d.ranges {
+		d.ranges[i][0] += from
+		d.ranges[i][1] += from
+	}
+	if d.maxBufferedBytes > 0 {
+		out := w
+		if hashes != nil {
+			out = io.MultiWriter(w, hashesWriter(hashes))
 		}
-		_range := fmt.Sprintf("%d-%d", startRange, endRange)
-		go d.downloadFileForRange(&wg, url, _range, index)
-		index++
+		d.flusher = d.newChunkFlusher(ctx, out, d.maxBufferedBytes)
 	}
 
-	wg.Wait()
+	started := time.Now()
+	d.observer.OnStart(url, int64(length))
+	defer func() {
+		d.observer.OnComplete(DownloadResult{
+			Size:        d.downloadedBytes(),
+			Multipart:   multiple,
+			Workers:     d.concurrency(len(d.ranges)),
+			Elapsed:     time.Since(started),
+			ContentType: details.contentType,
+		}, err)
+	}()
 
-	if err != nil {
-		return "", err
+	stopProgress := d.startProgress(ctx, length)
+	defer func() { stopProgress(err == nil) }()
+
+	if err = d.process(ctx, []string{details.finalURL}, multiple); err != nil {
+		return err
+	}
+
+	if err := d.verifySize(length); err != nil {
+		return err
 	}
 
-	return d.combineChunks(url)
+	if d.flusher != nil {
+		return d.finishFlushing(hashes, from)
+	}
+	return d.writeChunks(w, hashes, from)
 }
 
-func (d *downloader) downloadFileForRange(wg *sync.WaitGroup, url, _range string, index int) {
-	defer wg.Done()
-	fmt.Printf("range %s started\n", _range)
-	request, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return
+// Total bytes written so far across all the chunks.
+func (d *downloader) downloadedBytes() int64 {
+	var total int64
+	for i := range d.written {
+		total += d.written[i].Load()
 	}
+	return total
+}
 
-	request.Header.Add("Range", "bytes="+_range)
+// Makes sure the chunks add up to the size the server announced, a negative expected size means it's unknown.
+func (d *downloader) verifySize(expected int) error {
+	if expected < 0 {
+		return nil
+	}
 
-	response, err := d.client.Do(request)
-	if err != nil {
-		fmt.Println(err)
+	if got := d.downloadedBytes(); got != int64(expected) {
+		return fmt.Errorf("%w: got %d want %d", ErrSizeMismatch, got, expected)
 	}
-	defer response.Body.Close()
+	return nil
+}
 
-	fmt.Println("started writing to buffer")
-	d.chunks[index] = bytes.Buffer{}
-	written, err := io.Copy(&d.chunks[index], response.Body)
-	fmt.Println(written, err)
+// Runs the progress goroutine if it's enabled, the returned function stops it and waits for it to exit.
+func (d *downloader) startProgress(ctx context.Context, totalLen int) (stop func(succeeded bool)) {
+	if !d.progressEnabled {
+		return func(bool) {}
+	}
+
+	progressCtx, cancel := context.WithCancel(ctx)
+	progressStopped := make(chan struct{})
+	var finished atomic.Bool
+	go func() {
+		defer close(progressStopped)
+		d.progress(progressCtx, totalLen, &finished)
+	}()
+
+	return func(succeeded bool) {
+		finished.Store(succeeded)
+		cancel()
+		<-progressStopped
+	}
 }
 
-func (d *downloader) combineChunks(url string) (filePath string, err error) {
-	currentDir, err := os.Getwd()
+// Sets up a download of url with a fresh state, tracked so Close can stop it.
+// finish has to be deferred with the download's error, it tells ConsumeProgress readers we're done
+// once the progress goroutine has stopped and marks the error of an interrupted download as such.
+func (d *downloader) startDownload(ctx context.Context, url string) (_ context.Context, finish func(err *error), err error) {
+	ctx, cancel := d.downloadContext(ctx)
+	untrack, err := d.track(cancel)
 	if err != nil {
-		return "", err
+		cancel()
+		return nil, nil, err
 	}
+	d.reset()
 
-	filePath = path.Join(currentDir, "/", filepath.Base(url))
-	output, err := os.Create(filePath)
-	if err != nil {
-		return "", err
+	return ctx, func(err *error) {
+		d.closeProgress()
+		untrack()
+		if *err != nil && ctx.Err() != nil {
+			*err = fmt.Errorf("download of %s interrupted: %w", redactURL(url), ctx.Err())
+		}
+		cancel()
+	}, nil
+}
+
+// Clears what the previous download left behind, so every download starts out like the first one.
+func (d *downloader) reset() {
+	d.tempFile = nil
+	d.ranges = nil
+	d.written = nil
+	d.streamHash = nil
+	d.chunks = nil
+	d.memoryLimit = 0
+	d.encoding = ""
+	d.customServed = false
+	d.decoded = false
+	d.ifRange = ""
+	d.contentLength = -1
+	d.advertisedAlgo, d.advertisedDigest = "", ""
+	d.checksums = nil
+	d.flusher = nil
+	d.onWrite = nil
+	d.openProgress()
+}
+
+// Splits a file of contentLength bytes into count chunks, unless a resumed or retried download already
+// has its ranges, and sets up their state. It has to happen before the progress goroutine starts reading it.
+// The buffers stay empty when streaming to disk.
+func (d *downloader) allocateChunks(count, contentLength int) {
+	if d.ranges == nil {
+		d.ranges = d.planRanges(count, contentLength)
 	}
-	defer output.Close()
+	d.written = make([]atomic.Int64, len(d.ranges))
+	d.chunks = make([]bytes.Buffer, len(d.ranges))
+}
 
-	for i := 0; i < len(d.chunks); i++ {
-		if _, err = d.chunks[i].WriteTo(output); err != nil {
-			return "", err
+// Returns the inclusive ranges of count chunks of a file of contentLength bytes, or of chunks of the
+// WithChunkSize size, or a single one that stays open at the end when the size is unknown, and none for an empty file.
+func (d *downloader) planRanges(count, contentLength int) [][2]int {
+	if contentLength == 0 {
+		return nil
+	}
+	if count <= 1 || contentLength < 0 {
+		end := contentLength - 1
+		if contentLength < 0 {
+			end = -1
 		}
+		return [][2]int{{0, end}}
 	}
 
-	return filePath, nil
+	if d.chunkSize <= 0 && d.workStealing {
+		return stealingRanges(contentLength, count, d.minChunkSize)
+	}
+	if d.chunkSize <= 0 {
+		return splitRanges(contentLength, count)
+	}
+
+	// Fixed size chunks, the last one gets whatever is left
+	var ranges [][2]int
+	for start := 0; start < contentLength; start += d.chunkSize {
+		ranges = append(ranges, [2]int{start, min(start+d.chunkSize, contentLength) - 1})
+	}
+	return ranges
 }
 
-func (d *downloader) progress(ctx context.Context, totalLen int) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			totalDownloaded := 0
-			for _, chunk := range d.chunks {
-				totalDownloaded += int((float32(chunk.Len()) / float32(totalLen)) * 100)
-			}
-			if totalDownloaded > 100 {
-				totalDownloaded = 100
-			}
-			d.progressChan <- totalDownloaded
+// Splits total bytes into parts inclusive [start, end] ranges that tile [0, total-1] exactly, in order.
+// The sizes differ by a byte at most, the first ranges taking the remainder, and there are
+// never more ranges than bytes. Nothing is returned for an empty file.
+func splitRanges(total, parts int) [][2]int {
+	if total <= 0 {
+		return nil
+	}
+	parts = max(min(parts, total), 1)
+
+	ranges := make([][2]int, parts)
+	size, remainder := total/parts, total%parts
+	start := 0
+	for i := range ranges {
+		end := start + size - 1
+		if i < remainder {
+			end++
 		}
-		time.Sleep(time.Millisecond * time.Duration(d.progressCalcInterval))
+		ranges[i] = [2]int{start, end}
+		start = end + 1
 	}
+	return ranges
 }
 
-func (d *downloader) getRangeDetails(url string) (bool, int, error) {
-	response, err := d.client.Head(url)
+// Returns how many chunks a file of contentLength bytes is split into,
+// which is also the number of workers unless WithMaxConcurrency caps them.
+func (d *downloader) effectiveWorkersCount(contentLength int) int {
+	if d.forceSingle {
+		return 1
+	}
+	if d.chunkSize > 0 && contentLength > 0 {
+		return (contentLength + d.chunkSize - 1) / d.chunkSize
+	}
 
-	if err != nil {
-		// If resets by peer, we should tell user that we don't support downloading this podcast
-		return false, 0, err
+	workers := d.workersCount
+	if d.autoChunkSize > 0 {
+		workers = (contentLength + d.autoChunkSize - 1) / d.autoChunkSize
+		if workers > d.autoMaxWorkers {
+			workers = d.autoMaxWorkers
+		}
+	}
+
+	if d.minChunkSize > 0 && contentLength >= 0 && workers > contentLength/d.minChunkSize {
+		workers = contentLength / d.minChunkSize
 	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// Returns how many workers download parts chunks, a fixed chunk size can make for many more chunks
+// than there should be goroutines and connections.
+func (d *downloader) concurrency(parts int) int {
+	if d.forceSingle {
+		return 1
+	}
+	limit := d.maxConcurrency
+	if limit <= 0 && (d.chunkSize > 0 || d.workStealing) {
+		limit = d.workersCount
+	}
+	if limit > 0 && limit < parts {
+		return limit
+	}
+	return parts
+}
+
+// Returns a channel returning numerical values between 0 and 100 representing the percentage of file downloaded,
+// or -1 when the server didn't tell the size of the file. 100 only comes last, once the download succeeded,
+// whether the size was known or not. The channel is closed once Download returns, so it's safe to range over it.
+// It holds a single value, which a newer one replaces while the consumer is behind, so it always reads the latest
+// state and not reading it never slows the download down.
+func (d *downloader) ConsumeProgress() <-chan int {
+	d.percentRequested.Store(true)
+	percentChan, _ := d.openProgress()
+	return percentChan
+}
 
-	if response.StatusCode != 200 && response.StatusCode != 206 {
-		return false, 0, err
+// Downloads the chunks, in parallel when multiple is set, an empty file has none and needs no request at all.
+func (d *downloader) process(ctx context.Context, urls []string, multiple bool) error {
+	switch {
+	case len(d.ranges) == 0:
+		return nil
+	case multiple:
+		return d.processMultiple(ctx, urls)
+	default:
+		return d.processSingle(ctx, urls)
 	}
+}
+
+func (d *downloader) processSingle(ctx context.Context, urls []string) error {
+	d.logger.Debugf("processing single")
+	return d.observeChunk(0, func() error {
+		return d.retryMirrors(ctx, "download", urls, 0, func(url string) error {
+			return d.downloadFile(ctx, url)
+		})
+	})
+}
 
-	contentLength, err := strconv.Atoi(response.Header.Get("Content-Length"))
+// Downloads the whole file sequentially, carrying on from what's already written when the server allows it.
+func (d *downloader) downloadFile(ctx context.Context, url string) error {
+	release, err := d.holdHost(ctx, url)
 	if err != nil {
-		return false, 0, err
+		return err
+	}
+	defer release()
+
+	if isFTP(url) {
+		return d.ftpDownloadFile(ctx, url)
+	}
+
+	done := d.written[0].Load()
+	// The custom request already got the file when asked about it, unless this is a later attempt
+	response := d.takeFirstResponse(url)
+	if response != nil && done > 0 {
+		response.Body.Close()
+		response = nil
+	}
+	if response == nil {
+		if response, err = d.requestFile(ctx, url, done); err != nil {
+			return err
+		}
+	}
+	defer response.Body.Close()
+
+	if err := checkThrottled(response); err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
+		return &statusError{response}
+	}
+	if err := d.checkContentType(response.Header); err != nil {
+		return err
+	}
+
+	// The server sent the whole file instead of the rest of it, maybe because it changed, so start over.
+	if done > 0 && response.StatusCode != http.StatusPartialContent {
+		done = 0
+		d.written[0].Store(0)
+	}
+
+	body := d.limitReader(ctx, response.Body)
+	if encoding := response.Header.Get("Content-Encoding"); d.decompress && isEncoded(encoding) {
+		return d.decodeFile(encoding, body)
+	}
+
+	d.logger.Debugf("started writing")
+	written, err := d.copyBody(d.sniffed(d.chunkWriter(0, int(done)), int(done)), body)
+	if err != nil {
+		return err
+	}
+	d.logger.Debugf("written %d bytes", written)
+	return nil
+}
+
+// Sends the request for the whole file, for the rest of it after done bytes when it can.
+func (d *downloader) requestFile(ctx context.Context, url string, done int64) (*http.Response, error) {
+	request, err := d.newFileRequest(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	// An encoded body can only be decoded from its start
+	if done > 0 && !isEncoded(d.encoding) {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", done))
+		if d.ifRange != "" {
+			request.Header.Set("If-Range", d.ifRange)
+		}
+	}
+	return d.client.Do(request)
+}
+
+// Writes the decoded body from the start of the file, counting the encoded bytes since those are
+// what the server announced with Content-Length.
+func (d *downloader) decodeFile(encoding string, body io.Reader) error {
+	d.decoded = true
+	d.written[0].Store(0)
+	// The decoded file may well be shorter than the temp file was sized for
+	if d.tempFile != nil {
+		if err := d.tempFile.Truncate(0); err != nil {
+			return err
+		}
+	}
+
+	decoded, err := decoder(encoding, &countingReader{r: body, read: &d.written[0], report: d.bytesReporter()})
+	if err != nil {
+		return err
+	}
+
+	d.logger.Debugf("started writing %s decoded", encoding)
+	written, err := d.copyBody(d.sniffed(d.chunkDestination(0, 0), 0), decoded)
+	if err != nil {
+		return err
+	}
+	d.logger.Debugf("written %d decoded bytes", written)
+	return nil
+}
+
+func (d *downloader) processMultiple(ctx context.Context, urls []string) error {
+	d.logger.Debugf("processing multiple")
+
+	// A file that changed on the server makes the other ranges worthless, so they're stopped as well.
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	// Each range reports its own failure into its slot, so no locking is needed.
+	errs := make([]error, len(d.ranges))
+	var wg sync.WaitGroup
+	workers := d.concurrency(len(d.ranges))
+	gate := newConcurrencyGate(workers)
+	// The workers take the ranges off a queue, so there are never more goroutines than the concurrency allows.
+	queue := newWorkQueue(len(d.ranges), workers, d.workStealing && d.flusher == nil)
+	wg.Add(workers)
+
+	for i := 0; i < workers; i++ {
+		go func(worker int) {
+			defer wg.Done()
+			// The first worker never waits, so the queue still gets drained when ctx is done
+			if !d.staggerStart(ctx, worker) {
+				return
+			}
+			for {
+				index, ok := queue.next(worker)
+				if !ok {
+					return
+				}
+				started, before := time.Now(), d.written[index].Load()
+				startRange, endRange := d.ranges[index][0], d.ranges[index][1]
+				// Chunks are spread over the mirrors in turn
+				errs[index] = d.observeChunk(index, func() error {
+					return d.retryMirrors(ctx, fmt.Sprintf("range %d-%d", startRange, endRange), urls, index, func(url string) error {
+						release, _ := d.holdSlot(index, func() (func(), error) {
+							gate.acquire()
+							return gate.release, nil
+						})
+						defer release()
+						err := d.downloadFileForRange(ctx, url, startRange, endRange, index)
+						if isThrottled(err) {
+							d.logger.Infof("server is throttling, going down to %d requests at once", gate.reduce())
+						}
+						return err
+					})
+				})
+				queue.record(worker, d.written[index].Load()-before, time.Since(started))
+				if errors.Is(errs[index], ErrFileChanged) || errors.Is(errs[index], ErrUnexpectedContentType) {
+					stop()
+				}
+				// The chunks after a missing one can't be written out anymore
+				if errs[index] != nil && d.flusher != nil {
+					d.flusher.fail(errChunkMissing)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	// The ranges stopped because of it would only add noise
+	var failed []int
+	for index, err := range errs {
+		if errors.Is(err, ErrFileChanged) || errors.Is(err, ErrUnexpectedContentType) {
+			return err
+		}
+		if err != nil {
+			failed = append(failed, index)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return &RangesError{Ranges: d.missingRanges(failed), Err: errors.Join(errs...)}
+}
+
+// Downloads the inclusive byte range [startRange, endRange] into the chunk at index,
+// skipping what's already written for it, a body shorter than the requested range is reported as an error.
+func (d *downloader) downloadFileForRange(ctx context.Context, url string, startRange, endRange, index int) error {
+	done := int(d.written[index].Load())
+	if startRange+done > endRange {
+		return nil
+	}
+	startRange += done
+
+	_range := fmt.Sprintf("%d-%d", startRange, endRange)
+	release, err := d.holdSlot(index, func() (func(), error) {
+		return d.holdHost(ctx, url)
+	})
+	if err != nil {
+		return fmt.Errorf("range %s: %w", _range, err)
+	}
+	defer release()
+
+	d.logger.Debugf("range %s started", _range)
+	if isFTP(url) {
+		return d.ftpDownloadRange(ctx, url, startRange, endRange, index)
+	}
+
+	request, err := d.newRequest(ctx, "GET", url)
+	if err != nil {
+		return fmt.Errorf("range %s: %w", _range, err)
+	}
+
+	request.Header.Set("Range", "bytes="+_range)
+	if d.ifRange != "" {
+		request.Header.Set("If-Range", d.ifRange)
+	}
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("range %s: %w", _range, err)
+	}
+	defer response.Body.Close()
+
+	body := d.limitReader(ctx, response.Body)
+	expected := int64(endRange - startRange + 1)
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		// Writing a range the server clamped or shifted would put its bytes in the wrong place
+		contentRange := response.Header.Get("Content-Range")
+		start, end, total, err := parseContentRange(contentRange)
+		if err != nil || start != startRange || end != endRange {
+			return fmt.Errorf("range %s: %w, server sent Content-Range %q", _range, ErrRangeNotSupported, contentRange)
+		}
+		if total >= 0 && d.contentLength >= 0 && total != d.contentLength {
+			return fmt.Errorf("range %s: %w, its size went from %d to %d bytes", _range, ErrFileChanged, d.contentLength, total)
+		}
+	case http.StatusOK:
+		// Given If-Range, the server answers with the whole file when it no longer matches what we started with
+		if !d.sameFile(response.Header) {
+			return fmt.Errorf("range %s: %w", _range, ErrFileChanged)
+		}
+		// Otherwise the server ignored Range and sent the whole file, so only our part of it is kept.
+		d.logger.Debugf("range %s: server ignored the range, skipping to it", _range)
+		if _, err := io.CopyN(io.Discard, body, int64(startRange)); err != nil {
+			return fmt.Errorf("range %s: %w", _range, err)
+		}
+		body = io.LimitReader(body, expected)
+	default:
+		if err := checkThrottled(response); err != nil {
+			return fmt.Errorf("range %s: %w", _range, err)
+		}
+		return fmt.Errorf("range %s: %w", _range, &statusError{response})
+	}
+	if err := d.checkContentType(response.Header); err != nil {
+		return fmt.Errorf("range %s: %w", _range, err)
+	}
+
+	d.logger.Debugf("range %s: started writing", _range)
+	written, err := d.copyBody(d.sniffed(d.chunkWriter(index, startRange), startRange), body)
+	if err != nil {
+		return fmt.Errorf("range %s: %w", _range, err)
+	}
+
+	if written != expected {
+		return fmt.Errorf("range %s: %w, received %d bytes, expected %d", _range, ErrSizeMismatch, written, expected)
+	}
+
+	d.logger.Debugf("range %s: written %d bytes", _range, written)
+	return nil
+}
+
+// Reports whether a response carrying header is still the file If-Range was sent for,
+// a response without any validator doesn't tell otherwise.
+func (d *downloader) sameFile(header http.Header) bool {
+	etag, lastModified := header.Get("ETag"), header.Get("Last-Modified")
+	if d.ifRange == "" || etag == "" && lastModified == "" {
+		return true
+	}
+	return d.ifRange == etag || d.ifRange == lastModified
+}
+
+// Returns where the chunk at index should be written, either its in-memory buffer
+// or the temp file at the chunk offset, counting the written bytes for the progress.
+// The buffer keeps what an earlier attempt already wrote, unless the chunk is starting over.
+func (d *downloader) chunkWriter(index, offset int) io.Writer {
+	return &countingWriter{w: d.chunkDestination(index, offset), written: &d.written[index], notify: d.onWrite, report: d.bytesReporter()}
+}
+
+// Same as chunkWriter, without counting the written bytes.
+func (d *downloader) chunkDestination(index, offset int) io.Writer {
+	var w io.Writer
+	if d.tempFile != nil {
+		w = io.NewOffsetWriter(d.tempFile, int64(offset))
+		if d.streamHash != nil {
+			w = &streamHashWriter{w: w, h: d.streamHash, off: int64(offset)}
+		}
+	} else {
+		if d.flusher != nil {
+			w = d.flusher.chunkWriter(index, int64(max(offset-d.ranges[index][0], 0)))
+		} else {
+			if d.written[index].Load() == 0 {
+				d.chunks[index].Reset()
+			}
+			w = &d.chunks[index]
+		}
+		if d.memoryLimit > 0 {
+			w = &memoryLimitWriter{w: w, d: d, limit: d.memoryLimit}
+		}
+	}
+	return w
+}
+
+type countingWriter struct {
+	w       io.Writer
+	written *atomic.Int64
+	// Called after every write when set.
+	notify func()
+	// Given the bytes of every write when set, see bytesReporter.
+	report func(p []byte)
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.written.Add(int64(n))
+	if cw.report != nil {
+		cw.report(p[:n])
+	}
+	if cw.notify != nil {
+		cw.notify()
+	}
+	return n, err
+}
+
+// Returns where a download named name is saved and the directory it goes in,
+// which is empty when it's the current one and so can't be missing.
+func (d *downloader) resolveOutput(name string) (filePath, dir string, err error) {
+	if d.output == "" {
+		currentDir, err := os.Getwd()
+		if err != nil {
+			return "", "", err
+		}
+
+		return path.Join(currentDir, "/", name), "", nil
+	}
+
+	filePath, dir = d.output, filepath.Dir(d.output)
+	if info, err := d.fs.Stat(d.output); err == nil && info.IsDir() || os.IsPathSeparator(d.output[len(d.output)-1]) {
+		filePath, dir = filepath.Join(d.output, name), d.output
+	}
+	return filePath, dir, nil
+}
+
+// Name the file of fileURL is saved under, along with the directories of its URL with PathModePreserve.
+func (d *downloader) saveName(fileURL string, details rangeDetails) string {
+	name := fileName(fileURL, details)
+	if d.usesPortableNames() {
+		name = portableFileName(name)
+	}
+	if d.nameFile != nil {
+		return d.nameFile(d.urlDirs(fileURL), name)
+	}
+	return filepath.Join(d.urlDirs(fileURL), name)
+}
+
+// Resolves where a download named name is saved, according to WithOutput,
+// creating the missing directories when WithCreateDirs allows it.
+func (d *downloader) outputPath(name string) (string, error) {
+	filePath, dir, err := d.resolveOutput(name)
+	if err != nil {
+		return "", err
+	}
+
+	if dir != "" {
+		if _, err := d.fs.Stat(dir); errors.Is(err, os.ErrNotExist) {
+			if !d.createDirs {
+				return "", fmt.Errorf("output directory %s doesn't exist", dir)
+			}
+			if err := d.fs.MkdirAll(dir, 0755); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	// The directories of a preserved URL path are made as needed
+	if d.pathMode == PathModePreserve {
+		if err := d.fs.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return "", err
+		}
+	}
+	return filePath, nil
+}
+
+// Creates the temp file the workers write into, sized up front so each of them can write at its own offset.
+func (d *downloader) createTempFile(filePath string, size int) error {
+	tempFile, err := createFile(d.fs, d.partPath(filePath))
+	if err != nil {
+		return err
+	}
+
+	if size < 0 {
+		// Nothing to size up front, the file just grows as the body arrives.
+		d.tempFile = tempFile
+		return nil
+	}
+
+	if err := d.sizeFile(tempFile, int64(size)); err != nil {
+		tempFile.Close()
+		d.fs.Remove(tempFile.Name())
+		return err
+	}
+
+	d.tempFile = tempFile
+	return nil
+}
+
+// Starts hashing a streamed download as it's written, see streamHash. It has to happen before the workers start.
+func (d *downloader) startStreamHash() error {
+	if d.tempFile == nil {
+		return nil
+	}
+	hashes, err := d.fileHashes()
+	if err != nil || hashes == nil {
+		return err
+	}
+	written := make([]int64, len(d.written))
+	for i := range d.written {
+		written[i] = d.written[i].Load()
+	}
+	d.streamHash = newStreamHash(hashes, d.tempFile, d.ranges, written)
+	return nil
+}
+
+func (d *downloader) removeTempFile() {
+	if d.tempFile == nil {
+		return
+	}
+	d.tempFile.Close()
+	d.fs.Remove(d.tempFile.Name())
+	d.tempFile = nil
+}
+
+func (d *downloader) combineChunks(filePath string) (string, error) {
+	hashes, err := d.fileHashes()
+	if err != nil {
+		return "", err
+	}
+
+	// Streamed downloads are already on disk, they just need to be verified and moved in place.
+	if d.tempFile != nil {
+		if err := d.checkChunks(0); err != nil {
+			d.removeTempFile()
+			return "", err
+		}
+		if err := d.checkFileSize(); err != nil {
+			d.removeTempFile()
+			return "", err
+		}
+		if d.streamHash != nil {
+			if hashes, err = d.streamHash.finish(); err != nil {
+				return "", err
+			}
+		} else if hashes != nil {
+			// Retried ranges only write part of the file, the rest is read through
+			if _, err := io.Copy(hashesWriter(hashes), io.NewSectionReader(d.tempFile, 0, math.MaxInt64)); err != nil {
+				return "", err
+			}
+		}
+		if hashes != nil {
+			if err := d.finishChecksums(hashes); err != nil {
+				// Nothing worth resuming in a corrupted file
+				d.removeTempFile()
+				return "", err
+			}
+		}
+		if err := d.tempFile.Close(); err != nil {
+			return "", err
+		}
+		if err := d.moveFile(d.tempFile.Name(), filePath); err != nil {
+			return "", err
+		}
+		d.tempFile = nil
+		d.fs.Remove(d.resumeStatePath(filePath))
+		return filePath, nil
+	}
+
+	// Buffered downloads go through a temp file as well, so a failure never leaves a truncated file behind.
+	output, err := createFile(d.fs, d.partPath(filePath))
+	if err != nil {
+		return "", err
+	}
+
+	buffered := d.bufferedWriter(output)
+	err = d.writeChunks(buffered, hashes, 0)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		output.Close()
+		d.fs.Remove(output.Name())
+		return "", err
+	}
+
+	if err := output.Close(); err != nil {
+		d.fs.Remove(output.Name())
+		return "", err
+	}
+
+	if err := d.moveFile(output.Name(), filePath); err != nil {
+		d.fs.Remove(output.Name())
+		return "", err
+	}
+
+	return filePath, nil
+}
+
+// Makes sure the chunks tile the file from the byte at from without gaps or overlaps and that each of them is complete,
+// so a mistake in the range math fails loudly instead of producing a wrong file.
+func (d *downloader) checkChunks(from int) error {
+	next := from
+	for i, r := range d.ranges {
+		if r[0] != next {
+			return fmt.Errorf("chunk %d starts at %d, expected %d", i, r[0], next)
+		}
+		next = r[1] + 1
+
+		// Nothing to compare with when the size is unknown
+		if r[1] < 0 {
+			continue
+		}
+		expected := int64(r[1] - r[0] + 1)
+		if written := d.written[i].Load(); written != expected {
+			return fmt.Errorf("%w: chunk %d holds %d bytes, expected %d", ErrSizeMismatch, i, written, expected)
+		}
+		// A decoded body doesn't take the room its encoded bytes did
+		if d.tempFile == nil && !d.decoded && d.flusher == nil {
+			if size := int64(d.chunks[i].Len()); size != expected {
+				return fmt.Errorf("%w: chunk %d buffered %d bytes, expected %d", ErrSizeMismatch, i, size, expected)
+			}
+		}
+	}
+	return nil
+}
+
+// Makes sure the streamed file is exactly as long as its chunks, without anything left over from sizing it up front.
+func (d *downloader) checkFileSize() error {
+	// A decoded file or one of unknown size has nothing to compare with
+	if d.decoded || len(d.ranges) == 0 || d.ranges[len(d.ranges)-1][1] < 0 {
+		return nil
+	}
+
+	info, err := d.tempFile.Stat()
+	if err != nil {
+		return err
+	}
+	if expected := int64(d.ranges[len(d.ranges)-1][1] + 1); info.Size() != expected {
+		return fmt.Errorf("%w: file is %d bytes, expected %d", ErrSizeMismatch, info.Size(), expected)
+	}
+	return nil
+}
+
+// Writes the in-memory chunks, the first of them starting at from, to w in order,
+// feeding hashes on the way if there are any.
+func (d *downloader) writeChunks(w io.Writer, hashes map[string]hash.Hash, from int) error {
+	if hashes != nil {
+		w = io.MultiWriter(w, hashesWriter(hashes))
+	}
+
+	if err := d.checkChunks(from); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(d.chunks); i++ {
+		if _, err := d.chunks[i].WriteTo(w); err != nil {
+			return err
+		}
+	}
+
+	if hashes != nil {
+		return d.finishChecksums(hashes)
+	}
+	return nil
+}
+
+// Only feeds the channels that were asked for, so an unread one can't hold the others back.
+// The percentage only reaches 100 once the download succeeded, finished is set by then.
+func (d *downloader) progress(ctx context.Context, totalLen int, finished *atomic.Bool) {
+	percentChan, detailedChan := d.openProgress()
+	var lastBytes int64
+	lastTime := time.Now()
+	report := func(succeeded bool) {
+		// The chunks are read once, so the overall figure is exactly their sum
+		chunks := d.chunkProgress()
+		var downloadedBytes int64
+		for _, chunk := range chunks {
+			downloadedBytes += chunk.Downloaded
+		}
+		total := int64(totalLen)
+		// The size is known once the download is over
+		if succeeded && total < 0 {
+			total = downloadedBytes
+		}
+		totalDownloaded := percentage(downloadedBytes, total)
+		// All the bytes can be there while the file is still verified and moved in place, and that can fail
+		if !succeeded && totalDownloaded == 100 {
+			totalDownloaded = 99
+		}
+
+		if d.detailedRequested.Load() || d.progressCallback != nil {
+			now := time.Now()
+			snapshot := calcProgress(downloadedBytes, total, lastBytes, now.Sub(lastTime))
+			snapshot.Chunks = chunks
+			lastBytes, lastTime = downloadedBytes, now
+
+			if d.progressCallback != nil {
+				d.progressCallback(snapshot)
+			}
+			if d.detailedRequested.Load() {
+				offer(detailedChan, snapshot)
+			}
+		}
+
+		if d.percentRequested.Load() {
+			offer(percentChan, totalDownloaded)
+		}
+	}
+
+	// A ticker can't tick at 0, which used to mean reporting as often as possible
+	interval := max(time.Duration(d.progressCalcInterval)*time.Millisecond, time.Millisecond)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	report(false)
+	for {
+		select {
+		case <-ctx.Done():
+			// Consumers get to see where the download ended up
+			report(finished.Load())
+			return
+		case <-ticker.C:
+			report(false)
+		}
+	}
+}
+
+// Sends v without waiting, a value the consumer hasn't read yet is dropped to make room for it,
+// so a consumer that isn't keeping up gets the latest state rather than holding the progress loop back.
+// Only the progress loop sends, so the slot can't be taken again in between.
+func offer[T any](ch chan T, v T) {
+	select {
+	case ch <- v:
+		return
+	default:
+	}
+
+	select {
+	case <-ch:
+	default:
+	}
+	select {
+	case ch <- v:
+	default:
+	}
+}
+
+// Builds a request carrying the configured headers.
+func (d *downloader) newRequest(ctx context.Context, method, url string) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range d.headers {
+		// Host isn't sent from the header map
+		if key == "Host" {
+			request.Host = values[len(values)-1]
+			continue
+		}
+		request.Header[key] = append([]string(nil), values...)
+	}
+
+	// A User-Agent given with WithHeader wins
+	if request.Header.Get("User-Agent") == "" {
+		request.Header.Set("User-Agent", d.userAgent)
+	}
+
+	// Otherwise the transport asks for gzip on its own and hands us a body that no longer matches Content-Length
+	if request.Header.Get("Accept-Encoding") == "" {
+		request.Header.Set("Accept-Encoding", "identity")
+	}
+
+	return request, nil
+}
+
+// Asks the server about the file with a HEAD request, servers rejecting HEAD are asked again with a one byte ranged GET.
+func (d *downloader) getRangeDetails(ctx context.Context, url string) (rangeDetails, error) {
+	if isFTP(url) {
+		return d.ftpDetails(ctx, url)
+	}
+	if d.customRequest() {
+		return d.customDetails(ctx, url)
+	}
+
+	details, err := d.headDetails(ctx, url)
+	if err == nil {
+		return d.confirmRanges(ctx, url, details), nil
+	}
+	if ctx.Err() != nil || errors.Is(err, ErrNotModified) {
+		return details, err
+	}
+
+	d.logger.Debugf("HEAD %s failed, probing with a ranged GET: %v", redactURL(url), err)
+	details, probeErr := d.probeDetails(ctx, url)
+	if probeErr != nil {
+		return rangeDetails{}, fmt.Errorf("%w, ranged GET probe failed too: %v", err, probeErr)
+	}
+
+	return details, nil
+}
+
+func (d *downloader) headDetails(ctx context.Context, url string) (rangeDetails, error) {
+	ctx, cancel := d.probeContext(ctx)
+	defer cancel()
+	request, err := d.newRequest(ctx, "HEAD", url)
+	if err != nil {
+		return rangeDetails{}, err
+	}
+	d.setIfModifiedSince(request)
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		// If resets by peer, we should tell user that we don't support downloading this podcast
+		return rangeDetails{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		return rangeDetails{}, ErrNotModified
+	}
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
+		return rangeDetails{}, fmt.Errorf("unexpected status %d from HEAD %s", response.StatusCode, redactURL(url))
+	}
+
+	// Ranges are no use without knowing where the file ends, nor on an encoded body
+	contentLength := parseContentLength(response.Header.Get("Content-Length"))
+	encoding := response.Header.Get("Content-Encoding")
+	digestAlgo, digest := advertisedDigest(response.Header, true)
+	return rangeDetails{
+		supported:     contentLength >= 0 && !isEncoded(encoding) && response.Header.Get("Accept-Ranges") == "bytes",
+		encoding:      encoding,
+		length:        contentLength,
+		etag:          response.Header.Get("ETag"),
+		lastModified:  response.Header.Get("Last-Modified"),
+		fileName:      fileNameFromContentDisposition(response.Header.Get("Content-Disposition")),
+		contentType:   response.Header.Get("Content-Type"),
+		finalURL:      response.Request.URL.String(),
+		rangesUnknown: response.Header.Get("Accept-Ranges") == "",
+		digestAlgo:    digestAlgo,
+		digest:        digest,
+	}, nil
+}
+
+// Requests the first byte of the file, a 206 tells us ranges are supported and
+// its Content-Range carries the total size, a 200 means we got the whole file instead.
+func (d *downloader) probeDetails(ctx context.Context, url string) (rangeDetails, error) {
+	ctx, cancel := d.probeContext(ctx)
+	defer cancel()
+	request, err := d.newRequest(ctx, "GET", url)
+	if err != nil {
+		return rangeDetails{}, err
+	}
+	request.Header.Set("Range", "bytes=0-0")
+	d.setIfModifiedSince(request)
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return rangeDetails{}, err
+	}
+	// Closing without reading is fine, it just costs us the connection if the server sent the whole body.
+	defer response.Body.Close()
+
+	details := rangeDetails{
+		etag:         response.Header.Get("ETag"),
+		lastModified: response.Header.Get("Last-Modified"),
+		fileName:     fileNameFromContentDisposition(response.Header.Get("Content-Disposition")),
+		contentType:  response.Header.Get("Content-Type"),
+		encoding:     response.Header.Get("Content-Encoding"),
+		finalURL:     response.Request.URL.String(),
+	}
+	details.digestAlgo, details.digest = advertisedDigest(response.Header, response.StatusCode == http.StatusOK)
+
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		_, _, total, err := parseContentRange(response.Header.Get("Content-Range"))
+		if err != nil {
+			return rangeDetails{}, err
+		}
+		details.supported = total >= 0 && !isEncoded(details.encoding)
+		details.length = total
+	case http.StatusOK:
+		details.length = parseContentLength(response.Header.Get("Content-Length"))
+	case http.StatusNotModified:
+		return rangeDetails{}, ErrNotModified
+	default:
+		return rangeDetails{}, fmt.Errorf("unexpected status %d from GET %s", response.StatusCode, redactURL(url))
+	}
+
+	return details, nil
+}
+
+// Returns -1 for a missing or invalid Content-Length, which is what chunked responses look like.
+func parseContentLength(header string) int {
+	length, err := strconv.Atoi(header)
+	if err != nil || length < 0 {
+		return -1
+	}
+	return length
+}
+
+// Parses a "bytes start-end/total" Content-Range header, total is -1 when the server sent "*" for it.
+func parseContentRange(header string) (start, end, total int, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+
+	byteRange, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+
+	first, last, ok := strings.Cut(byteRange, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+
+	if start, err = strconv.Atoi(first); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q: %w", header, err)
+	}
+	if end, err = strconv.Atoi(last); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q: %w", header, err)
+	}
+
+	total = -1
+	if size != "*" {
+		if total, err = strconv.Atoi(size); err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid Content-Range %q: %w", header, err)
+		}
 	}
 
-	if response.Header.Get("Accept-Ranges") == "bytes" {
-		return true, contentLength, nil
+	if start < 0 || end < start || total >= 0 && end >= total {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
 	}
 
-	return false, contentLength, nil
+	return start, end, total, nil
 }
@@ -0,0 +1,1301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Set by runCommand, where the test binary runs the command instead of the tests.
+const commandArgsEnv = "DOWNLOADER_TEST_ARGS"
+
+func TestMain(m *testing.M) {
+	if args := os.Getenv(commandArgsEnv); args != "" {
+		if err := json.Unmarshal([]byte(args), &os.Args); err != nil {
+			panic(err)
+		}
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Runs the downloader command with args in dir, in a child process of the test binary fed stdin,
+// and returns what it printed and its exit code.
+func runCommand(t *testing.T, dir string, stdin io.Reader, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	cmd := command(t, dir, args...)
+	cmd.Stdin = stdin
+	var out, errOut bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &errOut
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), cmd.ProcessState.ExitCode()
+}
+
+// Prepares the downloader command with args in dir, as a child process of the test binary.
+func command(t *testing.T, dir string, args ...string) *exec.Cmd {
+	t.Helper()
+	encoded, err := json.Marshal(append([]string{"downloader"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0])
+	// A race enabled binary waits a second before exiting otherwise
+	cmd.Env = append(os.Environ(), commandArgsEnv+"="+string(encoded), "GORACE=atexit_sleep_ms=0")
+	cmd.Dir = dir
+	return cmd
+}
+
+// Returns n bytes that don't repeat every few of them, so misplaced ranges show.
+func testContent(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7 + i/251)
+	}
+	return b
+}
+
+// Serves data at every path, with ranges and HEAD support.
+func serveContent(data []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+}
+
+// Serves data like serveContent, counting the GETs it gets in gets.
+func getCountingServer(data []byte, gets *atomic.Int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+}
+
+// Serves data like getCountingServer, recording in peak the most GETs it served at once.
+// Each GET takes a couple of milliseconds, so the ones that can run together do.
+func peakServer(data []byte, gets, peak *atomic.Int64) *httptest.Server {
+	var running atomic.Int64
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+			n := running.Add(1)
+			defer running.Add(-1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+}
+
+// Returns a downloader splitting even small files across workers.
+func newTestDownloader(workers int) *downloader {
+	d := NewDownloader(workers)
+	d.WithMinChunkSize(0)
+	return d
+}
+
+// Runs the rest of the test in a temp directory, where the downloads are saved.
+func inTempDir(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// Sends the body a few hundred bytes at a time, so a download takes many writes.
+type trickleWriter struct{ http.ResponseWriter }
+
+func (t trickleWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		m, err := t.ResponseWriter.Write(p[:min(len(p), 4096)])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		t.ResponseWriter.(http.Flusher).Flush()
+		p = p[m:]
+	}
+	return n, nil
+}
+
+func TestRangeDetailsErrorsHidePassword(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	link := strings.Replace(srv.URL, "http://", "http://user:secret@", 1) + "/file.bin"
+	_, err := NewDownloader(1).getRangeDetails(context.Background(), link)
+	if err == nil {
+		t.Fatal("a missing file got details")
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("the error shows the password: %v", err)
+	}
+}
+
+func TestDownloadAwkwardLengths(t *testing.T) {
+	tests := []struct {
+		length, workers int
+	}{
+		{1, 3},
+		{2, 3},
+		{3, 3},
+		{4, 3},
+		{7, 3},
+		{100, 3},
+		{101, 4},
+		{103, 4},
+		{1000, 7},
+		{4097, 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d/%d", tt.length, tt.workers), func(t *testing.T) {
+			ranges := splitRanges(tt.length, tt.workers)
+			if len(ranges) != min(tt.length, tt.workers) {
+				t.Fatalf("got %d ranges, want %d", len(ranges), min(tt.length, tt.workers))
+			}
+			next := 0
+			for _, r := range ranges {
+				if r[0] != next || r[1] < r[0] {
+					t.Fatalf("ranges %v don't tile the file", ranges)
+				}
+				next = r[1] + 1
+			}
+			if next != tt.length {
+				t.Fatalf("ranges %v cover %d bytes, want %d", ranges, next, tt.length)
+			}
+
+			data := testContent(tt.length)
+			srv := serveContent(data)
+			defer srv.Close()
+			got, err := newTestDownloader(tt.workers).DownloadBytes(context.Background(), srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("downloaded bytes don't match")
+			}
+		})
+	}
+}
+
+func TestSplitRanges(t *testing.T) {
+	for total := 0; total <= 64; total++ {
+		for parts := -1; parts <= 70; parts++ {
+			ranges := splitRanges(total, parts)
+			if total == 0 {
+				if ranges != nil {
+					t.Errorf("splitRanges(0, %d) = %v, want nothing", parts, ranges)
+				}
+				continue
+			}
+
+			want := max(min(parts, total), 1)
+			if len(ranges) != want {
+				t.Fatalf("splitRanges(%d, %d) = %v, want %d ranges", total, parts, ranges, want)
+			}
+			// Each starts right after the one before, so none overlap nor leave a gap,
+			// and the remainder goes to the first ones
+			next := 0
+			for i, r := range ranges {
+				size := r[1] - r[0] + 1
+				wantSize := total / want
+				if i < total%want {
+					wantSize++
+				}
+				if r[0] != next || size != wantSize {
+					t.Fatalf("splitRanges(%d, %d) = %v, range %d is wrong", total, parts, ranges, i)
+				}
+				next = r[1] + 1
+			}
+			if next != total {
+				t.Fatalf("splitRanges(%d, %d) = %v, covers %d bytes", total, parts, ranges, next)
+			}
+		}
+	}
+}
+
+func TestRangeDetailsUnexpectedStatus(t *testing.T) {
+	for _, status := range []int{http.StatusForbidden, http.StatusNotFound, http.StatusInternalServerError} {
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(status)
+			}))
+			defer srv.Close()
+
+			_, err := NewDownloader(1).getRangeDetails(context.Background(), srv.URL+"/file.bin")
+			if err == nil {
+				t.Fatalf("a %d response got details", status)
+			}
+			if !strings.Contains(err.Error(), strconv.Itoa(status)) {
+				t.Errorf("the error doesn't mention the status: %v", err)
+			}
+		})
+	}
+}
+
+func TestConsumeProgressCloses(t *testing.T) {
+	inTempDir(t)
+	srv := serveContent(testContent(1000))
+	defer srv.Close()
+
+	d := newTestDownloader(3)
+	d.WithProgress(true, 5)
+	done := make(chan struct{})
+	go func() {
+		for range d.ConsumeProgress() {
+		}
+		close(done)
+	}()
+	if _, err := d.Download(srv.URL + "/file.bin"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the progress channel is still open after the download")
+	}
+}
+
+func TestDownloadOutput(t *testing.T) {
+	inTempDir(t)
+	srv := serveContent(testContent(100))
+	defer srv.Close()
+	if err := os.Mkdir("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		output     string
+		createDirs bool
+		want       string
+		fail       bool
+	}{
+		{"other.bin", false, "other.bin", false},
+		{"dir", false, filepath.Join("dir", "file.bin"), false},
+		{filepath.Join("dir", "other.bin"), false, filepath.Join("dir", "other.bin"), false},
+		{filepath.Join("missing", "other.bin"), false, "", true},
+		{filepath.Join("a", "b", "other.bin"), true, filepath.Join("a", "b", "other.bin"), false},
+		{"c/d/", true, filepath.Join("c", "d", "file.bin"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.output, func(t *testing.T) {
+			d := newTestDownloader(2)
+			d.WithOutput(tt.output)
+			d.WithCreateDirs(tt.createDirs)
+			path, err := d.Download(srv.URL + "/file.bin")
+			if tt.fail {
+				if err == nil {
+					t.Fatalf("got %q, want an error", path)
+				}
+				return
+			}
+			if err != nil || filepath.Clean(path) != tt.want {
+				t.Fatalf("got %q, %v, want %q", path, err, tt.want)
+			}
+			if _, err := os.Stat(tt.want); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestDownloadWithoutHead(t *testing.T) {
+	data := testContent(3000)
+	tests := []struct {
+		name   string
+		status int
+		ranges bool
+		// The probe and the ones downloading the file.
+		gets int64
+	}{
+		{"405", http.StatusMethodNotAllowed, true, 4},
+		{"403", http.StatusForbidden, true, 4},
+		{"no ranges", http.StatusMethodNotAllowed, false, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			var gets atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodHead {
+					w.WriteHeader(tt.status)
+					return
+				}
+				gets.Add(1)
+				if !tt.ranges {
+					r.Header.Del("Range")
+				}
+				http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+			}))
+			defer srv.Close()
+
+			path, err := newTestDownloader(3).Download(srv.URL + "/file.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+				t.Fatal("downloaded file doesn't match")
+			}
+			if gets.Load() != tt.gets {
+				t.Errorf("got %d GETs, want %d", gets.Load(), tt.gets)
+			}
+		})
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header            string
+		start, end, total int
+	}{
+		{"bytes 0-0/12345", 0, 0, 12345},
+		{"bytes 5-9/*", 5, 9, -1},
+	}
+	for _, tt := range tests {
+		start, end, total, err := parseContentRange(tt.header)
+		if err != nil || start != tt.start || end != tt.end || total != tt.total {
+			t.Errorf("%q: got %d, %d, %d, %v", tt.header, start, end, total, err)
+		}
+	}
+
+	for _, header := range []string{"", "bytes 5-4/10", "bytes 0-10/10", "items 0-1/2", "bytes 0-/2"} {
+		if _, _, _, err := parseContentRange(header); err == nil {
+			t.Errorf("%q parsed", header)
+		}
+	}
+}
+
+// Fails the writes to its files once they hold limit bytes, like a full disk.
+type fullDiskFS struct {
+	osFileSystem
+	limit int64
+}
+
+type fullDiskFile struct {
+	File
+	limit   int64
+	written atomic.Int64
+}
+
+func (fs fullDiskFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.osFileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &fullDiskFile{File: f, limit: fs.limit}, nil
+}
+
+func (f *fullDiskFile) Write(p []byte) (int, error) {
+	if f.written.Add(int64(len(p))) > f.limit {
+		return 0, errors.New("no space left on device")
+	}
+	return f.File.Write(p)
+}
+
+func (f *fullDiskFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.written.Add(int64(len(p))) > f.limit {
+		return 0, errors.New("no space left on device")
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func TestDownloadWriteFailureLeavesNoFile(t *testing.T) {
+	// Streamed to disk and buffered in memory
+	for _, memory := range []int{0, 1 << 20} {
+		t.Run(strconv.Itoa(memory), func(t *testing.T) {
+			inTempDir(t)
+			srv := serveContent(testContent(100000))
+			defer srv.Close()
+
+			d := newTestDownloader(4)
+			d.WithMemoryBuffering(memory)
+			d.WithFileSystem(fullDiskFS{limit: 50000})
+			if _, err := d.Download(srv.URL + "/file.bin"); err == nil {
+				t.Fatal("a download that couldn't be written succeeded")
+			}
+			if names, _ := filepath.Glob("*"); len(names) != 0 {
+				t.Errorf("left %v behind", names)
+			}
+		})
+	}
+}
+
+func TestDownloadHeaders(t *testing.T) {
+	inTempDir(t)
+	data := testContent(3000)
+	var mu sync.Mutex
+	seen := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kind := r.Method
+		if r.Header.Get("Range") != "" {
+			kind = "ranged " + kind
+		}
+		if r.Header.Get("X-Token") != "abc" || len(r.Header.Values("Cookie")) != 2 {
+			kind = "bad " + kind
+		}
+		mu.Lock()
+		seen[kind]++
+		mu.Unlock()
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(3)
+	d.WithHeader("x-token", "abc")
+	d.WithHeader("Cookie", "a=1")
+	d.WithHeader("Cookie", "b=2")
+	if _, err := d.Download(srv.URL + "/file.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"HEAD": 1, "ranged GET": 3}; !maps.Equal(seen, want) {
+		t.Errorf("got requests %v, want %v", seen, want)
+	}
+}
+
+func TestAutoWorkers(t *testing.T) {
+	tests := []struct {
+		name   string
+		length int
+		want   int
+	}{
+		{"one byte", 1, 1},
+		{"one chunk", 100, 1},
+		{"just over a chunk", 101, 2},
+		{"three and a bit chunks", 350, 4},
+		{"as many chunks as workers", 400, 4},
+		{"more chunks than workers", 10000, 4},
+		{"unknown length", -1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDownloader(1)
+			d.WithAutoWorkers(4, 100)
+			if got := d.effectiveWorkersCount(tt.length); got != tt.want {
+				t.Errorf("got %d workers for %d bytes, want %d", got, tt.length, tt.want)
+			}
+		})
+	}
+}
+
+func TestAutoWorkersWithoutRanges(t *testing.T) {
+	inTempDir(t)
+	data := testContent(10000)
+	var gets atomic.Int64
+	// No Accept-Ranges, so the file can only come in one piece
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(1)
+	d.WithAutoWorkers(4, 1000)
+	path, err := d.Download(srv.URL + "/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatal("downloaded file doesn't match")
+	}
+	if gets.Load() != 1 {
+		t.Errorf("got %d GETs, want 1", gets.Load())
+	}
+}
+
+func TestDownloadTinyFileWithManyWorkers(t *testing.T) {
+	inTempDir(t)
+	var gets atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(testContent(1000)))
+	}))
+	defer srv.Close()
+
+	d := NewDownloader(8)
+	if _, err := d.Download(srv.URL + "/file.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if gets.Load() != 1 {
+		t.Errorf("got %d GETs, want 1", gets.Load())
+	}
+	if len(d.ranges) != 1 || len(d.chunks) > 1 || len(d.written) != 1 {
+		t.Errorf("got %d ranges, %d chunks and %d counters, want a single chunk", len(d.ranges), len(d.chunks), len(d.written))
+	}
+}
+
+// Fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestDownloadToWriter(t *testing.T) {
+	inTempDir(t)
+	data := testContent(5000)
+	srv := serveContent(data)
+	defer srv.Close()
+
+	for _, workers := range []int{1, 4} {
+		var buf bytes.Buffer
+		if err := newTestDownloader(workers).DownloadToWriter(context.Background(), srv.URL+"/file.bin", &buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("%d workers wrote other bytes", workers)
+		}
+	}
+
+	err := newTestDownloader(2).DownloadToWriter(context.Background(), srv.URL+"/file.bin", failingWriter{})
+	if err == nil || err.Error() != "write failed" {
+		t.Errorf("got %v, want the error of the writer", err)
+	}
+	if names, _ := filepath.Glob("*"); len(names) != 0 {
+		t.Errorf("left %v behind", names)
+	}
+}
+
+func TestDownloadShortBody(t *testing.T) {
+	data := testContent(5000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", "5000")
+			return
+		}
+		// Without a length of its own, the response just ends early
+		w.Write(data[:1000])
+		w.(http.Flusher).Flush()
+		w.Write(data[1000:4000])
+	}))
+	defer srv.Close()
+
+	// Streamed to disk and buffered in memory
+	for _, memory := range []int{0, 1 << 20} {
+		t.Run(strconv.Itoa(memory), func(t *testing.T) {
+			inTempDir(t)
+			d := newTestDownloader(3)
+			d.WithMemoryBuffering(memory)
+			_, err := d.Download(srv.URL + "/file.bin")
+			if !errors.Is(err, ErrSizeMismatch) || !strings.Contains(err.Error(), "got 4000 want 5000") {
+				t.Fatalf("got %v, want a size mismatch", err)
+			}
+			if names, _ := filepath.Glob("*"); len(names) != 0 {
+				t.Errorf("left %v behind", names)
+			}
+		})
+	}
+}
+
+func TestDownloadConnectionClosedEarly(t *testing.T) {
+	inTempDir(t)
+	data := testContent(10000)
+	_, srv := newCuttingServer(data, 1000)
+	defer srv.Close()
+
+	for _, workers := range []int{1, 4} {
+		if _, err := newTestDownloader(workers).Download(srv.URL + "/file.bin"); err == nil {
+			t.Fatalf("%d workers: a download cut off early succeeded", workers)
+		}
+		if names, _ := filepath.Glob("*"); len(names) != 0 {
+			t.Errorf("%d workers: left %v behind", workers, names)
+		}
+	}
+}
+
+func TestDownloadChunkedEncoding(t *testing.T) {
+	data := testContent(50000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		if r.Method == http.MethodHead {
+			w.Header().Set("Transfer-Encoding", "chunked")
+			return
+		}
+		// Flushing before the end leaves the length out
+		for i := 0; i < len(data); i += 10000 {
+			w.Write(data[i : i+10000])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	for _, mode := range []string{"file", "writer"} {
+		t.Run(mode, func(t *testing.T) {
+			inTempDir(t)
+			d := newTestDownloader(4)
+			d.WithProgress(true, 1)
+			done := make(chan int)
+			go func() {
+				last := 0
+				for p := range d.ConsumeProgress() {
+					last = p
+				}
+				done <- last
+			}()
+
+			var got []byte
+			if mode == "file" {
+				result, err := d.DownloadWithResult(context.Background(), srv.URL+"/file.bin")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result.Multipart || result.Size != int64(len(data)) {
+					t.Errorf("got %+v, want a single stream of %d bytes", result, len(data))
+				}
+				got, _ = os.ReadFile(result.Path)
+			} else {
+				var buf bytes.Buffer
+				if err := d.DownloadToWriter(context.Background(), srv.URL+"/file.bin", &buf); err != nil {
+					t.Fatal(err)
+				}
+				got = buf.Bytes()
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("downloaded bytes don't match")
+			}
+			if last := <-done; last != 100 {
+				t.Errorf("the last progress is %d, want 100", last)
+			}
+		})
+	}
+}
+
+func TestDownloadFileChangedOnServer(t *testing.T) {
+	inTempDir(t)
+	data := testContent(100000)
+	var requests atomic.Int64
+	var ifRange atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `"v1"`
+		if requests.Add(1) > 1 {
+			etag = `"v2"`
+		}
+		if r.Method == http.MethodGet {
+			ifRange.Store(r.Header.Get("If-Range"))
+		}
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(4)
+	d.WithRetries(3, time.Millisecond)
+	if _, err := d.Download(srv.URL + "/file.bin"); !errors.Is(err, ErrFileChanged) {
+		t.Fatalf("got %v, want ErrFileChanged", err)
+	}
+	if got := ifRange.Load(); got != `"v1"` {
+		t.Errorf("the ranges were asked with If-Range %v, want the ETag of the HEAD", got)
+	}
+	if names, _ := filepath.Glob("*"); len(names) != 0 {
+		t.Errorf("left %v behind", names)
+	}
+
+	// Unchanged from then on
+	if _, err := newTestDownloader(4).Download(srv.URL + "/file.bin"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDownloadServerIgnoringRanges(t *testing.T) {
+	data := testContent(100003)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Claims ranges and sends the whole file to every request anyway
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", `"same"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	// Streamed to disk and buffered in memory
+	for _, memory := range []int{0, 1 << 20} {
+		t.Run(strconv.Itoa(memory), func(t *testing.T) {
+			inTempDir(t)
+			d := newTestDownloader(4)
+			d.WithMemoryBuffering(memory)
+			path, err := d.Download(srv.URL + "/file.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+				t.Errorf("got %d bytes, want the %d of the file", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestDownloadAuthorization(t *testing.T) {
+	data := testContent(20000)
+	tests := []struct {
+		name string
+		set  func(d *downloader)
+		want string
+	}{
+		{"basic", func(d *downloader) { d.WithBasicAuth("user", "pass") }, "Basic dXNlcjpwYXNz"},
+		{"bearer", func(d *downloader) { d.WithBearerToken("token") }, "Bearer token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			var requests, wrong atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				if r.Header.Get("Authorization") != tt.want {
+					wrong.Add(1)
+				}
+				http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+			}))
+			defer srv.Close()
+
+			logger := &capturingLogger{}
+			d := newTestDownloader(3)
+			d.WithLogger(logger)
+			tt.set(d)
+			if _, err := d.Download(strings.Replace(srv.URL, "http://", "http://name:secret@", 1) + "/file.bin"); err != nil {
+				t.Fatal(err)
+			}
+			if requests.Load() != 4 || wrong.Load() != 0 {
+				t.Errorf("%d of %d requests didn't carry %q", wrong.Load(), requests.Load(), tt.want)
+			}
+			for _, message := range logger.messages {
+				if strings.Contains(message, "secret") || strings.Contains(message, tt.want) {
+					t.Errorf("credentials logged in %q", message)
+				}
+			}
+		})
+	}
+}
+
+func TestMinChunkSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		length  int
+		workers int
+		want    int
+	}{
+		{"small file", 3000, 5, 1},
+		{"large file", 5 << 20, 5, 5},
+		// A chunk of at least a megabyte each
+		{"more workers than megabytes", 5 << 20, 8, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			srv := serveContent(testContent(tt.length))
+			defer srv.Close()
+
+			result, err := NewDownloader(tt.workers).DownloadWithResult(context.Background(), srv.URL+"/file.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Workers != tt.want || result.Multipart != (tt.want > 1) {
+				t.Errorf("got %d workers, multipart %v, want %d", result.Workers, result.Multipart, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	tests := []struct {
+		name, userAgent, want string
+	}{
+		{"default", "", "multipart-downloader/" + version},
+		{"custom", "ua-test/1", "ua-test/1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			var mu sync.Mutex
+			var seen []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				seen = append(seen, r.Header.Get("User-Agent"))
+				mu.Unlock()
+				http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(testContent(3000)))
+			}))
+			defer srv.Close()
+
+			d := newTestDownloader(3)
+			if tt.userAgent != "" {
+				d.WithUserAgent(tt.userAgent)
+			}
+			if _, err := d.Download(srv.URL + "/file.bin"); err != nil {
+				t.Fatal(err)
+			}
+			// The HEAD and the three ranges
+			if len(seen) != 4 {
+				t.Errorf("got %d requests, want 4", len(seen))
+			}
+			for _, userAgent := range seen {
+				if userAgent != tt.want {
+					t.Errorf("got User-Agent %q, want %q", userAgent, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteChunksChecksAssembly(t *testing.T) {
+	// Three chunks of 10 bytes, broken by change
+	setup := func(change func(d *downloader)) *downloader {
+		d := newTestDownloader(3)
+		d.allocateChunks(3, 30)
+		d.ranges = [][2]int{{0, 9}, {10, 19}, {20, 29}}
+		for i := range d.ranges {
+			d.chunks[i].Write(make([]byte, 10))
+			d.written[i].Store(10)
+		}
+		change(d)
+		return d
+	}
+	tests := []struct {
+		name   string
+		change func(d *downloader)
+		fail   bool
+		// What the failure wraps, if anything in particular.
+		err error
+	}{
+		{"complete", func(d *downloader) {}, false, nil},
+		{"short chunk", func(d *downloader) {
+			d.chunks[1].Truncate(5)
+			d.written[1].Store(5)
+		}, true, ErrSizeMismatch},
+		{"short buffer", func(d *downloader) { d.chunks[1].Truncate(5) }, true, ErrSizeMismatch},
+		{"gap", func(d *downloader) { d.ranges[2][0] = 21 }, true, nil},
+		{"overlap", func(d *downloader) { d.ranges[1][0] = 9 }, true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := setup(tt.change).writeChunks(io.Discard, nil, 0)
+			if tt.fail != (err != nil) {
+				t.Fatalf("got %v", err)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestChunkSizeAndMaxConcurrency(t *testing.T) {
+	data := testContent(1000003)
+	// Streamed to disk and buffered in memory
+	for _, memory := range []int{0, 1 << 30} {
+		t.Run(strconv.Itoa(memory), func(t *testing.T) {
+			inTempDir(t)
+			var gets, peak atomic.Int64
+			srv := peakServer(data, &gets, &peak)
+			defer srv.Close()
+
+			d := NewDownloader(1)
+			d.WithChunkSize(10000)
+			d.WithMaxConcurrency(3)
+			d.WithMemoryBuffering(memory)
+			result, err := d.DownloadWithResult(context.Background(), srv.URL+"/file.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(result.Path); !bytes.Equal(got, data) {
+				t.Fatal("downloaded file doesn't match")
+			}
+			// ceil(1000003 / 10000)
+			if len(d.ranges) != 101 || gets.Load() != 101 {
+				t.Errorf("got %d ranges and %d GETs, want 101", len(d.ranges), gets.Load())
+			}
+			if peak.Load() > 3 || result.Workers != 3 {
+				t.Errorf("%d requests ran at once with %d workers, want at most 3", peak.Load(), result.Workers)
+			}
+		})
+	}
+}
+
+func TestManySmallRangesWithFewWorkers(t *testing.T) {
+	inTempDir(t)
+	data := testContent(2 << 20)
+	var gets, peak atomic.Int64
+	srv := peakServer(data, &gets, &peak)
+	defer srv.Close()
+
+	d := NewDownloader(2)
+	d.WithChunkSize(4096)
+	d.WithMemoryBuffering(0)
+	result, err := d.DownloadWithResult(context.Background(), srv.URL+"/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(result.Path); !bytes.Equal(got, data) {
+		t.Fatal("downloaded file doesn't match")
+	}
+	if len(d.ranges) != 512 || gets.Load() != 512 {
+		t.Errorf("got %d ranges and %d GETs, want 512", len(d.ranges), gets.Load())
+	}
+	if peak.Load() > 2 || result.Workers != 2 {
+		t.Errorf("%d requests ran at once with %d workers, want at most 2", peak.Load(), result.Workers)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	dir := t.TempDir()
+	srv := serveContent(testContent(100000))
+	defer srv.Close()
+
+	stdout, stderr, code := runCommand(t, dir, nil, "download", "--quiet", "-w", "4", srv.URL+"/file.bin")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+	if want := filepath.Join(dir, "file.bin") + "\n"; stdout != want {
+		t.Errorf("got %q on stdout, want only %q", stdout, want)
+	}
+	if stderr != "" {
+		t.Errorf("got %q on stderr", stderr)
+	}
+}
+
+func TestReuse(t *testing.T) {
+	inTempDir(t)
+	d := newTestDownloader(3)
+	d.WithProgress(true, 5)
+	// Smaller and bigger than the one before, down to fewer bytes than workers
+	for i, size := range []int{3000, 10, 20000} {
+		data := testContent(size)
+		srv := serveContent(data)
+		progress := d.ConsumeProgress()
+		last := make(chan int)
+		go func() {
+			var p int
+			for p = range progress {
+			}
+			last <- p
+		}()
+
+		d.WithOutput(fmt.Sprintf("file%d.bin", i))
+		path, err := d.Download(srv.URL + "/file.bin")
+		srv.Close()
+		if err != nil {
+			t.Fatalf("download %d: %v", i, err)
+		}
+		if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+			t.Errorf("download %d doesn't match", i)
+		}
+		if p := <-last; p != 100 {
+			t.Errorf("the progress of download %d ended at %d", i, p)
+		}
+	}
+}
+
+func TestReuseConcurrently(t *testing.T) {
+	inTempDir(t)
+	srv := stallingServer(testContent(100), 5*time.Second)
+	defer srv.Close()
+
+	d := newTestDownloader(1)
+	defer d.Close()
+	go d.Download(srv.URL + "/file.bin")
+	waitFor(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.cancel != nil
+	})
+	if _, err := d.Download(srv.URL + "/other.bin"); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("got %v, want the second download refused", err)
+	}
+}
+
+func TestRangeDetailsContentType(t *testing.T) {
+	data := testContent(1000)
+	tests := []struct {
+		name string
+		// Whether the server refuses HEAD, so the details come from the ranged GET probe
+		noHead bool
+	}{
+		{"head", false},
+		{"probe", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.noHead && r.Method == http.MethodHead {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+				w.Header().Set("ETag", `"v1"`)
+				http.ServeContent(w, r, "file.csv", time.Time{}, bytes.NewReader(data))
+			}))
+			defer srv.Close()
+
+			details, err := NewDownloader(1).getRangeDetails(context.Background(), srv.URL+"/file.csv")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if details.contentType != "text/csv; charset=utf-8" || details.etag != `"v1"` {
+				t.Errorf("got the type %q and ETag %q", details.contentType, details.etag)
+			}
+			if !details.supported || details.length != len(data) {
+				t.Errorf("got %+v", details)
+			}
+		})
+	}
+}
+
+func TestRangeDetailsAuthorization(t *testing.T) {
+	data := testContent(5000)
+	var heads atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "pass" || r.Header.Get("X-Key") != "value" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	if _, err := NewDownloader(1).getRangeDetails(context.Background(), srv.URL+"/file.bin"); err == nil {
+		t.Fatal("got the details without credentials")
+	}
+
+	d := newTestDownloader(3)
+	d.WithBasicAuth("user", "pass")
+	d.WithHeader("X-Key", "value")
+	details, err := d.getRangeDetails(context.Background(), srv.URL+"/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Answered by the HEAD itself, not the ranged GET tried after a refused one
+	if heads.Load() != 1 || !details.supported || details.length != len(data) {
+		t.Errorf("got %+v after %d HEADs", details, heads.Load())
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	data := testContent(100000)
+	srv := serveContent(data)
+	defer srv.Close()
+	// Says it takes ranges and then sends the whole file to every one of them
+	ignoring := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			return
+		}
+		w.Write(data)
+	}))
+	defer ignoring.Close()
+
+	tests := []struct {
+		name       string
+		url        string
+		start, end int64
+		workers    int
+	}{
+		{"first byte", srv.URL, 0, 0, 1},
+		{"split", srv.URL, 10, 20, 4},
+		{"to the end", srv.URL, 5000, 99999, 4},
+		{"last byte", srv.URL, 99999, 99999, 2},
+		{"whole file", srv.URL, 0, 99999, 3},
+		{"single worker", srv.URL, 123, 60000, 1},
+		{"ranges ignored", ignoring.URL, 500, 9000, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := newTestDownloader(tt.workers).DownloadRange(context.Background(), tt.url+"/file.bin", tt.start, tt.end, &buf); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), data[tt.start:tt.end+1]) {
+				t.Errorf("got %d bytes that don't match %d-%d", buf.Len(), tt.start, tt.end)
+			}
+		})
+	}
+}
+
+func TestDownloadRangeInvalid(t *testing.T) {
+	data := testContent(100000)
+	srv := serveContent(data)
+	defer srv.Close()
+	noRanges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer noRanges.Close()
+
+	tests := []struct {
+		name       string
+		url        string
+		start, end int64
+		want       error
+	}{
+		{"past the end", srv.URL, 10, 100000, nil},
+		{"backwards", srv.URL, 10, 5, nil},
+		{"negative", srv.URL, -1, 5, nil},
+		{"no ranges", noRanges.URL, 0, 5, ErrRangeNotSupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := newTestDownloader(2).DownloadRange(context.Background(), tt.url+"/file.bin", tt.start, tt.end, &buf)
+			if err == nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want it refused", err)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("wrote %d bytes", buf.Len())
+			}
+		})
+	}
+}
+
+func TestDownloadMisalignedContentRange(t *testing.T) {
+	data := testContent(4000)
+	tests := []struct {
+		name string
+		// Changes the range the server answers the first ranged GET with, and the total it tells
+		misalign func(start, end, total int) (int, int, int)
+		// The download is retried, unless the file seems to have changed
+		want error
+	}{
+		{"shifted", func(start, end, total int) (int, int, int) {
+			if end+1 < total {
+				return start + 1, end + 1, total
+			}
+			return start - 1, end - 1, total
+		}, nil},
+		{"clamped", func(start, end, total int) (int, int, int) { return start, end - 1, total }, nil},
+		{"other total", func(start, end, total int) (int, int, int) { return start, end, total + 1 }, ErrFileChanged},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			var misaligned atomic.Bool
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var start, end int
+				if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil && end > 0 && misaligned.CompareAndSwap(false, true) {
+					start, end, total := tt.misalign(start, end, len(data))
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+					w.WriteHeader(http.StatusPartialContent)
+					w.Write(data[start : end+1])
+					return
+				}
+				http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+			}))
+			defer srv.Close()
+
+			d := newTestDownloader(4)
+			d.WithRetries(2, time.Millisecond)
+			path, err := d.Download(srv.URL + "/file.bin")
+			if !misaligned.Load() {
+				t.Fatal("the server never misaligned a range, the test doesn't test anything")
+			}
+			if tt.want != nil {
+				if !errors.Is(err, tt.want) {
+					t.Fatalf("got %v, want %v", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+				t.Fatal("a misaligned range was written")
+			}
+		})
+	}
+}
+
+func TestDownloadZeroLength(t *testing.T) {
+	var gets atomic.Int64
+	srv := getCountingServer(nil, &gets)
+	defer srv.Close()
+
+	for _, workers := range []int{1, 4} {
+		// Streamed to disk and buffered in memory
+		for _, memory := range []int{0, 1 << 20} {
+			t.Run(fmt.Sprintf("%d/%d", workers, memory), func(t *testing.T) {
+				inTempDir(t)
+				gets.Store(0)
+				d := newTestDownloader(workers)
+				d.WithMemoryBuffering(memory)
+				d.WithProgress(true, 1)
+				var last Progress
+				d.WithProgressCallback(func(p Progress) { last = p })
+				result, err := d.DownloadWithResult(context.Background(), srv.URL+"/empty.bin")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info, err := os.Stat(result.Path); err != nil || info.Size() != 0 {
+					t.Fatalf("got %v, want an empty file", err)
+				}
+				if names, _ := filepath.Glob("*"); len(names) != 1 {
+					t.Errorf("left %v", names)
+				}
+				if last.Percent() != 100 || gets.Load() != 0 {
+					t.Errorf("ended at %d%% after %d GETs, want 100%% with nothing to get", last.Percent(), gets.Load())
+				}
+			})
+		}
+	}
+}
+
+func TestDownloadZeroLengthToWriter(t *testing.T) {
+	srv := serveContent(nil)
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	if err := newTestDownloader(3).DownloadToWriter(context.Background(), srv.URL+"/empty.bin", &buf); err != nil || buf.Len() != 0 {
+		t.Errorf("got %d bytes, %v", buf.Len(), err)
+	}
+	// The checksum of nothing is still checked
+	d := newTestDownloader(3)
+	d.WithChecksum("sha256", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	if _, err := d.DownloadBytes(context.Background(), srv.URL+"/empty.bin"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Returned when a file doesn't fit in the limit set by WithMaxInMemorySize.
+var ErrTooLarge = errors.New("file is too large to hold in memory")
+
+// Makes DownloadBytes and DownloadToWriter fail with ErrTooLarge on files bigger than max bytes, 0 means no limit.
+// A file of unknown size is stopped as soon as it goes over max.
+func (d *downloader) WithMaxInMemorySize(max int) {
+	d.maxInMemorySize = max
+}
+
+// Downloads the file like DownloadToWriter and returns its content, nothing is written to the file system.
+func (d *downloader) DownloadBytes(ctx context.Context, url string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := d.DownloadToWriter(ctx, url, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Fails a write to an in-memory chunk that would take the whole download over limit bytes.
+type memoryLimitWriter struct {
+	w     io.Writer
+	d     *downloader
+	limit int
+}
+
+func (m *memoryLimitWriter) Write(p []byte) (int, error) {
+	if total := m.d.downloadedBytes() + int64(len(p)); total > int64(m.limit) {
+		return 0, fmt.Errorf("%w: over %d bytes", ErrTooLarge, m.limit)
+	}
+	return m.w.Write(p)
+}
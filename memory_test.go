@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDownloadBytes(t *testing.T) {
+	inTempDir(t)
+	data := testContent(70000)
+	srv := serveContent(data)
+	defer srv.Close()
+
+	// The single and the multipart path
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprint(workers), func(t *testing.T) {
+			got, err := newTestDownloader(workers).DownloadBytes(context.Background(), srv.URL+"/file.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("downloaded bytes don't match")
+			}
+
+			d := newTestDownloader(workers)
+			d.WithMaxInMemorySize(1000)
+			if _, err := d.DownloadBytes(context.Background(), srv.URL+"/file.bin"); !errors.Is(err, ErrTooLarge) {
+				t.Errorf("got %v, want ErrTooLarge", err)
+			}
+		})
+	}
+	if names, _ := filepath.Glob("*"); len(names) != 0 {
+		t.Errorf("wrote %v", names)
+	}
+}
+
+func TestDownloadBytesTooLargeUnknownSize(t *testing.T) {
+	data := testContent(70000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Transfer-Encoding", "chunked")
+			return
+		}
+		for i := 0; i < len(data); i += 10000 {
+			w.Write(data[i : i+10000])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(4)
+	d.WithMaxInMemorySize(30000)
+	// Going over the limit isn't worth a retry
+	d.WithRetries(3, time.Second)
+	start := time.Now()
+	if _, err := d.DownloadBytes(context.Background(), srv.URL+"/file.bin"); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v, want ErrTooLarge", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("took %s", elapsed)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// Downloads the same file from any of urls, the file is named after the first one.
+// Mirrors agreeing on its size and ETag (or Last-Modified) share the chunks between them,
+// and a chunk failing on one mirror after its retries moves on to the next.
+func (d *downloader) DownloadFromMirrors(ctx context.Context, urls []string) (string, error) {
+	if len(urls) == 0 {
+		return "", errors.New("no mirrors to download from")
+	}
+	result, err := d.download(ctx, urls, nil)
+	return result.Path, err
+}
+
+// Asks every mirror about the file, the first one answering decides what the others have to agree with.
+// It returns the final URLs of the mirrors that do, mirrors that fail or disagree are left out.
+func (d *downloader) mirrorDetails(ctx context.Context, urls []string) (rangeDetails, []string, error) {
+	var details rangeDetails
+	var usable []string
+	var errs []error
+	for _, url := range urls {
+		mirror, err := d.getRangeDetails(ctx, url)
+		// Asking the other mirrors wouldn't change the answer
+		if errors.Is(err, ErrNotModified) {
+			return rangeDetails{}, nil, err
+		}
+		if err != nil {
+			if len(urls) > 1 {
+				d.logger.Errorf("mirror %s failed: %v", redactURL(url), err)
+			}
+			errs = append(errs, err)
+			continue
+		}
+
+		if len(usable) == 0 {
+			details = mirror
+		} else if mirror.length != details.length || mirror.validator() != details.validator() {
+			d.logger.Infof("mirror %s serves another version of the file, skipping it", redactURL(url))
+			continue
+		}
+		// Splitting the file needs every mirror to support ranges
+		details.supported = details.supported && mirror.supported
+		usable = append(usable, mirror.finalURL)
+	}
+
+	if len(usable) == 0 {
+		return rangeDetails{}, nil, errors.Join(errs...)
+	}
+	return details, usable, nil
+}
+
+// Runs attempt with the retries against urls[start], then moves on to the following mirrors in turn
+// until one of them succeeds, start is the index of the chunk too.
+func (d *downloader) retryMirrors(ctx context.Context, name string, urls []string, start int, attempt func(url string) error) error {
+	var err error
+	for i := range urls {
+		url := urls[(start+i)%len(urls)]
+		err = d.retry(ctx, start, name, func() error {
+			return attempt(url)
+		})
+		if err == nil || permanent(err) || ctx.Err() != nil {
+			return err
+		}
+		if i < len(urls)-1 {
+			d.logger.Errorf("%s failed on %s, moving to the next mirror: %v", name, redactURL(url), err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Serves data with etag, counting its GETs and failing them with a 500 if fail is set.
+func mirrorServer(data []byte, etag string, fail bool, gets *atomic.Int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+			if fail {
+				http.Error(w, "mirror is down", http.StatusInternalServerError)
+				return
+			}
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+}
+
+func TestDownloadFromMirrors(t *testing.T) {
+	inTempDir(t)
+	data := testContent(4 << 20)
+	var gets [3]atomic.Int64
+	healthy := mirrorServer(data, `"v1"`, false, &gets[0])
+	defer healthy.Close()
+	broken := mirrorServer(data, `"v1"`, true, &gets[1])
+	defer broken.Close()
+	other := mirrorServer(data, `"v1"`, false, &gets[2])
+	defer other.Close()
+
+	d := NewDownloader(4)
+	path, err := d.DownloadFromMirrors(context.Background(), []string{healthy.URL + "/file.bin", broken.URL + "/file.bin", other.URL + "/file.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatal("downloaded file doesn't match")
+	}
+	// The chunks of the broken mirror moved on to the others
+	for i := range gets {
+		if gets[i].Load() == 0 {
+			t.Errorf("mirror %d got no chunk", i)
+		}
+	}
+}
+
+func TestDownloadFromMirrorsSkipsOtherVersions(t *testing.T) {
+	inTempDir(t)
+	data := testContent(4 << 20)
+	var gets, otherGets atomic.Int64
+	mirror := mirrorServer(data, `"v1"`, false, &gets)
+	defer mirror.Close()
+	other := mirrorServer(testContent(4<<20+1), `"v2"`, false, &otherGets)
+	defer other.Close()
+
+	logger := &capturingLogger{}
+	d := NewDownloader(4)
+	d.WithLogger(logger)
+	path, err := d.DownloadFromMirrors(context.Background(), []string{mirror.URL + "/file.bin", other.URL + "/file.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatal("downloaded file doesn't match")
+	}
+	if otherGets.Load() != 0 {
+		t.Errorf("the mirror of another version got %d GETs", otherGets.Load())
+	}
+	if !logger.logged("INFO", "mirror "+other.URL+"/file.bin serves another version") {
+		t.Errorf("skipping the mirror isn't logged in %q", logger.messages)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+// Hears about the key events of every download, for metrics or tracing, the default one ignores them.
+// The chunk and retry calls come from the workers at the same time, so they must be safe for concurrent use
+// and return quickly. A download that isn't split has a single chunk, at index 0.
+type Observer interface {
+	// The file at url is about to be downloaded, size is -1 when the server didn't tell.
+	OnStart(url string, size int64)
+	// Chunk index, covering the inclusive range from start to end, is starting, end is -1 when the size is unknown.
+	OnChunkStart(index, start, end int)
+	// Chunk index is done, with bytes of it received across all of its attempts, err is nil when it's complete.
+	OnChunkDone(index int, bytes int64, err error)
+	// Chunk index failed with err and is about to be tried again, attempt counts the retries from 1.
+	OnRetry(index, attempt int, err error)
+	// The download is over, err is nil when it succeeded. Path is empty for DownloadToWriter.
+	OnComplete(result DownloadResult, err error)
+}
+
+func (d *downloader) WithObserver(o Observer) {
+	d.observer = o
+}
+
+type noopObserver struct{}
+
+func (noopObserver) OnStart(string, int64)            {}
+func (noopObserver) OnChunkStart(int, int, int)       {}
+func (noopObserver) OnChunkDone(int, int64, error)    {}
+func (noopObserver) OnRetry(int, int, error)          {}
+func (noopObserver) OnComplete(DownloadResult, error) {}
+
+// Runs download for chunk index, telling the observer when it starts and how it ended.
+func (d *downloader) observeChunk(index int, download func() error) error {
+	d.observer.OnChunkStart(index, d.ranges[index][0], d.ranges[index][1])
+	err := download()
+	d.observer.OnChunkDone(index, d.written[index].Load(), err)
+	return err
+}
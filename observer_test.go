@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records the calls it gets, in order.
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+	bytes  int64
+	result DownloadResult
+}
+
+func (o *recordingObserver) record(format string, args ...any) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+}
+
+func (o *recordingObserver) OnStart(url string, size int64) {
+	o.record("start %d", size)
+}
+
+func (o *recordingObserver) OnChunkStart(index, start, end int) {
+	o.record("chunk %d start %d-%d", index, start, end)
+}
+
+func (o *recordingObserver) OnChunkDone(index int, bytes int64, err error) {
+	o.mu.Lock()
+	o.bytes += bytes
+	o.mu.Unlock()
+	o.record("chunk %d done %v", index, err)
+}
+
+func (o *recordingObserver) OnRetry(index, attempt int, err error) {
+	o.record("chunk %d retry %d", index, attempt)
+}
+
+func (o *recordingObserver) OnComplete(result DownloadResult, err error) {
+	o.mu.Lock()
+	o.result = result
+	o.mu.Unlock()
+	o.record("complete %v", err)
+}
+
+// Returns the events of chunk index, without its prefix.
+func (o *recordingObserver) chunkEvents(index int) []string {
+	prefix := fmt.Sprintf("chunk %d ", index)
+	var events []string
+	for _, e := range o.events {
+		if strings.HasPrefix(e, prefix) {
+			events = append(events, strings.TrimPrefix(e, prefix))
+		}
+	}
+	return events
+}
+
+func TestObserver(t *testing.T) {
+	inTempDir(t)
+	data := testContent(5000)
+	// The first GET fails, whichever chunk it is
+	s := &flakyServer{data: data, failures: 1}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	o := &recordingObserver{}
+	d := newTestDownloader(2)
+	d.WithRetries(1, time.Millisecond)
+	d.WithObserver(o)
+	result, err := d.DownloadWithResult(context.Background(), srv.URL+"/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(o.events) != 7 || o.events[0] != "start 5000" || o.events[6] != "complete <nil>" {
+		t.Fatalf("got %q, want the start, 2 chunks with a retry and the completion", o.events)
+	}
+	retried := 0
+	for i, r := range [][2]int{{0, 2499}, {2500, 4999}} {
+		events := o.chunkEvents(i)
+		if len(events) == 3 && events[1] == "retry 1" {
+			retried++
+			events = append(events[:1], events[2:]...)
+		}
+		if want := []string{fmt.Sprintf("start %d-%d", r[0], r[1]), "done <nil>"}; strings.Join(events, ",") != strings.Join(want, ",") {
+			t.Errorf("chunk %d got %q, want %q", i, events, want)
+		}
+	}
+	if retried != 1 {
+		t.Errorf("got %d retried chunks, want 1 in %q", retried, o.events)
+	}
+	if o.bytes != int64(len(data)) || o.result.Path != result.Path || o.result.Size != int64(len(data)) {
+		t.Errorf("got %d bytes and %+v", o.bytes, o.result)
+	}
+}
+
+func TestObserverDownloadToWriter(t *testing.T) {
+	srv := serveContent(testContent(5000))
+	defer srv.Close()
+
+	o := &recordingObserver{}
+	d := newTestDownloader(3)
+	d.WithObserver(o)
+	var buf bytes.Buffer
+	if err := d.DownloadToWriter(context.Background(), srv.URL+"/file.bin", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.events) != 8 || o.result.Size != 5000 || o.result.Path != "" {
+		t.Errorf("got %q and %+v", o.events, o.result)
+	}
+}
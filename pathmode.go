@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// How the path of a file under the output directory is derived from its URL.
+type PathMode int
+
+const (
+	// Save the file right in the output directory under its name, it's the default.
+	PathModeFlat PathMode = iota
+	// Recreate the host and directories of the URL under the output directory,
+	// https://example.com/a/b/file.zip becoming example.com/a/b/file.zip.
+	PathModePreserve
+)
+
+// Sets how the path of the file is derived from its URL, the missing directories of a preserved path
+// are always created while the output directory itself still needs WithCreateDirs. It has no effect
+// when WithOutput is given a file path.
+func (d *downloader) WithPathMode(mode PathMode) {
+	d.pathMode = mode
+}
+
+// Returns the directories the file of fileURL goes in with PathModePreserve, its host followed
+// by the directories of its path, each made safe like a file name. It's empty in flat mode.
+func (d *downloader) urlDirs(fileURL string) string {
+	if d.pathMode != PathModePreserve {
+		return ""
+	}
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return ""
+	}
+
+	var dirs []string
+	for _, segment := range append([]string{u.Hostname()}, strings.Split(path.Dir(u.EscapedPath()), "/")...) {
+		if unescaped, err := url.PathUnescape(segment); err == nil {
+			segment = unescaped
+		}
+		// Also drops the . and .. that could climb out of the output directory
+		if segment = cleanFileName(segment); segment == "" {
+			continue
+		}
+		if d.usesPortableNames() {
+			segment = portableFileName(segment)
+		}
+		dirs = append(dirs, segment)
+	}
+	return filepath.Join(dirs...)
+}
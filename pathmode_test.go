@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathMode(t *testing.T) {
+	srv := serveContent(testContent(3000))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	host := u.Hostname()
+
+	tests := []struct {
+		name string
+		mode PathMode
+		path string
+		want string
+	}{
+		{"flat", PathModeFlat, "/a/b%20c/file.zip?q=1", filepath.Join("out", "file.zip")},
+		{"preserve", PathModePreserve, "/a/b%20c/file.zip", filepath.Join("out", host, "a", "b c", "file.zip")},
+		{"dot segments", PathModePreserve, "/a/b/../x/file.zip", filepath.Join("out", host, "a", "x", "file.zip")},
+		// Escaped so the client leaves them in, they still can't climb out of the output directory
+		{"escaped dot segments", PathModePreserve, "/%2e%2e/%2e%2e/evil.zip", filepath.Join("out", host, "evil.zip")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			d := newTestDownloader(2)
+			d.WithOutput("out/")
+			d.WithCreateDirs(true)
+			d.WithPathMode(tt.mode)
+			result, err := d.DownloadWithResult(context.Background(), srv.URL+tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Path != tt.want {
+				t.Errorf("saved to %s, want %s", result.Path, tt.want)
+			}
+			if _, err := os.Stat(tt.want); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestPathModeDownloadAll(t *testing.T) {
+	inTempDir(t)
+	srv := serveContent(testContent(3000))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	d := newTestDownloader(1)
+	d.WithCreateDirs(true)
+	d.WithPathMode(PathModePreserve)
+	urls := []string{srv.URL + "/m/file.bin", srv.URL + "/n/file.bin", srv.URL + "/m/file.bin"}
+	results, err := d.DownloadAll(context.Background(), urls, DownloadAllOptions{Dir: "batch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same name in different directories doesn't collide, the same URL twice still gets a name of its own
+	for i, want := range []string{"m", "n"} {
+		if filepath.Dir(results[i].Path) != filepath.Join("batch", u.Hostname(), want) {
+			t.Errorf("saved %s to %s", urls[i], results[i].Path)
+		}
+	}
+	if results[0].Path == results[2].Path {
+		t.Errorf("both downloads of %s saved to %s", urls[0], results[0].Path)
+	}
+}
+
+func TestPreservePathCommand(t *testing.T) {
+	dir := t.TempDir()
+	srv := serveContent(testContent(3000))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	if _, stderr, code := runCommand(t, dir, nil, "download", "-p=false", "--preserve-path", srv.URL+"/p/q/file.bin"); code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, u.Hostname(), "p", "q", "file.bin")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// What Download would do with a URL, as Plan finds out without downloading it.
+type DownloadPlan struct {
+	// Where the redirects, if any, led to
+	FinalURL string
+	// -1 when the server didn't tell the size
+	ContentLength int64
+	// Whether the file would be fetched in several ranges at once
+	Multipart bool
+	// How many of the ranges would be downloaded at once
+	Workers int
+	// Inclusive byte ranges of the chunks, a single one ending at -1 when the size is unknown
+	Ranges [][2]int
+	// Where the file would be saved
+	Path string
+}
+
+// Works out how the file at url would be downloaded with the current options, asking the server
+// about it like Download does but neither fetching it nor creating anything on disk.
+func (d *downloader) Plan(ctx context.Context, url string) (DownloadPlan, error) {
+	d.logger.Infof("planning the download of %s", redactURL(url))
+	ctx, cancel := d.downloadContext(ctx)
+	defer cancel()
+
+	untrack, err := d.track(cancel)
+	if err != nil {
+		return DownloadPlan{}, err
+	}
+	defer untrack()
+
+	details, err := d.getRangeDetails(ctx, url)
+	if err != nil {
+		return DownloadPlan{}, err
+	}
+
+	workersCount := d.effectiveWorkersCount(details.length)
+	multiple := details.supported && workersCount > 1
+	if !multiple {
+		workersCount = 1
+	}
+	ranges := d.planRanges(workersCount, details.length)
+
+	filePath, _, err := d.resolveOutput(d.saveName(url, details))
+	if err != nil {
+		return DownloadPlan{}, err
+	}
+
+	return DownloadPlan{
+		FinalURL:      details.finalURL,
+		ContentLength: int64(details.length),
+		Multipart:     multiple,
+		Workers:       d.concurrency(len(ranges)),
+		Ranges:        ranges,
+		Path:          filePath,
+	}, nil
+}
+
+// Prints the plan of link for --dry-run, prefix is printed before each line.
+func printPlan(ctx context.Context, d *downloader, link, prefix string) error {
+	plan, err := d.Plan(ctx, link)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%sURL:\t%s\n", prefix, redactURL(plan.FinalURL))
+	fmt.Fprintf(w, "%sSize:\t%s\n", prefix, describeSize(plan.ContentLength))
+	fmt.Fprintf(w, "%sMultipart:\t%s\n", prefix, yesNo(plan.Multipart))
+	fmt.Fprintf(w, "%sWorkers:\t%d\n", prefix, plan.Workers)
+	fmt.Fprintf(w, "%sRanges:\t%d\n", prefix, len(plan.Ranges))
+	for _, r := range plan.Ranges {
+		if r[1] < 0 {
+			fmt.Fprintf(w, "%s\t%d-\n", prefix, r[0])
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d-%d\n", prefix, r[0], r[1])
+	}
+	fmt.Fprintf(w, "%sPath:\t%s\n", prefix, plan.Path)
+	return w.Flush()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPlan(t *testing.T) {
+	data := testContent(1000)
+	var gets atomic.Int64
+	mux := http.NewServeMux()
+	mux.Handle("/old.bin", http.RedirectHandler("/file.bin", http.StatusFound))
+	mux.HandleFunc("/file.bin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	})
+	mux.HandleFunc("/stream.bin", func(w http.ResponseWriter, r *http.Request) {
+		// Flushed before the end, so neither the size nor ranges are known
+		w.Write(data[:10])
+		w.(http.Flusher).Flush()
+		w.Write(data[10:])
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		path string
+		want DownloadPlan
+	}{
+		{"multipart", "/old.bin", DownloadPlan{
+			FinalURL:      srv.URL + "/file.bin",
+			ContentLength: 1000,
+			Multipart:     true,
+			Workers:       4,
+			Ranges:        [][2]int{{0, 249}, {250, 499}, {500, 749}, {750, 999}},
+			// Named after the URL asked for, like Download does
+			Path: "old.bin",
+		}},
+		{"unknown size", "/stream.bin", DownloadPlan{
+			FinalURL:      srv.URL + "/stream.bin",
+			ContentLength: -1,
+			Workers:       1,
+			Ranges:        [][2]int{{0, -1}},
+			Path:          "stream.bin",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			gets.Store(0)
+			plan, err := newTestDownloader(4).Plan(context.Background(), srv.URL+tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plan.Path = filepath.Base(plan.Path)
+			if !reflect.DeepEqual(plan, tt.want) {
+				t.Errorf("got %+v, want %+v", plan, tt.want)
+			}
+			if entries, _ := os.ReadDir("."); len(entries) != 0 || gets.Load() != 0 {
+				t.Errorf("planning created %d files and sent %d GETs", len(entries), gets.Load())
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(testContent(1000)))
+	}))
+	defer srv.Close()
+
+	stdout, stderr, code := runCommand(t, dir, nil, "download", "--dry-run", "-w", "2", "--min-chunk-size", "0", srv.URL+"/file.bin")
+	if code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+	// The columns are padded to line up, only the words are compared
+	got := strings.Join(strings.Fields(stdout), " ")
+	want := "Multipart: yes Workers: 2 Ranges: 2 0-499 500-999 Path: " + filepath.Join(dir, "file.bin")
+	if !strings.Contains(got, want) {
+		t.Errorf("got %q, want %q in it", stdout, want)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("the dry run created %d files", len(entries))
+	}
+}
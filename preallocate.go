@@ -0,0 +1,21 @@
+package main
+
+import "os"
+
+// Reserves the whole size of a streamed file on disk before the workers start, which is the default,
+// so it isn't fragmented by writes landing all over it and a full disk fails the download right away.
+// Disabled, the file is only sized up front and its blocks are allocated as the data arrives.
+func (d *downloader) WithPreallocate(enabled bool) {
+	d.preallocate = enabled
+}
+
+// Sizes f to exactly size bytes, reserving its blocks when preallocation is enabled and the platform supports it.
+func (d *downloader) sizeFile(f File, size int64) error {
+	if osFile, ok := f.(*os.File); ok && d.preallocate {
+		if err := allocate(osFile, size); err != nil && err != errPreallocateUnsupported {
+			return err
+		}
+	}
+	// fallocate only ever grows a file, a longer one is still cut down here
+	return f.Truncate(size)
+}
@@ -0,0 +1,25 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var errPreallocateUnsupported = errors.New("preallocation isn't supported")
+
+func allocate(f *os.File, size int64) error {
+	// fallocate refuses an empty length, Truncate handles it
+	if size == 0 {
+		return errPreallocateUnsupported
+	}
+	err := unix.Fallocate(int(f.Fd()), 0, 0, size)
+	// Some filesystems can't do it, they still get the file sized by Truncate
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return errPreallocateUnsupported
+	}
+	return err
+}
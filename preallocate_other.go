@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errPreallocateUnsupported = errors.New("preallocation isn't supported")
+
+func allocate(f *os.File, size int64) error {
+	return errPreallocateUnsupported
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+	data := testContent(3<<20 + 17)
+	srv := serveContent(data)
+	defer srv.Close()
+
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			inTempDir(t)
+			d := newTestDownloader(4)
+			d.WithMemoryBuffering(0)
+			d.WithPreallocate(enabled)
+			path, err := d.Download(srv.URL + "/file.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := os.ReadFile(path)
+			if len(got) != len(data) {
+				t.Fatalf("the file is %d bytes, want %d", len(got), len(data))
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("downloaded file doesn't match")
+			}
+		})
+	}
+}
+
+func TestSizeFile(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			inTempDir(t)
+			// Left over from a bigger file, sizing has to cut it down too
+			if err := os.WriteFile("file.bin", make([]byte, 2<<20), 0644); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.OpenFile("file.bin", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			d := NewDownloader(1)
+			d.WithPreallocate(enabled)
+			if err := d.sizeFile(f, 1<<20+1); err != nil {
+				t.Fatal(err)
+			}
+			if info, _ := f.Stat(); info.Size() != 1<<20+1 {
+				t.Errorf("the file is %d bytes, want %d", info.Size(), 1<<20+1)
+			}
+		})
+	}
+}
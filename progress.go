@@ -0,0 +1,100 @@
+package main
+
+import "time"
+
+// Snapshot of a running download, Speed is in bytes per second and measured over the last progress interval.
+// ETA is zero while the speed is still unknown, and Total is -1 when the server didn't tell the size.
+type Progress struct {
+	Downloaded int64
+	Total      int64
+	Speed      float64
+	ETA        time.Duration
+	// Every chunk in the order of the file, so a UI can draw a segment per chunk, their Downloaded add up to the one above.
+	Chunks []ChunkProgress
+}
+
+// How far a single chunk got, Total is -1 when the size of the file is unknown.
+type ChunkProgress struct {
+	Index      int
+	Downloaded int64
+	Total      int64
+}
+
+// Percentage of the file downloaded so far, or -1 when the total is unknown.
+func (p Progress) Percent() int64 {
+	return int64(percentage(p.Downloaded, p.Total))
+}
+
+// Rounds down once from the byte counts, so the chunks' shares aren't truncated one by one.
+func percentage(downloaded, total int64) int {
+	switch {
+	case total < 0:
+		return -1
+	case total == 0 || downloaded >= total:
+		return 100
+	}
+	return int(downloaded * 100 / total)
+}
+
+// Returns a channel of detailed progress snapshots, closed once Download returns.
+// A snapshot the consumer hasn't read yet is replaced by the newer one rather than queued when it falls behind.
+func (d *downloader) ConsumeProgressDetailed() <-chan Progress {
+	d.detailedRequested.Store(true)
+	_, detailedChan := d.openProgress()
+	return detailedChan
+}
+
+// Calls callback with a snapshot at every progress interval, from the progress goroutine and without any channel.
+// Progress has to be enabled with WithProgress, and callback should return quickly since the next snapshot waits for it.
+func (d *downloader) WithProgressCallback(callback func(Progress)) {
+	d.progressCallback = callback
+}
+
+// Returns the progress channels of the running or next download, the ones a previous download closed
+// are replaced with new ones, unless the downloader itself is closed.
+func (d *downloader) openProgress() (chan int, chan Progress) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.progressClosed && !d.closed {
+		d.progressChan = make(chan int, 1)
+		d.progressDetailedChan = make(chan Progress, 1)
+		d.progressClosed = false
+	}
+	return d.progressChan, d.progressDetailedChan
+}
+
+// Closes both progress channels, only the first call does anything so Close and a finished download can both call it.
+func (d *downloader) closeProgress() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.progressClosed {
+		return
+	}
+	d.progressClosed = true
+	close(d.progressChan)
+	close(d.progressDetailedChan)
+}
+
+// Returns how far each chunk got at this moment.
+func (d *downloader) chunkProgress() []ChunkProgress {
+	chunks := make([]ChunkProgress, len(d.ranges))
+	for i, r := range d.ranges {
+		chunks[i] = ChunkProgress{Index: i, Downloaded: d.written[i].Load(), Total: -1}
+		if r[1] >= 0 {
+			chunks[i].Total = int64(r[1] - r[0] + 1)
+		}
+	}
+	return chunks
+}
+
+// Builds the snapshot for downloaded bytes out of total, given that previous bytes were downloaded elapsed ago.
+func calcProgress(downloaded, total, previous int64, elapsed time.Duration) Progress {
+	p := Progress{Downloaded: downloaded, Total: total}
+	if elapsed > 0 {
+		p.Speed = float64(downloaded-previous) / elapsed.Seconds()
+	}
+	if p.Speed > 0 && total > downloaded {
+		p.ETA = time.Duration(float64(total-downloaded) / p.Speed * float64(time.Second))
+	}
+	return p
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCalcProgress(t *testing.T) {
+	tests := []struct {
+		name                        string
+		downloaded, total, previous int64
+		elapsed                     time.Duration
+		speed                       float64
+		eta                         time.Duration
+	}{
+		{"steady", 3000, 10000, 1000, 2 * time.Second, 1000, 7 * time.Second},
+		{"fast", 6000, 10000, 2000, 500 * time.Millisecond, 8000, 500 * time.Millisecond},
+		{"stalled", 5000, 10000, 5000, time.Second, 0, 0},
+		{"first report", 0, 10, 0, 0, 0, 0},
+		{"done", 10000, 10000, 9000, time.Second, 1000, 0},
+		{"unknown size", 4000, -1, 2000, time.Second, 2000, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := calcProgress(tt.downloaded, tt.total, tt.previous, tt.elapsed)
+			if p.Downloaded != tt.downloaded || p.Total != tt.total {
+				t.Errorf("got %d of %d bytes, want %d of %d", p.Downloaded, p.Total, tt.downloaded, tt.total)
+			}
+			if p.Speed != tt.speed || p.ETA != tt.eta {
+				t.Errorf("got %v B/s and %s left, want %v B/s and %s", p.Speed, p.ETA, tt.speed, tt.eta)
+			}
+		})
+	}
+}
+
+func TestConsumeProgressDetailed(t *testing.T) {
+	inTempDir(t)
+	srv := serveContent(testContent(100000))
+	defer srv.Close()
+
+	d := newTestDownloader(3)
+	d.WithProgress(true, 5)
+	done := make(chan Progress)
+	go func() {
+		var last Progress
+		for p := range d.ConsumeProgressDetailed() {
+			last = p
+		}
+		done <- last
+	}()
+	if _, err := d.Download(srv.URL + "/file.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if last := <-done; last.Downloaded != 100000 || last.Total != 100000 {
+		t.Errorf("the last progress is %d of %d bytes, want all 100000", last.Downloaded, last.Total)
+	}
+}
+
+func TestPercentageOfUnequalChunks(t *testing.T) {
+	tests := []struct {
+		written []int64
+		total   int64
+	}{
+		// Each chunk alone rounds down to 0
+		{[]int64{1, 1, 1}, 100},
+		{[]int64{333, 334, 0}, 1000},
+		{[]int64{999, 1, 0}, 1000},
+		{[]int64{0, 0, 0}, 1000},
+		{[]int64{5000, 17, 250, 3}, 10007},
+		{[]int64{1 << 30, 1 << 29}, 3 << 30},
+	}
+
+	for _, tt := range tests {
+		d := newTestDownloader(len(tt.written))
+		d.allocateChunks(len(tt.written), int(tt.total))
+		var sum int64
+		for i, written := range tt.written {
+			d.written[i].Store(written)
+			sum += written
+		}
+		want := float64(sum) * 100 / float64(tt.total)
+		if got := percentage(d.downloadedBytes(), tt.total); math.Abs(float64(got)-want) > 1 {
+			t.Errorf("%v of %d: got %d%%, want %.2f%%", tt.written, tt.total, got, want)
+		}
+	}
+}
+
+func TestPercentage(t *testing.T) {
+	tests := []struct {
+		downloaded, total int64
+		want              int
+	}{
+		{50, 100, 50},
+		{0, 0, 100},
+		{100, 100, 100},
+		{10, -1, -1},
+	}
+	for _, tt := range tests {
+		if got := percentage(tt.downloaded, tt.total); got != tt.want {
+			t.Errorf("percentage(%d, %d) = %d, want %d", tt.downloaded, tt.total, got, tt.want)
+		}
+	}
+}
+
+func TestProgressCallback(t *testing.T) {
+	inTempDir(t)
+	srv := serveContent(testContent(1 << 20))
+	defer srv.Close()
+
+	d := newTestDownloader(4)
+	d.WithProgress(true, 1)
+	// Slow enough for a few reports
+	d.WithRateLimit(4 << 20)
+	var downloaded []int64
+	d.WithProgressCallback(func(p Progress) { downloaded = append(downloaded, p.Downloaded) })
+	if _, err := d.Download(srv.URL + "/file.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(downloaded) < 2 {
+		t.Fatalf("the callback got %v", downloaded)
+	}
+	for i := 1; i < len(downloaded); i++ {
+		if downloaded[i] < downloaded[i-1] {
+			t.Fatalf("the progress went back in %v", downloaded)
+		}
+	}
+	if last := downloaded[len(downloaded)-1]; last != 1<<20 || last <= downloaded[0] {
+		t.Errorf("the progress went from %d to %d bytes", downloaded[0], last)
+	}
+}
+
+func TestProgressNeverConsumed(t *testing.T) {
+	inTempDir(t)
+	srv := serveContent(testContent(300000))
+	defer srv.Close()
+
+	d := newTestDownloader(3)
+	d.WithProgress(true, 1)
+	// Asked for and never read
+	d.ConsumeProgress()
+	d.ConsumeProgressDetailed()
+	done := make(chan error)
+	go func() {
+		_, err := d.Download(srv.URL + "/file.bin")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the download is held up by the unread progress")
+	}
+}
+
+func TestChunkProgress(t *testing.T) {
+	inTempDir(t)
+	srv := serveContent(testContent(100000))
+	defer srv.Close()
+
+	d := newTestDownloader(4)
+	d.WithProgress(true, 1)
+	d.WithRateLimit(400000)
+	var snapshots []Progress
+	d.WithProgressCallback(func(p Progress) { snapshots = append(snapshots, p) })
+	if _, err := d.Download(srv.URL + "/file.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snapshots) < 2 {
+		t.Fatalf("got %d snapshots", len(snapshots))
+	}
+	for _, p := range snapshots {
+		if len(p.Chunks) != 4 {
+			t.Fatalf("got %d chunks, want 4", len(p.Chunks))
+		}
+		var downloaded, total int64
+		for i, c := range p.Chunks {
+			if c.Index != i || c.Downloaded > c.Total {
+				t.Errorf("got the chunk %+v at %d", c, i)
+			}
+			downloaded += c.Downloaded
+			total += c.Total
+		}
+		if downloaded != p.Downloaded || total != p.Total {
+			t.Errorf("the chunks add up to %d of %d, the download is at %d of %d", downloaded, total, p.Downloaded, p.Total)
+		}
+	}
+}
+
+func TestChunkProgressUnknownSize(t *testing.T) {
+	d := NewDownloader(1)
+	d.ranges = [][2]int{{0, -1}}
+	d.written = make([]atomic.Int64, 1)
+	d.written[0].Store(500)
+	if got := d.chunkProgress(); len(got) != 1 || got[0] != (ChunkProgress{Index: 0, Downloaded: 500, Total: -1}) {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestProgressStopsPromptly(t *testing.T) {
+	d := NewDownloader(1)
+	// Far longer than the test waits
+	d.WithProgress(true, 60000)
+	d.allocateChunks(1, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := d.startProgress(ctx, 10)
+	// Into the first interval
+	time.Sleep(20 * time.Millisecond)
+
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		stop(false)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the progress goroutine waited out its interval after the cancel")
+	}
+}
+
+func TestOffer(t *testing.T) {
+	ch := make(chan int, 1)
+	for i := 1; i <= 3; i++ {
+		offer(ch, i)
+	}
+	if got := <-ch; got != 3 {
+		t.Errorf("got %d, want the latest value 3", got)
+	}
+	select {
+	case v := <-ch:
+		t.Errorf("got %d queued behind the latest value", v)
+	default:
+	}
+}
+
+func TestProgressSlowConsumer(t *testing.T) {
+	data := testContent(5 << 10)
+	var gets atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Later chunks take longer, so there's progress over a few hundred milliseconds
+		if r.Method == http.MethodGet {
+			time.Sleep(time.Duration(gets.Add(1)) * 20 * time.Millisecond)
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(5)
+	d.WithMinChunkSize(1024)
+	d.WithMaxConcurrency(1)
+	d.WithProgress(true, 1)
+	progress := d.ConsumeProgressDetailed()
+	var got []int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for p := range progress {
+			got = append(got, p.Downloaded)
+			// Far slower than the updates every millisecond
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	var buf bytes.Buffer
+	if err := d.DownloadToWriter(context.Background(), srv.URL+"/file.bin", &buf); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if len(got) == 0 || got[len(got)-1] != int64(len(data)) {
+		t.Fatalf("got %v, want it to end with all %d bytes", got, len(data))
+	}
+	// A backlog would have handed over hundreds of old, repeated values
+	if len(got) > 20 {
+		t.Errorf("got %d updates for a consumer reading every 50ms", len(got))
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i] < got[i-1] {
+			t.Errorf("got %v, going backwards", got)
+			break
+		}
+	}
+}
+
+func TestFinalProgress(t *testing.T) {
+	// Not a multiple of the chunks, so the percent of the last update before the end gets truncated
+	data := testContent(10007)
+	srv := serveContent(data)
+	defer srv.Close()
+	unknownSize := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Flushed before the body, so there's no Content-Length
+		w.(http.Flusher).Flush()
+		w.Write(data)
+	}))
+	defer unknownSize.Close()
+
+	tests := []struct {
+		name    string
+		url     string
+		workers int
+		// Whether the checksum fails the download
+		mismatch bool
+	}{
+		{"single", srv.URL, 1, false},
+		{"multipart", srv.URL, 3, false},
+		{"single failed", srv.URL, 1, true},
+		{"multipart failed", srv.URL, 3, true},
+		{"unknown size", unknownSize.URL, 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			d := newTestDownloader(tt.workers)
+			d.WithMinChunkSize(1000)
+			d.WithProgress(true, 1)
+			if tt.mismatch {
+				d.WithChecksum("sha256", strings.Repeat("0", 64))
+			}
+			var got []int
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for p := range d.ConsumeProgress() {
+					got = append(got, p)
+				}
+			}()
+			_, err := d.Download(tt.url + "/file.bin")
+			<-done
+
+			if (err != nil) != tt.mismatch {
+				t.Fatalf("got %v, want a failure %v", err, tt.mismatch)
+			}
+			if len(got) == 0 {
+				t.Fatal("got no progress")
+			}
+			if last := got[len(got)-1]; (last == 100) == tt.mismatch {
+				t.Errorf("the last progress is %d of %v", last, got)
+			}
+			// Only ever the very last one
+			for _, p := range got[:len(got)-1] {
+				if p == 100 {
+					t.Errorf("got 100 before the end in %v", got)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Width of the bar itself, between the brackets.
+const progressBarWidth = 30
+
+// Formats p as a single terminal line starting with a carriage return, so each one replaces the previous.
+// A download of unknown size gets no bar, only what has been downloaded so far.
+func renderProgressBar(p Progress) string {
+	speed := formatBytes(int64(p.Speed)) + "/s"
+	if p.Total < 0 {
+		return fmt.Sprintf("\r%s  %s", formatBytes(p.Downloaded), speed)
+	}
+
+	percent := p.Percent()
+	filled := int(percent) * progressBarWidth / 100
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	if filled > 0 && filled < progressBarWidth {
+		bar = bar[:filled-1] + ">" + bar[filled:]
+	}
+	return fmt.Sprintf("\r[%s] %3d%%  %s / %s  %s", bar, percent, formatBytes(p.Downloaded), formatBytes(p.Total), speed)
+}
+
+// Formats n bytes with binary units, like 1.5 MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	value, prefix := float64(n)/unit, 0
+	for value >= unit && prefix < len("KMGTPE")-1 {
+		value /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTPE"[prefix])
+}
+
+// Reports whether f is a terminal, so a bar written to it gets redrawn in place instead of piling up in a log.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
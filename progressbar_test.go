@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestRenderProgressBar(t *testing.T) {
+	tests := []struct {
+		progress Progress
+		want     string
+	}{
+		{Progress{Downloaded: 5 << 20, Total: 10 << 20, Speed: 1 << 20}, "\r[==============>               ]  50%  5.0 MiB / 10.0 MiB  1.0 MiB/s"},
+		{Progress{Downloaded: 10, Total: 10}, "\r[==============================] 100%  10 B / 10 B  0 B/s"},
+		{Progress{Downloaded: 0, Total: 1000, Speed: 512}, "\r[                              ]   0%  0 B / 1000 B  512 B/s"},
+		// Without a total there's nothing to fill
+		{Progress{Downloaded: 10, Total: -1}, "\r10 B  0 B/s"},
+	}
+	for _, tt := range tests {
+		if got := renderProgressBar(tt.progress); got != tt.want {
+			t.Errorf("renderProgressBar(%+v)\n got %q\nwant %q", tt.progress, got, tt.want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.want {
+			t.Errorf("formatBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "io"
+
+// Writes every byte the workers receive to w as well, for progress bars counting what's written to them.
+// The writes come from all the workers in no particular order, so w only makes sense for counting, never as a copy
+// of the file, and they wait for each other so w doesn't have to be safe for concurrent use. Bytes a chunk
+// starting over receives again are written again, and the encoded ones when the body is decoded.
+func (d *downloader) WithProgressWriter(w io.Writer) {
+	d.progressWriter = w
+}
+
+// Calls callback with the number of bytes of every write of the workers, from all of them at the same time
+// so it must be safe for concurrent use and return quickly, like the Add of a progress bar.
+func (d *downloader) WithBytesCallback(callback func(n int)) {
+	d.bytesCallback = callback
+}
+
+// Returns what the workers call with every write, nil when neither WithProgressWriter nor WithBytesCallback is set.
+func (d *downloader) bytesReporter() func(p []byte) {
+	if d.progressWriter == nil && d.bytesCallback == nil {
+		return nil
+	}
+	return func(p []byte) {
+		if len(p) == 0 {
+			return
+		}
+		if d.bytesCallback != nil {
+			d.bytesCallback(len(p))
+		}
+		if d.progressWriter != nil {
+			d.progressWriterMu.Lock()
+			defer d.progressWriterMu.Unlock()
+			// The download doesn't depend on what a progress bar makes of it
+			d.progressWriter.Write(p)
+		}
+	}
+}
+
+// Writes as many zero bytes to w as the downloads of progress advance by, until progress is closed, like the channel
+// of ConsumeProgressDetailed. It lets an io.Writer progress bar follow the snapshots rather than the workers' writes.
+func WriteProgressTo(w io.Writer, progress <-chan Progress) error {
+	zeros := make([]byte, 32*1024)
+	var last int64
+	for p := range progress {
+		// A bar can't go back, what a chunk starting over lost was counted already
+		for p.Downloaded > last {
+			n, err := w.Write(zeros[:min(p.Downloaded-last, int64(len(zeros)))])
+			last += int64(n)
+			if err != nil {
+				// Draining keeps the download from waiting on a reader that's gone
+				for range progress {
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// Counts what's written to it, like the io.Writer of a progress bar.
+type countingBar struct {
+	written int64
+	// Fails writes after this many bytes if it's above 0
+	failAfter int64
+}
+
+func (b *countingBar) Write(p []byte) (int, error) {
+	if b.failAfter > 0 && b.written+int64(len(p)) > b.failAfter {
+		return 0, errors.New("bar closed")
+	}
+	b.written += int64(len(p))
+	return len(p), nil
+}
+
+func TestProgressWriter(t *testing.T) {
+	// Not a multiple of the chunks
+	data := testContent(3<<20 + 17)
+	srv := serveContent(data)
+	defer srv.Close()
+
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprint(workers), func(t *testing.T) {
+			inTempDir(t)
+			bar := &countingBar{}
+			var counted atomic.Int64
+			d := newTestDownloader(workers)
+			d.WithProgressWriter(bar)
+			d.WithBytesCallback(func(n int) { counted.Add(int64(n)) })
+			if _, err := d.Download(srv.URL + "/file.bin"); err != nil {
+				t.Fatal(err)
+			}
+			if bar.written != int64(len(data)) || counted.Load() != int64(len(data)) {
+				t.Errorf("the bar got %d bytes and the callback %d, want %d", bar.written, counted.Load(), len(data))
+			}
+		})
+	}
+}
+
+func TestWriteProgressTo(t *testing.T) {
+	inTempDir(t)
+	data := testContent(3<<20 + 17)
+	srv := serveContent(data)
+	defer srv.Close()
+
+	d := newTestDownloader(4)
+	d.WithProgress(true, 10)
+	bar := &countingBar{}
+	done := make(chan error)
+	progress := d.ConsumeProgressDetailed()
+	go func() { done <- WriteProgressTo(bar, progress) }()
+	if _, err := d.Download(srv.URL + "/file.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil || bar.written != int64(len(data)) {
+		t.Errorf("got %v, the bar at %d of %d bytes", err, bar.written, len(data))
+	}
+}
+
+func TestWriteProgressToFailingWriter(t *testing.T) {
+	progress := make(chan Progress)
+	done := make(chan error)
+	go func() { done <- WriteProgressTo(&countingBar{failAfter: 100}, progress) }()
+	progress <- Progress{Downloaded: 50}
+	progress <- Progress{Downloaded: 500}
+	// Still read after the failure, so the sender isn't stuck
+	progress <- Progress{Downloaded: 1000}
+	close(progress)
+	if err := <-done; err == nil {
+		t.Error("got no error from the failing writer")
+	}
+}
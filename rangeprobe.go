@@ -0,0 +1,29 @@
+package main
+
+import "context"
+
+// Some servers honor Range requests without sending Accept-Ranges, with this enabled a HEAD response
+// that doesn't mention it is followed by a one byte ranged GET, the download is split if it gets a 206 back.
+// It's off by default as it costs every such download an extra request.
+func (d *downloader) WithAggressiveRangeProbe(enabled bool) {
+	d.aggressiveRangeProbe = enabled
+}
+
+// Asks for the first byte of the file the HEAD request was silent about ranges for,
+// and marks them as supported if the server answered with a range of the same file.
+func (d *downloader) confirmRanges(ctx context.Context, url string, details rangeDetails) rangeDetails {
+	if !d.aggressiveRangeProbe || !details.rangesUnknown || details.length < 0 || isEncoded(details.encoding) {
+		return details
+	}
+
+	probe, err := d.probeDetails(ctx, details.finalURL)
+	if err != nil {
+		d.logger.Debugf("probing %s for ranges failed: %v", redactURL(url), err)
+		return details
+	}
+	if probe.supported && probe.length == details.length {
+		d.logger.Debugf("%s supports ranges without saying so", redactURL(url))
+		details.supported = true
+	}
+	return details
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Drops the Accept-Ranges header http.ServeContent sets, the way some servers leave it out.
+type hiddenRangesWriter struct {
+	http.ResponseWriter
+}
+
+func (w hiddenRangesWriter) WriteHeader(status int) {
+	w.Header().Del("Accept-Ranges")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w hiddenRangesWriter) Write(p []byte) (int, error) {
+	w.Header().Del("Accept-Ranges")
+	return w.ResponseWriter.Write(p)
+}
+
+func TestAggressiveRangeProbe(t *testing.T) {
+	data := testContent(4000)
+	tests := []struct {
+		name  string
+		probe bool
+		// Whether the server honors ranges, it never says whether it does
+		ranges    bool
+		multipart bool
+	}{
+		{"probed", true, true, true},
+		{"not probed", false, true, false},
+		{"probed without ranges", true, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !tt.ranges {
+					w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+					w.Write(data)
+					return
+				}
+				http.ServeContent(hiddenRangesWriter{w}, r, "file.bin", time.Time{}, bytes.NewReader(data))
+			}))
+			defer srv.Close()
+
+			d := newTestDownloader(4)
+			d.WithAggressiveRangeProbe(tt.probe)
+			result, err := d.DownloadWithResult(context.Background(), srv.URL+"/file.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(result.Path); !bytes.Equal(got, data) {
+				t.Fatal("downloaded file doesn't match")
+			}
+			if result.Multipart != tt.multipart {
+				t.Errorf("got multipart %v, want %v", result.Multipart, tt.multipart)
+			}
+		})
+	}
+}
+
+func TestAggressiveRangeProbeRefused(t *testing.T) {
+	for _, header := range []string{"none", "bytes"} {
+		t.Run(header, func(t *testing.T) {
+			inTempDir(t)
+			data := testContent(4000)
+			var gets atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Accept-Ranges", header)
+				if r.Method == http.MethodGet {
+					gets.Add(1)
+				}
+				if header == "none" {
+					w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+					w.Write(data)
+					return
+				}
+				http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+			}))
+			defer srv.Close()
+
+			d := newTestDownloader(4)
+			d.WithAggressiveRangeProbe(true)
+			if _, err := d.Download(srv.URL + "/file.bin"); err != nil {
+				t.Fatal(err)
+			}
+			// Only a server silent about ranges is probed
+			want := map[string]int64{"none": 1, "bytes": 4}[header]
+			if gets.Load() != want {
+				t.Errorf("got %d GETs, want %d", gets.Load(), want)
+			}
+		})
+	}
+}
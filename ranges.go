@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Returned by RetryRanges when it can't carry on with what a download left behind, along with
+// ErrNoPartialFile or ErrRangeNotSupported telling why.
+var ErrNotResumable = errors.New("download can't be resumed")
+
+// Returned when the server can't send parts of the file that ranges had to be asked for.
+var ErrRangeNotSupported = errors.New("ranges not supported")
+
+// Returned by RetryRanges when the download didn't leave a file behind to fetch the ranges into.
+var ErrNoPartialFile = errors.New("no partial file to retry the ranges into, the download has to keep it with WithResume or WithKeepPartialOnError")
+
+// Returned when some ranges of a multipart download didn't complete, Ranges holds the inclusive
+// byte ranges that are still missing. RetryRanges can fetch them on their own when the download kept
+// its partial file with WithResume or WithKeepPartialOnError, otherwise it's removed along with what was fetched.
+type RangesError struct {
+	Ranges [][2]int
+	Err    error
+}
+
+func (e *RangesError) Error() string {
+	return fmt.Sprintf("%d ranges failed: %v", len(e.Ranges), e.Err)
+}
+
+func (e *RangesError) Unwrap() error {
+	return e.Err
+}
+
+// Returns the part of every chunk in indexes that hasn't been written yet.
+func (d *downloader) missingRanges(indexes []int) [][2]int {
+	var missing [][2]int
+	for _, i := range indexes {
+		start := d.ranges[i][0] + int(d.written[i].Load())
+		if start <= d.ranges[i][1] {
+			missing = append(missing, [2]int{start, d.ranges[i][1]})
+		}
+	}
+	return missing
+}
+
+// Fetches only the given inclusive byte ranges of url into the file a download of it left behind,
+// like the Ranges of a RangesError. The partial file kept by WithResume or WithKeepPartialOnError is preferred
+// over a finished one, and it's moved in place once the retried ranges were all that it was missing.
+// It fails with ErrNotResumable and ErrNoPartialFile when there's neither, or ErrRangeNotSupported
+// when the server can't send the ranges.
+// It returns the path of the file that was written into, along with a RangesError when ranges are still missing.
+func (d *downloader) RetryRanges(ctx context.Context, url string, ranges [][2]int) (_ string, err error) {
+	d.logger.Infof("retrying %d ranges of %s", len(ranges), redactURL(url))
+	ctx, finish, err := d.startDownload(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	defer finish(&err)
+
+	details, err := d.getRangeDetails(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	if !details.supported {
+		return "", fmt.Errorf("%s: %w, %w", redactURL(url), ErrNotResumable, ErrRangeNotSupported)
+	}
+	d.ifRange = details.validator()
+	d.contentLength = details.length
+
+	total := 0
+	for _, r := range ranges {
+		if r[0] < 0 || r[1] < r[0] || r[1] >= details.length {
+			return "", fmt.Errorf("range %d-%d is outside of the %d bytes file", r[0], r[1], details.length)
+		}
+		total += r[1] - r[0] + 1
+	}
+
+	filePath, err := d.outputPath(d.saveName(url, details))
+	if err != nil {
+		return "", err
+	}
+
+	target := d.partPath(filePath)
+	file, err := d.fs.OpenFile(target, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		target = filePath
+		file, err = d.fs.OpenFile(target, os.O_RDWR, 0)
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("%s: %w, %w", d.partPath(filePath), ErrNotResumable, ErrNoPartialFile)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	d.tempFile = file
+	d.ranges = ranges
+	d.allocateChunks(len(ranges), total)
+	err = d.runRetriedRanges(ctx, total, details.finalURL)
+	d.tempFile = nil
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if target == filePath {
+		return filePath, nil
+	}
+	return d.finishRetry(filePath, url, details, ranges)
+}
+
+func (d *downloader) runRetriedRanges(ctx context.Context, total int, url string) (err error) {
+	stopProgress := d.startProgress(ctx, total)
+	defer func() { stopProgress(err == nil) }()
+	return d.processMultiple(ctx, []string{url})
+}
+
+// Marks the chunks of the resume state that the retried ranges covered as done, and moves the partial
+// file in place once none of them is missing anything.
+func (d *downloader) finishRetry(filePath, url string, details rangeDetails, retried [][2]int) (string, error) {
+	// Without a resume state there's no telling what else the file is missing
+	if !d.loadResumeState(filePath, url, details) {
+		return d.partPath(filePath), nil
+	}
+
+	var incomplete []int
+	for i, r := range d.ranges {
+		start := r[0] + int(d.written[i].Load())
+		if start > r[1] {
+			continue
+		}
+		if !covered([2]int{start, r[1]}, retried) {
+			incomplete = append(incomplete, i)
+			continue
+		}
+		d.written[i].Store(int64(r[1] - r[0] + 1))
+	}
+
+	if len(incomplete) > 0 {
+		missing := d.missingRanges(incomplete)
+		d.saveResumeState(filePath, url, details)
+		return d.partPath(filePath), &RangesError{Ranges: missing, Err: errors.New("they weren't retried")}
+	}
+	return d.combineChunks(filePath)
+}
+
+// Reports whether one of ranges holds all of r.
+func covered(r [2]int, ranges [][2]int) bool {
+	for _, c := range ranges {
+		if c[0] <= r[0] && r[1] <= c[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryRanges(t *testing.T) {
+	data := testContent(1000)
+	tests := []struct {
+		name string
+		keep func(d *downloader)
+		// Whether the retry finds a partial file to fetch the ranges into.
+		kept bool
+	}{
+		{"resume", func(d *downloader) { d.WithResume(true) }, true},
+		{"keep partial", func(d *downloader) { d.WithKeepPartialOnError(true) }, true},
+		{"default", func(d *downloader) {}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			var fail atomic.Bool
+			fail.Store(true)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if fail.Load() && strings.HasPrefix(r.Header.Get("Range"), "bytes=500-") {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+			}))
+			defer srv.Close()
+
+			d := newTestDownloader(4)
+			tt.keep(d)
+			_, err := d.Download(srv.URL + "/file.bin")
+			var rangesErr *RangesError
+			if !errors.As(err, &rangesErr) || len(rangesErr.Ranges) != 1 || rangesErr.Ranges[0] != [2]int{500, 749} {
+				t.Fatalf("got %v, want the range 500-749 missing", err)
+			}
+
+			fail.Store(false)
+			path, err := newTestDownloader(4).RetryRanges(context.Background(), srv.URL+"/file.bin", rangesErr.Ranges)
+			if !tt.kept {
+				if !errors.Is(err, ErrNoPartialFile) || !errors.Is(err, ErrNotResumable) {
+					t.Fatalf("got %v, want ErrNoPartialFile and ErrNotResumable", err)
+				}
+				return
+			}
+			if err != nil || filepath.Base(path) != "file.bin" {
+				t.Fatalf("got %q, %v", path, err)
+			}
+			if got, _ := os.ReadFile("file.bin"); !bytes.Equal(got, data) {
+				t.Fatal("retried file doesn't match")
+			}
+			for _, name := range []string{"file.bin.part", "file.bin.part.json"} {
+				if _, err := os.Stat(name); err == nil {
+					t.Errorf("%s left behind", name)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryRangesWithoutRangeSupport(t *testing.T) {
+	inTempDir(t)
+	data := testContent(1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer srv.Close()
+	if err := os.WriteFile("file.bin.part", make([]byte, len(data)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := newTestDownloader(4).RetryRanges(context.Background(), srv.URL+"/file.bin", [][2]int{{500, 749}})
+	if !errors.Is(err, ErrRangeNotSupported) || !errors.Is(err, ErrNotResumable) {
+		t.Fatalf("got %v, want ErrRangeNotSupported and ErrNotResumable", err)
+	}
+	// The partial file is kept for when the server can send ranges again
+	if _, err := os.Stat("file.bin.part"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRetryRangesFinishedFile(t *testing.T) {
+	inTempDir(t)
+	data := testContent(1000)
+	srv := serveContent(data)
+	defer srv.Close()
+	if err := os.WriteFile("file.bin", make([]byte, len(data)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := newTestDownloader(2).RetryRanges(context.Background(), srv.URL+"/file.bin", [][2]int{{100, 899}})
+	if err != nil || filepath.Base(path) != "file.bin" {
+		t.Fatalf("got %q, %v", path, err)
+	}
+	got, _ := os.ReadFile("file.bin")
+	want := append(make([]byte, 100), data[100:900]...)
+	if !bytes.Equal(got, append(want, make([]byte, 100)...)) {
+		t.Fatal("only the retried ranges should be rewritten")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// Caps the download speed to bytesPerSecond, shared by all the workers of the downloader, 0 removes the limit.
+func (d *downloader) WithRateLimit(bytesPerSecond int) {
+	if bytesPerSecond <= 0 {
+		d.limiter = nil
+		return
+	}
+	d.limiter = rate.NewLimiter(rate.Limit(bytesPerSecond), bytesPerSecond)
+}
+
+// Wraps a response body so reading from it respects the rate limit, if there is one.
+func (d *downloader) limitReader(ctx context.Context, r io.Reader) io.Reader {
+	if d.limiter == nil {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, limiter: d.limiter}
+}
+
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (rl *rateLimitedReader) Read(p []byte) (int, error) {
+	// Never ask for more tokens than the bucket can hold
+	if len(p) > rl.limiter.Burst() {
+		p = p[:rl.limiter.Burst()]
+	}
+
+	n, err := rl.r.Read(p)
+	if n > 0 {
+		if waitErr := rl.limiter.WaitN(rl.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// Parses sizes like 500, 500k or 2M, the suffixes are powers of 1024.
+func parseByteSize(value string) (int, error) {
+	multiplier := 1
+	number := strings.TrimSpace(value)
+	if number != "" {
+		switch strings.ToLower(number[len(number)-1:]) {
+		case "k":
+			multiplier = 1 << 10
+		case "m":
+			multiplier = 1 << 20
+		case "g":
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			number = number[:len(number)-1]
+		}
+	}
+
+	size, err := strconv.Atoi(number)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected something like 500k or 2M", value)
+	}
+	return size * multiplier, nil
+}
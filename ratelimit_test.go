@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	for _, workers := range []int{1, 3} {
+		t.Run(strconv.Itoa(workers), func(t *testing.T) {
+			inTempDir(t)
+			srv := serveContent(testContent(20000))
+			defer srv.Close()
+
+			d := newTestDownloader(workers)
+			d.WithRateLimit(10000)
+			start := time.Now()
+			if _, err := d.Download(srv.URL + "/file.bin"); err != nil {
+				t.Fatal(err)
+			}
+			// The first second of bytes comes right away
+			if elapsed := time.Since(start); elapsed < 950*time.Millisecond {
+				t.Errorf("20000 bytes at 10000 B/s took %s, want at least a second", elapsed)
+			}
+		})
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"500", 500},
+		{"500k", 500 << 10},
+		{"500K", 500 << 10},
+		{"2M", 2 << 20},
+		{"1g", 1 << 30},
+	}
+	for _, tt := range tests {
+		if got, err := parseByteSize(tt.value); err != nil || got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", tt.value, got, err, tt.want)
+		}
+	}
+
+	for _, value := range []string{"", "abc", "-1k", "1.5M"} {
+		if _, err := parseByteSize(value); err == nil {
+			t.Errorf("%q parsed", value)
+		}
+	}
+}
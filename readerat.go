@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// A file that is still being downloaded, see DownloadReaderAt. Its ReadAt waits for the bytes it asks for
+// to arrive, so readers wanting random access, like archive/zip, can start before the download is over.
+type PartialFile struct {
+	cancel context.CancelFunc
+	// Closed once the file is being written, or the download ended before getting there.
+	started chan struct{}
+	done    chan struct{}
+	result  DownloadResult
+	err     error
+
+	// Closed and replaced every time a chunk is written to, so waiting reads check again.
+	changedMu sync.Mutex
+	changed   chan struct{}
+
+	mu   sync.RWMutex
+	file File
+	size int64
+	// The chunks of the running download, shared with it.
+	ranges  [][2]int
+	written []atomic.Int64
+	// Set when the file is decoded as it arrives, its bytes only land where they belong once it's done.
+	wholeOnly bool
+	closed    bool
+}
+
+// Starts downloading url like DownloadContext and returns the file as soon as it's being written,
+// the download carries on in the background while its ReadAt blocks until the range it reads has arrived.
+// The file is always streamed to disk, an error before that point is returned here, any later one
+// is returned by the reads and Wait. Close the file once done with it, that stops the download if it's still running.
+func (d *downloader) DownloadReaderAt(ctx context.Context, url string) (*PartialFile, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &PartialFile{
+		cancel:  cancel,
+		started: make(chan struct{}),
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+		size:    -1,
+	}
+
+	go func() {
+		result, err := d.download(ctx, []string{url}, p)
+		p.finish(d.fs, result, err)
+	}()
+
+	select {
+	case <-p.started:
+		return p, nil
+	case <-p.done:
+	}
+	if p.err != nil {
+		cancel()
+		return nil, p.err
+	}
+	return p, nil
+}
+
+// Called by the download once it's writing to the file at path, before any chunk has started.
+func (p *PartialFile) streaming(fs FileSystem, path string, size int, ranges [][2]int, written []atomic.Int64, decoded bool) error {
+	file, err := fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.file = file
+	p.size = int64(size)
+	p.ranges = ranges
+	p.written = written
+	p.wholeOnly = decoded
+	p.mu.Unlock()
+	close(p.started)
+	return nil
+}
+
+// Closes the partial file before the download moves it in place, since Windows can't rename a file that's open.
+// The reads wait meanwhile and go on from the moved file once finish opened it.
+func (p *PartialFile) suspend() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.file == nil {
+		return nil
+	}
+	err := p.file.Close()
+	p.file = nil
+	return err
+}
+
+// Wakes up the reads waiting for the file to grow.
+func (p *PartialFile) notify() {
+	p.changedMu.Lock()
+	close(p.changed)
+	p.changed = make(chan struct{})
+	p.changedMu.Unlock()
+}
+
+func (p *PartialFile) waitChange() <-chan struct{} {
+	p.changedMu.Lock()
+	defer p.changedMu.Unlock()
+	return p.changed
+}
+
+// Switches the reads over to the finished file, or to the error the download ended with.
+func (p *PartialFile) finish(fs FileSystem, result DownloadResult, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.result, p.err = result, err
+
+	if err == nil && !p.closed {
+		if p.file != nil {
+			p.file.Close()
+			p.file = nil
+		}
+		p.file, p.err = fs.OpenFile(result.Path, os.O_RDONLY, 0)
+		if p.err == nil {
+			if info, statErr := p.file.Stat(); statErr == nil {
+				p.size = info.Size()
+			}
+		}
+	}
+	close(p.done)
+}
+
+// Reads len(b) bytes at off once they've been downloaded, it returns io.EOF for what's past the end of the file
+// and the error of the download when it failed before they arrived.
+func (p *PartialFile) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	for {
+		// Taken before looking, so a write landing in between isn't missed
+		changed := p.waitChange()
+		if n, ok, err := p.tryRead(b, off); ok {
+			return n, err
+		}
+
+		select {
+		case <-changed:
+		case <-p.done:
+		}
+	}
+}
+
+// Reads b at off if it's all there, ok is false when it has to be waited for.
+func (p *PartialFile) tryRead(b []byte, off int64) (n int, ok bool, err error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return 0, true, os.ErrClosed
+	}
+
+	finished := isDone(p.done)
+	if finished && p.err != nil {
+		return 0, true, p.err
+	}
+	// Without a file it's being moved in place
+	if !finished && (p.file == nil || !p.arrived(off, off+int64(len(b)))) {
+		return 0, false, nil
+	}
+	n, err = p.file.ReadAt(b, off)
+	return n, true, err
+}
+
+// Reports whether every byte from start up to end, or up to the end of the file, has been written.
+func (p *PartialFile) arrived(start, end int64) bool {
+	if p.wholeOnly {
+		return false
+	}
+	if p.size >= 0 && end > p.size {
+		end = p.size
+	}
+
+	for i, r := range p.ranges {
+		chunkStart := int64(r[0])
+		chunkEnd := int64(r[1]) + 1
+		// A chunk of unknown size ends wherever the file does
+		if r[1] < 0 {
+			chunkEnd = end
+		}
+		if chunkEnd <= start || chunkStart >= end {
+			continue
+		}
+		if chunkStart+p.written[i].Load() < min(chunkEnd, end) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the size of the file, or -1 as long as the server didn't tell it and the download isn't over.
+func (p *PartialFile) Size() int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.size
+}
+
+// Waits for the download to end and returns what happened to it.
+func (p *PartialFile) Wait() (DownloadResult, error) {
+	<-p.done
+	return p.result, p.err
+}
+
+// Stops the download if it's still running and releases the file, which stays on disk once it completed.
+func (p *PartialFile) Close() error {
+	p.cancel()
+	<-p.done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.file == nil {
+		return nil
+	}
+	return p.file.Close()
+}
+
+var _ io.ReaderAt = (*PartialFile)(nil)
+
+func isDone(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Refuses to rename files that are still open, like Windows does.
+type windowsLikeFS struct {
+	osFileSystem
+	mu   sync.Mutex
+	open map[string]int
+}
+
+type trackedFile struct {
+	File
+	fs   *windowsLikeFS
+	path string
+	once sync.Once
+}
+
+func (f *trackedFile) Close() error {
+	f.once.Do(func() {
+		f.fs.mu.Lock()
+		f.fs.open[f.path]--
+		f.fs.mu.Unlock()
+	})
+	return f.File.Close()
+}
+
+func (fs *windowsLikeFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.osFileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	path, _ := filepath.Abs(name)
+	fs.mu.Lock()
+	fs.open[path]++
+	fs.mu.Unlock()
+	return &trackedFile{File: f, fs: fs, path: path}, nil
+}
+
+func (fs *windowsLikeFS) Rename(oldPath, newPath string) error {
+	path, _ := filepath.Abs(oldPath)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.open[path] > 0 {
+		return fmt.Errorf("rename %s: the file is open", oldPath)
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func TestDownloadReaderAtMovesClosedFile(t *testing.T) {
+	inTempDir(t)
+	data := testContent(3 << 20)
+	srv := serveContent(data)
+	defer srv.Close()
+
+	d := newTestDownloader(4)
+	d.WithFileSystem(&windowsLikeFS{open: map[string]int{}})
+	p, err := d.DownloadReaderAt(context.Background(), srv.URL+"/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	got := make([]byte, len(data))
+	if _, err := p.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("read bytes differ")
+	}
+	result, err := p.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads go on from the moved file
+	if _, err := p.ReadAt(got[:1024], 4096); err != nil || !bytes.Equal(got[:1024], data[4096:4096+1024]) {
+		t.Fatal("reading the finished file failed:", err)
+	}
+	if saved, err := os.ReadFile(result.Path); err != nil || !bytes.Equal(saved, data) {
+		t.Fatal("saved file differs:", err)
+	}
+}
+
+func TestDownloadReaderAtWaitsForSlowChunk(t *testing.T) {
+	inTempDir(t)
+	data := testContent(4 << 20)
+	release := make(chan struct{})
+	var once sync.Once
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The last of the four chunks only comes once released
+		if strings.HasPrefix(r.Header.Get("Range"), fmt.Sprintf("bytes=%d-", 3<<20)) {
+			<-release
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+	defer once.Do(func() { close(release) })
+
+	p, err := newTestDownloader(4).DownloadReaderAt(context.Background(), srv.URL+"/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	slow := make([]byte, 1000)
+	read := make(chan error, 1)
+	go func() {
+		_, err := p.ReadAt(slow, 3<<20+500)
+		read <- err
+	}()
+
+	// The chunks that arrived can be read meanwhile
+	first := make([]byte, 1000)
+	if _, err := p.ReadAt(first, 100); err != nil || !bytes.Equal(first, data[100:1100]) {
+		t.Fatal("reading a chunk that arrived failed:", err)
+	}
+	select {
+	case err := <-read:
+		t.Fatalf("the read returned %v before its chunk arrived", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	once.Do(func() { close(release) })
+	if err := <-read; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(slow, data[3<<20+500:3<<20+1500]) {
+		t.Fatal("the read bytes differ")
+	}
+	if _, err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
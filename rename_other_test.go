@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// What a rename across devices fails with.
+var errCrossDevice error = syscall.EXDEV
@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// What a rename across devices fails with.
+var errCrossDevice error = windows.ERROR_NOT_SAME_DEVICE
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Sends the request that starts the download with method instead of GET, for servers that only hand the file out
+// to a POST or the like. It's sent once, in place of the HEAD, and the file is read from its response in a single
+// stream as every range would need a request of its own, only a retry or a resumed download sends it again. A server redirecting it to a plain GET, as
+// 303 See Other does, has the file downloaded from where it led like any other, split if it supports ranges.
+func (d *downloader) WithRequestMethod(method string) {
+	d.requestMethod = strings.ToUpper(method)
+}
+
+// Sends body along with the request that starts the download, with POST unless WithRequestMethod says otherwise.
+// Its Content-Type can be set with WithHeader, like application/json or application/x-www-form-urlencoded.
+func (d *downloader) WithRequestBody(body []byte) {
+	d.requestBody = body
+}
+
+// Method of the request that starts the download.
+func (d *downloader) method() string {
+	switch {
+	case d.requestMethod != "":
+		return d.requestMethod
+	case d.requestBody != nil:
+		return http.MethodPost
+	default:
+		return http.MethodGet
+	}
+}
+
+// Reports whether the download starts with another request than a plain GET.
+func (d *downloader) customRequest() bool {
+	return d.method() != http.MethodGet || d.requestBody != nil
+}
+
+// Returns the request of WithRequestMethod and WithRequestBody for url, the body is sent again on redirects and retries.
+func (d *downloader) newCustomRequest(ctx context.Context, url string) (*http.Request, error) {
+	request, err := d.newRequest(ctx, d.method(), url)
+	if err != nil {
+		return nil, err
+	}
+	if body := d.requestBody; body != nil {
+		request.ContentLength = int64(len(body))
+		request.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		request.Body, _ = request.GetBody()
+	}
+	return request, nil
+}
+
+// Returns the request downloadFile sends for the whole file, the custom one unless it was redirected to a GET.
+func (d *downloader) newFileRequest(ctx context.Context, url string) (*http.Request, error) {
+	if d.customServed {
+		return d.newCustomRequest(ctx, url)
+	}
+	return d.newRequest(ctx, http.MethodGet, url)
+}
+
+// The response to the custom request that serves the file, kept by customDetails for downloadFile to read.
+type firstResponse struct {
+	url      string
+	response *http.Response
+}
+
+// Cancels the context of the request once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// Returns the kept response if it's the one for url and forgets about it, nil otherwise.
+func (d *downloader) takeFirstResponse(url string) *http.Response {
+	first := d.firstResponse
+	if first == nil || first.url != url {
+		return nil
+	}
+	d.firstResponse = nil
+	return first.response
+}
+
+// Closes the kept response if nothing read it, called once the download is over.
+func (d *downloader) dropFirstResponse() {
+	if first := d.firstResponse; first != nil {
+		first.response.Body.Close()
+		d.firstResponse = nil
+	}
+}
+
+// Asks the server about the file with the custom request, in place of the HEAD. When the file is served
+// to that request itself its response is kept, so the request isn't sent a second time to download it.
+func (d *downloader) customDetails(ctx context.Context, url string) (rangeDetails, error) {
+	// The probe timeout is only for the headers, the body that follows may be the whole file
+	ctx, cancel := context.WithCancel(ctx)
+	if d.probeTimeout > 0 {
+		timer := time.AfterFunc(d.probeTimeout, cancel)
+		defer timer.Stop()
+	}
+	request, err := d.newCustomRequest(ctx, url)
+	if err != nil {
+		cancel()
+		return rangeDetails{}, err
+	}
+	d.setIfModifiedSince(request)
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		cancel()
+		return rangeDetails{}, err
+	}
+	kept := false
+	defer func() {
+		if !kept {
+			response.Body.Close()
+			cancel()
+		}
+	}()
+
+	if response.StatusCode == http.StatusNotModified {
+		return rangeDetails{}, ErrNotModified
+	}
+	if err := checkThrottled(response); err != nil {
+		return rangeDetails{}, err
+	}
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
+		return rangeDetails{}, fmt.Errorf("unexpected status %d from %s %s", response.StatusCode, d.method(), redactURL(url))
+	}
+
+	// The client follows a 301, 302 or 303 with a GET, which can be repeated for every range
+	redirected := response.Request.Method == http.MethodGet
+	contentLength := parseContentLength(response.Header.Get("Content-Length"))
+	encoding := response.Header.Get("Content-Encoding")
+	digestAlgo, digest := advertisedDigest(response.Header, true)
+	details := rangeDetails{
+		supported:     redirected && contentLength >= 0 && !isEncoded(encoding) && response.Header.Get("Accept-Ranges") == "bytes",
+		encoding:      encoding,
+		length:        contentLength,
+		etag:          response.Header.Get("ETag"),
+		lastModified:  response.Header.Get("Last-Modified"),
+		fileName:      fileNameFromContentDisposition(response.Header.Get("Content-Disposition")),
+		contentType:   response.Header.Get("Content-Type"),
+		finalURL:      response.Request.URL.String(),
+		rangesUnknown: response.Header.Get("Accept-Ranges") == "",
+		digestAlgo:    digestAlgo,
+		digest:        digest,
+		custom:        !redirected,
+	}
+	// The file is downloaded from the first mirror
+	if details.custom && d.firstResponse == nil {
+		response.Body = cancelOnClose{ReadCloser: response.Body, cancel: cancel}
+		d.firstResponse = &firstResponse{url: details.finalURL, response: response}
+		kept = true
+	}
+	return details, nil
+}
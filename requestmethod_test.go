@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRequestMethodPost(t *testing.T) {
+	inTempDir(t)
+	data := testContent(3 << 20)
+	var posts, gets atomic.Int64
+	mux := http.NewServeMux()
+	// Hands the file out once for every token
+	var used atomic.Bool
+	mux.HandleFunc("/gated", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || string(body) != `{"token":"once"}` || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		posts.Add(1)
+		if used.Swap(true) {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="report.bin"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		posts.Add(1)
+		http.Redirect(w, r, "/file.bin", http.StatusSeeOther)
+	})
+	mux.HandleFunc("/file.bin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	d := newTestDownloader(4)
+	if _, err := d.DownloadContext(context.Background(), srv.URL+"/gated"); err == nil {
+		t.Fatal("a GET of the gated file succeeded")
+	}
+
+	d.WithRequestBody([]byte(`{"token":"once"}`))
+	d.WithHeader("Content-Type", "application/json")
+	result, err := d.DownloadWithResult(context.Background(), srv.URL+"/gated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Multipart || filepath.Base(result.Path) != "report.bin" {
+		t.Errorf("got %+v, want a single stream saved as report.bin", result)
+	}
+	if saved, _ := os.ReadFile(result.Path); !bytes.Equal(saved, data) {
+		t.Error("saved file differs")
+	}
+	if n := posts.Load(); n != 1 {
+		t.Errorf("the POST was sent %d times, want once", n)
+	}
+
+	posts.Store(0)
+	d = newTestDownloader(4)
+	d.WithRequestMethod("post")
+	result, err = d.DownloadWithResult(context.Background(), srv.URL+"/redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The GET following the redirect, then one per range
+	if !result.Multipart || posts.Load() != 1 || gets.Load() != 5 {
+		t.Errorf("got %+v with %d POST and %d GET, want the redirect split in 4 ranges", result, posts.Load(), gets.Load())
+	}
+	if saved, _ := os.ReadFile(result.Path); !bytes.Equal(saved, data) {
+		t.Error("saved file differs")
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import "time"
+
+// What DownloadWithResult reports about a finished download.
+type DownloadResult struct {
+	// Where the file is stored
+	Path string
+	// Number of bytes received, zero when the download was skipped
+	Size int64
+	// Whether the file was fetched in several ranges at once
+	Multipart bool
+	// Number of workers that actually took part, it can be lower than the configured count
+	Workers int
+	// From the start of DownloadWithResult until the file was in place
+	Elapsed time.Duration
+	// Content-Type header the server sent for the file
+	ContentType string
+	// Set when the file already existed and WithExistingFilePolicy told us to keep it,
+	// or when the server said it wasn't modified
+	Skipped bool
+	// Set when the server answered the If-Modified-Since of WithIfModifiedSince with 304
+	NotModified bool
+	// Hex digests of the file by algorithm, for WithComputedChecksums and WithChecksum
+	Checksums map[string]string
+}
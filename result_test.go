@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDownloadWithResult(t *testing.T) {
+	data := testContent(1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-test")
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+	tests := []struct {
+		name      string
+		workers   int
+		multipart bool
+	}{
+		{"multipart", 4, true},
+		{"single", 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			result, err := newTestDownloader(tt.workers).DownloadWithResult(context.Background(), srv.URL+"/file.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filepath.Base(result.Path) != "file.bin" || result.Size != 1000 || result.ContentType != "application/x-test" {
+				t.Errorf("got %q, %d bytes of %s", result.Path, result.Size, result.ContentType)
+			}
+			if result.Multipart != tt.multipart || result.Workers != tt.workers {
+				t.Errorf("got multipart %v with %d workers, want %v with %d", result.Multipart, result.Workers, tt.multipart, tt.workers)
+			}
+			if result.Elapsed <= 0 || result.Skipped || result.NotModified {
+				t.Errorf("got %+v", result)
+			}
+		})
+	}
+}
+
+func TestDownloadWithResultSkipped(t *testing.T) {
+	inTempDir(t)
+	srv := serveContent(testContent(1000))
+	defer srv.Close()
+	if err := os.WriteFile("file.bin", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newTestDownloader(2)
+	d.WithExistingFilePolicy(ExistingFileSkip)
+	result, err := d.DownloadWithResult(context.Background(), srv.URL+"/file.bin")
+	if err != nil || !result.Skipped || result.Size != 0 || filepath.Base(result.Path) != "file.bin" {
+		t.Errorf("got %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often a download that keeps its partial file saves the state of its chunks, see WithResumeSaveInterval.
+const defaultResumeSaveInterval = 5 * time.Second
+
+// Saved next to the partial file of an interrupted download, so the next one can pick up where it stopped.
+// It's also saved while the download runs, so a process that gets killed leaves it behind as well.
+type resumeState struct {
+	// Without its credentials, a download of another URL doesn't pick up this one
+	URL           string       `json:"url,omitempty"`
+	ContentLength int          `json:"content_length"`
+	ETag          string       `json:"etag,omitempty"`
+	LastModified  string       `json:"last_modified,omitempty"`
+	Chunks        []chunkState `json:"chunks"`
+}
+
+// Inclusive byte range of a chunk and how many bytes of it are already on disk.
+type chunkState struct {
+	Start   int   `json:"start"`
+	End     int   `json:"end"`
+	Written int64 `json:"written"`
+}
+
+// Keeps the partial file of a failed or cancelled download along with the state of its chunks,
+// like WithResume does, without continuing an earlier one. A later download with WithResume picks it up.
+// Such downloads are streamed to disk, regardless of WithMemoryBuffering.
+func (d *downloader) WithKeepPartialOnError(enabled bool) {
+	d.keepPartial = enabled
+}
+
+// Sets how often a download that keeps its partial file, see WithResume and WithKeepPartialOnError,
+// saves how far its chunks got while it runs, 5 seconds by default. 0 saves it only once the download stops,
+// which a killed process never gets to do.
+func (d *downloader) WithResumeSaveInterval(interval time.Duration) {
+	d.resumeSaveInterval = interval
+}
+
+// Reports whether a failed download leaves its partial file behind.
+func (d *downloader) keepsPartial() bool {
+	return d.resumeEnabled || d.keepPartial
+}
+
+func (d *downloader) resumeStatePath(filePath string) string {
+	return d.partPath(filePath) + ".json"
+}
+
+// Restores the chunks and the partial file of a previous download of fileURL into filePath,
+// it reports false when there is nothing to resume or the file has changed on the server since then.
+func (d *downloader) loadResumeState(filePath, fileURL string, details rangeDetails) bool {
+	data, err := readFile(d.fs, d.resumeStatePath(filePath))
+	if err != nil {
+		return false
+	}
+
+	var state resumeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return false
+	}
+
+	if state.ContentLength != details.length || state.ETag != details.etag || state.LastModified != details.lastModified || len(state.Chunks) == 0 {
+		return false
+	}
+	// States saved before the URL was recorded can't tell
+	if state.URL != "" && state.URL != redactURL(fileURL) {
+		return false
+	}
+
+	// Carrying on with several chunks needs range requests
+	if len(state.Chunks) > 1 && !details.supported {
+		return false
+	}
+
+	tempFile, err := d.fs.OpenFile(d.partPath(filePath), os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+
+	d.tempFile = tempFile
+	d.ranges = make([][2]int, len(state.Chunks))
+	d.written = make([]atomic.Int64, len(state.Chunks))
+	for i, chunk := range state.Chunks {
+		d.ranges[i] = [2]int{chunk.Start, chunk.End}
+		d.written[i].Store(chunk.Written)
+	}
+
+	return true
+}
+
+// Records how far each chunk got and keeps the partial file for a later resume.
+func (d *downloader) saveResumeState(filePath, fileURL string, details rangeDetails) {
+	if len(d.ranges) == 0 {
+		d.removeTempFile()
+		return
+	}
+
+	if err := d.writeResumeState(filePath, fileURL, details); err != nil {
+		d.removeTempFile()
+		return
+	}
+
+	d.tempFile.Close()
+	d.tempFile = nil
+}
+
+// Writes the state of the chunks as they are now next to the partial file, replacing the previous one
+// in a single rename so a process killed in the middle can't leave half of it.
+func (d *downloader) writeResumeState(filePath, fileURL string, details rangeDetails) error {
+	state := resumeState{
+		URL:           redactURL(fileURL),
+		ContentLength: details.length,
+		ETag:          details.etag,
+		LastModified:  details.lastModified,
+		Chunks:        make([]chunkState, len(d.ranges)),
+	}
+	for i, r := range d.ranges {
+		state.Chunks[i] = chunkState{Start: r[0], End: r[1], Written: d.written[i].Load()}
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// The bytes counted above have to be on disk before the state saying so
+	if syncer, ok := d.tempFile.(interface{ Sync() error }); ok {
+		if err := syncer.Sync(); err != nil {
+			return err
+		}
+	}
+
+	statePath := d.resumeStatePath(filePath)
+	if err := writeFile(d.fs, statePath+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return d.fs.Rename(statePath+".tmp", statePath)
+}
+
+// Saves the state of the chunks at every WithResumeSaveInterval until the returned func is called,
+// which waits for a save in progress so nothing is written once the download moved on.
+func (d *downloader) saveResumeStatePeriodically(ctx context.Context, filePath, fileURL string, details rangeDetails) (stop func()) {
+	if d.resumeSaveInterval <= 0 || len(d.ranges) == 0 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(d.resumeSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := d.writeResumeState(filePath, fileURL, details); err != nil {
+					d.logger.Debugf("saving the resume state failed: %v", err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Serves data with an ETag, cutting every GET off after cut bytes while cut is above 0
+// and counting the bytes of the bodies it sent.
+type cuttingServer struct {
+	data   []byte
+	etag   atomic.Value
+	cut    atomic.Int64
+	served atomic.Int64
+}
+
+func newCuttingServer(data []byte, cut int) (*cuttingServer, *httptest.Server) {
+	s := &cuttingServer{data: data}
+	s.etag.Store(`"v1"`)
+	s.cut.Store(int64(cut))
+	return s, httptest.NewServer(s)
+}
+
+func (s *cuttingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("ETag", s.etag.Load().(string))
+	if r.Method != http.MethodGet {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(s.data))
+		return
+	}
+	http.ServeContent(&cutWriter{ResponseWriter: w, served: &s.served, left: s.cut.Load()}, r, "file.bin", time.Time{}, bytes.NewReader(s.data))
+}
+
+// Counts the bytes written into served, cutting the response off after left of them if it's above 0.
+type cutWriter struct {
+	http.ResponseWriter
+	served *atomic.Int64
+	left   int64
+}
+
+func (c *cutWriter) Write(p []byte) (int, error) {
+	cut := c.left > 0
+	if cut && int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.ResponseWriter.Write(p)
+	c.served.Add(int64(n))
+	if cut {
+		if c.left -= int64(n); c.left == 0 {
+			c.ResponseWriter.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+	}
+	return n, err
+}
+
+func TestResume(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprint(workers), func(t *testing.T) {
+			inTempDir(t)
+			data := testContent(10000)
+			s, srv := newCuttingServer(data, 1000)
+			defer srv.Close()
+
+			d := newTestDownloader(workers)
+			d.WithResume(true)
+			if _, err := d.Download(srv.URL + "/file.bin"); err == nil {
+				t.Fatal("the cut off download succeeded")
+			}
+			if _, err := os.Stat("file.bin.part.json"); err != nil {
+				t.Fatal(err)
+			}
+
+			s.cut.Store(0)
+			s.served.Store(0)
+			d = newTestDownloader(workers)
+			d.WithResume(true)
+			path, err := d.Download(srv.URL + "/file.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+				t.Fatal("resumed file doesn't match")
+			}
+			if want := int64(len(data) - 1000*workers); s.served.Load() != want {
+				t.Errorf("the resumed download fetched %d bytes, want %d", s.served.Load(), want)
+			}
+			if names, _ := filepath.Glob("*"); len(names) != 1 {
+				t.Errorf("left behind %v", names)
+			}
+		})
+	}
+}
+
+func TestResumeChangedFile(t *testing.T) {
+	inTempDir(t)
+	data := testContent(10000)
+	s, srv := newCuttingServer(data, 1000)
+	defer srv.Close()
+
+	d := newTestDownloader(4)
+	d.WithResume(true)
+	if _, err := d.Download(srv.URL + "/file.bin"); err == nil {
+		t.Fatal("the cut off download succeeded")
+	}
+
+	s.etag.Store(`"v2"`)
+	s.cut.Store(0)
+	s.served.Store(0)
+	d = newTestDownloader(4)
+	d.WithResume(true)
+	path, err := d.Download(srv.URL + "/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatal("restarted file doesn't match")
+	}
+	if s.served.Load() != int64(len(data)) {
+		t.Errorf("a changed file was resumed, fetched %d bytes of %d", s.served.Load(), len(data))
+	}
+}
+
+func TestKeepPartialOnError(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		t.Run(fmt.Sprint(keep), func(t *testing.T) {
+			inTempDir(t)
+			data := testContent(10000)
+			s, srv := newCuttingServer(data, 1000)
+			defer srv.Close()
+
+			d := newTestDownloader(2)
+			d.WithMemoryBuffering(0)
+			d.WithKeepPartialOnError(keep)
+			if _, err := d.Download(srv.URL + "/file.bin"); err == nil {
+				t.Fatal("the cut off download succeeded")
+			}
+			for _, name := range []string{"file.bin.part", "file.bin.part.json"} {
+				if _, err := os.Stat(name); (err == nil) != keep {
+					t.Errorf("%s kept: %v, want %v", name, err == nil, keep)
+				}
+			}
+			if !keep {
+				return
+			}
+
+			s.cut.Store(0)
+			s.served.Store(0)
+			d = newTestDownloader(2)
+			d.WithResume(true)
+			path, err := d.Download(srv.URL + "/file.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+				t.Fatal("resumed file doesn't match")
+			}
+			if want := int64(len(data) - 2000); s.served.Load() != want {
+				t.Errorf("the resumed download fetched %d bytes, want %d", s.served.Load(), want)
+			}
+		})
+	}
+}
+
+func TestResumeManifest(t *testing.T) {
+	data := testContent(40000)
+	tests := []struct {
+		name string
+		// Changes the manifest the previous process left
+		change func(state *resumeState)
+		// Whether the chunks on disk are picked up
+		trusted bool
+	}{
+		{"same file", func(state *resumeState) {}, true},
+		{"other URL", func(state *resumeState) { state.URL += "/other" }, false},
+		{"other ETag", func(state *resumeState) { state.ETag = `"v0"` }, false},
+		{"other size", func(state *resumeState) { state.ContentLength = 50000 }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			var mu sync.Mutex
+			var requested []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					mu.Lock()
+					requested = append(requested, r.Header.Get("Range"))
+					mu.Unlock()
+				}
+				w.Header().Set("ETag", `"v1"`)
+				http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+			}))
+			defer srv.Close()
+
+			// What a previous process got done of its two chunks before it went away
+			part := make([]byte, len(data))
+			copy(part[:5000], data[:5000])
+			copy(part[20000:35000], data[20000:35000])
+			if err := os.WriteFile("file.bin.part", part, 0644); err != nil {
+				t.Fatal(err)
+			}
+			state := resumeState{URL: srv.URL + "/file.bin", ContentLength: len(data), ETag: `"v1"`,
+				Chunks: []chunkState{{0, 19999, 5000}, {20000, 39999, 15000}}}
+			tt.change(&state)
+			manifest, _ := json.Marshal(state)
+			if err := os.WriteFile("file.bin.part.json", manifest, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			d := newTestDownloader(2)
+			d.WithMinChunkSize(1)
+			d.WithResume(true)
+			path, err := d.Download(srv.URL + "/file.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+				t.Fatal("resumed file doesn't match")
+			}
+			sort.Strings(requested)
+			want := []string{"bytes=0-19999", "bytes=20000-39999"}
+			if tt.trusted {
+				want = []string{"bytes=35000-39999", "bytes=5000-19999"}
+			}
+			if !slices.Equal(requested, want) {
+				t.Errorf("requested %v, want %v", requested, want)
+			}
+			if _, err := os.Stat("file.bin.part.json"); err == nil {
+				t.Error("the manifest is left after the download")
+			}
+		})
+	}
+}
+
+func TestResumeSaveInterval(t *testing.T) {
+	inTempDir(t)
+	data := testContent(20000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Method == http.MethodHead {
+			http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+			return
+		}
+		// Half a kilobyte every 10ms, the download takes far longer than the test waits
+		http.ServeContent(slowWriter{w}, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(2)
+	d.WithMinChunkSize(1)
+	d.WithKeepPartialOnError(true)
+	d.WithResumeSaveInterval(20 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	saved := make(chan resumeState, 1)
+	go func() {
+		// The manifest shows up with progress in it while the download is still running
+		for ctx.Err() == nil {
+			manifest, err := os.ReadFile("file.bin.part.json")
+			var state resumeState
+			if err == nil && json.Unmarshal(manifest, &state) == nil && len(state.Chunks) == 2 && state.Chunks[0].Written > 0 {
+				saved <- state
+				cancel()
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	if _, err := d.DownloadContext(ctx, srv.URL+"/file.bin"); err == nil {
+		t.Fatal("the cancelled download succeeded")
+	}
+
+	select {
+	case state := <-saved:
+		if state.ContentLength != len(data) || state.ETag != `"v1"` || state.URL != srv.URL+"/file.bin" {
+			t.Errorf("got %+v", state)
+		}
+	default:
+		t.Fatal("the manifest wasn't saved during the download")
+	}
+	if _, err := os.Stat("file.bin.part.json.tmp"); err == nil {
+		t.Error("the temporary manifest is left")
+	}
+}
+
+// Writes half a kilobyte at a time, every 10ms.
+type slowWriter struct{ http.ResponseWriter }
+
+func (s slowWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		m, err := s.ResponseWriter.Write(p[:min(len(p), 500)])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		s.ResponseWriter.(http.Flusher).Flush()
+		p = p[m:]
+		time.Sleep(10 * time.Millisecond)
+	}
+	return n, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Retries a failed request up to count times, waiting baseDelay before the first retry
+// and doubling it (with some jitter) after each attempt, or longer when the server's Retry-After asks for it.
+// Only the bytes that haven't arrived yet are requested again.
+func (d *downloader) WithRetries(count int, baseDelay time.Duration) {
+	d.retries = count
+	d.retryBaseDelay = baseDelay
+}
+
+// Decides which failures WithRetries tries again, response is the one that failed, with its body already closed,
+// or nil when there's none like for a network error. By default those and the statuses of a server or proxy
+// in trouble, 408, 429, 500, 502, 503 and 504, are retried while other statuses aren't.
+// Errors asking again can't fix, like the file having changed on the server, are never retried whatever it says.
+func (d *downloader) WithRetryableFunc(retryable func(response *http.Response, err error) bool) {
+	d.retryable = retryable
+}
+
+// Returned for a response with a status the download can't do anything with.
+type statusError struct {
+	response *http.Response
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.response.StatusCode)
+}
+
+// Returns the response err failed with, if it came from one.
+func failedResponse(err error) *http.Response {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.response
+	}
+	var throttled *throttledError
+	if errors.As(err, &throttled) {
+		return throttled.response
+	}
+	return nil
+}
+
+func defaultRetryable(response *http.Response, err error) bool {
+	if response == nil {
+		return true
+	}
+	switch response.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Reports whether err is worth another attempt.
+func (d *downloader) shouldRetry(err error) bool {
+	if permanent(err) {
+		return false
+	}
+	if d.retryable == nil {
+		return defaultRetryable(failedResponse(err), err)
+	}
+	return d.retryable(failedResponse(err), err)
+}
+
+// Calls attempt for chunk index until it succeeds, the configured retries are used up or ctx is done.
+func (d *downloader) retry(ctx context.Context, index int, name string, attempt func() error) error {
+	err := attempt()
+	for i := 0; err != nil && d.shouldRetry(err) && i < d.retries; i++ {
+		delay := backoff(d.retryBaseDelay, i)
+		// A server that said how long to wait knows better
+		if wait := retryAfter(err); wait > delay {
+			delay = wait
+		}
+		d.logger.Errorf("%s failed, retrying in %s: %v", name, delay, err)
+		d.observer.OnRetry(index, i+1, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		err = attempt()
+	}
+	return err
+}
+
+// Reports errors asking again won't fix, like the file having changed on the server or being too large.
+func permanent(err error) bool {
+	return errors.Is(err, ErrFileChanged) || errors.Is(err, ErrTooLarge) || errors.Is(err, ErrUnexpectedContentType)
+}
+
+// Doubles base for every attempt and picks a random delay from the upper half of it,
+// so workers failing together don't all come back at the same moment.
+func backoff(base time.Duration, attempt int) time.Duration {
+	delay := base << attempt
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Fails the first failures GETs, with a 503 or by cutting the body off after 500 bytes.
+type flakyServer struct {
+	data     []byte
+	failures int64
+	cut      bool
+	gets     atomic.Int64
+	served   atomic.Int64
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(s.data))
+		return
+	}
+	cut := &cutWriter{ResponseWriter: w, served: &s.served}
+	if s.gets.Add(1) <= s.failures {
+		if !s.cut {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		cut.left = 500
+	}
+	http.ServeContent(cut, r, "file.bin", time.Time{}, bytes.NewReader(s.data))
+}
+
+func TestRetries(t *testing.T) {
+	for _, cut := range []bool{false, true} {
+		for _, memory := range []int{0, 1 << 20} {
+			for _, workers := range []int{1, 4} {
+				t.Run(fmt.Sprintf("cut=%v/%d/%d", cut, memory, workers), func(t *testing.T) {
+					inTempDir(t)
+					data := testContent(10000)
+					s := &flakyServer{data: data, failures: int64(workers), cut: cut}
+					srv := httptest.NewServer(s)
+					defer srv.Close()
+
+					d := newTestDownloader(workers)
+					d.WithMemoryBuffering(memory)
+					// Enough for one chunk getting every failure
+					d.WithRetries(workers, time.Millisecond)
+					path, err := d.Download(srv.URL + "/file.bin")
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+						t.Fatal("downloaded file doesn't match")
+					}
+					// The retries only ask for what the chunks are still missing, a single stream starts over
+					if workers > 1 && s.served.Load() != int64(len(data)) {
+						t.Errorf("served %d bytes for a %d bytes file", s.served.Load(), len(data))
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestRetriesRunOut(t *testing.T) {
+	inTempDir(t)
+	s := &flakyServer{data: testContent(10000), failures: 100}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	d := newTestDownloader(2)
+	d.WithRetries(2, time.Millisecond)
+	if _, err := d.Download(srv.URL + "/file.bin"); err == nil {
+		t.Fatal("a download failing every time succeeded")
+	}
+	// Each chunk gets its first attempt and two retries
+	if gets := s.gets.Load(); gets != 6 {
+		t.Errorf("got %d requests, want 6", gets)
+	}
+}
+
+func TestRetryableFunc(t *testing.T) {
+	data := testContent(5000)
+	only404 := func(response *http.Response, err error) bool {
+		return response == nil || response.StatusCode == http.StatusNotFound
+	}
+	tests := []struct {
+		name      string
+		status    int
+		retryable func(response *http.Response, err error) bool
+		ok        bool
+	}{
+		{"404 by default", http.StatusNotFound, nil, false},
+		{"404 retried", http.StatusNotFound, only404, true},
+		{"502 by default", http.StatusBadGateway, nil, true},
+		{"502 not retried", http.StatusBadGateway, only404, false},
+	}
+
+	for _, tt := range tests {
+		for _, workers := range []int{1, 3} {
+			t.Run(fmt.Sprintf("%s/%d", tt.name, workers), func(t *testing.T) {
+				var gets atomic.Int64
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					// The first two GETs fail, whichever chunks they're for
+					if r.Method == http.MethodGet && gets.Add(1) <= 2 {
+						w.WriteHeader(tt.status)
+						return
+					}
+					http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+				}))
+				defer srv.Close()
+
+				var mu sync.Mutex
+				var seen []int
+				d := newTestDownloader(workers)
+				d.WithRetries(3, time.Millisecond)
+				if tt.retryable != nil {
+					d.WithRetryableFunc(func(response *http.Response, err error) bool {
+						mu.Lock()
+						defer mu.Unlock()
+						if response != nil {
+							seen = append(seen, response.StatusCode)
+						}
+						return tt.retryable(response, err)
+					})
+				}
+				var buf bytes.Buffer
+				err := d.DownloadToWriter(context.Background(), srv.URL+"/file.bin", &buf)
+				if tt.ok != (err == nil) {
+					t.Fatalf("got %v, want success %v", err, tt.ok)
+				}
+				if tt.ok && !bytes.Equal(buf.Bytes(), data) {
+					t.Error("downloaded bytes don't match")
+				}
+				if !tt.ok && !strings.Contains(err.Error(), fmt.Sprintf("unexpected status %d", tt.status)) {
+					t.Errorf("got %v", err)
+				}
+				for _, status := range seen {
+					if status != tt.status {
+						t.Errorf("the predicate got the status %d, want %d", status, tt.status)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestDefaultRetryable(t *testing.T) {
+	for status, want := range map[int]bool{
+		http.StatusRequestTimeout: true, http.StatusTooManyRequests: true, http.StatusInternalServerError: true,
+		http.StatusBadGateway: true, http.StatusServiceUnavailable: true, http.StatusGatewayTimeout: true,
+		http.StatusNotFound: false, http.StatusForbidden: false, http.StatusNotImplemented: false,
+	} {
+		if got := defaultRetryable(&http.Response{StatusCode: status}, nil); got != want {
+			t.Errorf("got %v for %d, want %v", got, status, want)
+		}
+	}
+	// Network errors have no response
+	if !defaultRetryable(nil, errors.New("connection reset")) {
+		t.Error("a network error isn't retried")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Exit code of a process stopped by Ctrl-C, as shells report it.
+const interruptedExitCode = 130
+
+// Returns a context cancelled by the first of signals, so the downloads stop and clean up after themselves.
+// A second one kills the process as usual, in case cleaning up is stuck.
+func notifyContext(signals ...os.Signal) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), signals...)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// Cancelled on Ctrl-C or a termination request.
+func interruptContext() (context.Context, context.CancelFunc) {
+	return notifyContext(os.Interrupt, syscall.SIGTERM)
+}
+
+// Tells what became of the partial files once the downloads were interrupted and exits.
+func exitInterrupted(opts downloadOptions) {
+	message := "interrupted, the partial download was removed"
+	if opts.resume || opts.keepPartial {
+		message = "interrupted, the partial download is kept and continues on the next run with --resume"
+	}
+	if opts.json {
+		newEventWriter(os.Stdout).emit(errorEvent{Event: "error", Error: message, ExitCode: interruptedExitCode})
+	} else {
+		fmt.Fprintln(os.Stderr, message)
+	}
+	os.Exit(interruptedExitCode)
+}
@@ -0,0 +1,102 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNotifyContext(t *testing.T) {
+	ctx, stop := notifyContext(syscall.SIGUSR1)
+	defer stop()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the signal didn't cancel the context")
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		// What's left in the directory once the download stopped
+		left []string
+	}{
+		{"removed", nil, nil},
+		{"kept", []string{"--resume"}, []string{"file.bin.part", "file.bin.part.json"}},
+		{"json", []string{"--json"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requested := make(chan struct{}, 4)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					requested <- struct{}{}
+					<-r.Context().Done()
+					return
+				}
+				http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(testContent(100000)))
+			}))
+			defer srv.Close()
+
+			dir := t.TempDir()
+			args := append([]string{"download", "-p=false", "-w", "2"}, tt.args...)
+			cmd := command(t, dir, append(args, srv.URL+"/file.bin")...)
+			var stdout, stderr bytes.Buffer
+			cmd.Stdout = &stdout
+			cmd.Stderr = &stderr
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			exited := make(chan struct{})
+			go func() {
+				cmd.Wait()
+				close(exited)
+			}()
+			select {
+			case <-requested:
+			case <-exited:
+				t.Fatalf("exited before downloading: %s", stderr.String())
+			}
+			if err := cmd.Process.Signal(os.Interrupt); err != nil {
+				t.Fatal(err)
+			}
+
+			<-exited
+			if code := cmd.ProcessState.ExitCode(); code != interruptedExitCode {
+				t.Errorf("exited with %d, want %d, stderr: %s", code, interruptedExitCode, stderr.String())
+			}
+			told := stderr.String()
+			if tt.name == "json" {
+				lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+				told = lines[len(lines)-1]
+				if !strings.HasPrefix(told, `{"event":"error"`) || stderr.Len() != 0 {
+					t.Errorf("got %q and %q on stderr, want an error event", told, stderr.String())
+				}
+			}
+			if !strings.Contains(told, "interrupted") {
+				t.Errorf("got %q, want the interruption told", told)
+			}
+			names, _ := filepath.Glob(filepath.Join(dir, "*"))
+			for i := range names {
+				names[i] = filepath.Base(names[i])
+			}
+			if strings.Join(names, ",") != strings.Join(tt.left, ",") {
+				t.Errorf("left %v, want %v", names, tt.left)
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+// Downloads every file in a single request even when the server supports ranges, for servers that rate limit
+// or corrupt them. Unlike a single worker it leaves the worker count alone, so it can be turned off again for
+// the next file. A resumed download that was split carries on with its chunks, one after the other.
+func (d *downloader) WithForceSingle(enabled bool) {
+	d.forceSingle = enabled
+}
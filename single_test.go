@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestForceSingle(t *testing.T) {
+	data := testContent(5 << 20)
+	for _, force := range []bool{true, false} {
+		t.Run(fmt.Sprint(force), func(t *testing.T) {
+			inTempDir(t)
+			var gets atomic.Int64
+			srv := getCountingServer(data, &gets)
+			defer srv.Close()
+
+			d := newTestDownloader(5)
+			d.WithForceSingle(force)
+			result, err := d.DownloadWithResult(context.Background(), srv.URL+"/file.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(result.Path); !bytes.Equal(got, data) {
+				t.Fatal("downloaded file doesn't match")
+			}
+			want := map[bool]int64{true: 1, false: 5}[force]
+			if result.Multipart == force || gets.Load() != want || result.Workers != int(want) {
+				t.Errorf("got multipart %v with %d workers over %d GETs, want %d", result.Multipart, result.Workers, gets.Load(), want)
+			}
+		})
+	}
+}
+
+func TestSingleCommand(t *testing.T) {
+	dir := t.TempDir()
+	data := testContent(5 << 20)
+	var gets atomic.Int64
+	srv := getCountingServer(data, &gets)
+	defer srv.Close()
+
+	if _, stderr, code := runCommand(t, dir, nil, "download", "-p=false", "--single", "-w", "5", srv.URL+"/file.bin"); code != 0 {
+		t.Fatalf("exited with %d: %s", code, stderr)
+	}
+	if gets.Load() != 1 {
+		t.Errorf("got %d GETs, want 1", gets.Load())
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "file.bin")); !bytes.Equal(got, data) {
+		t.Error("downloaded file doesn't match")
+	}
+}
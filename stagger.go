@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Starts the workers of a multipart download delay apart instead of all at once, with a little jitter,
+// so a server limiting connections or their rate doesn't see a burst of requests. 0, the default, disables it.
+func (d *downloader) WithStaggerStart(delay time.Duration) {
+	d.staggerDelay = delay
+}
+
+// Holds worker back until its turn to start, it reports false when ctx is done first.
+func (d *downloader) staggerStart(ctx context.Context, worker int) bool {
+	if d.staggerDelay <= 0 || worker == 0 {
+		return true
+	}
+
+	// Up to a tenth of the delay either way, so downloads started together don't stay in step
+	jitter := time.Duration(rand.Int63n(int64(d.staggerDelay)/5+1)) - d.staggerDelay/10
+	timer := time.NewTimer(time.Duration(worker)*d.staggerDelay + jitter)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
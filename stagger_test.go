@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStaggerStart(t *testing.T) {
+	inTempDir(t)
+	const delay = 50 * time.Millisecond
+	var mu sync.Mutex
+	var starts []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			starts = append(starts, time.Now())
+			mu.Unlock()
+			// Busy past the turn of every worker, or the first one takes all the ranges
+			time.Sleep(8 * delay)
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(testContent(4000)))
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader(4)
+	d.WithStaggerStart(delay)
+	if _, err := d.Download(srv.URL + "/file.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(starts) != 4 {
+		t.Fatalf("got %d GETs, want 4", len(starts))
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	for i := 1; i < len(starts); i++ {
+		// The jitter of each worker is a tenth of the delay either way, the rest is slack for a busy machine
+		// making one request arrive late and the next one seem early
+		if gap := starts[i].Sub(starts[i-1]); gap < delay*6/10 || gap > delay*5/2 {
+			t.Errorf("worker %d started %v after the one before, want about %v", i, gap, delay)
+		}
+	}
+}
+
+func TestStaggerStartCancelled(t *testing.T) {
+	inTempDir(t)
+	srv := stallingServer(testContent(4000), time.Minute)
+	defer srv.Close()
+
+	d := newTestDownloader(4)
+	// The workers still waiting for their turn have to give up on the cancel as well
+	d.WithStaggerStart(time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if _, err := d.DownloadContext(ctx, srv.URL+"/file.bin"); err == nil {
+		t.Fatal("the cancelled download succeeded")
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("the download took %v to stop, the workers kept waiting for their turn", elapsed)
+	}
+}
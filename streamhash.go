@@ -0,0 +1,145 @@
+package main
+
+import (
+	"hash"
+	"io"
+	"math"
+	"sync"
+)
+
+// Feeds the hashes of a streamed download as its bytes are written, so the finished file isn't read again.
+// A running hash only takes the file in order, so it follows the bytes written from the start of the file on,
+// and the ones written ahead of that by the other chunks are read back from the file once everything before
+// them is there. Keeping them in memory until then would cost as much as buffering the download,
+// see WithMaxBufferedBytes. Anything written again, like a stream starting over, falls back to reading
+// the whole file when the download is done.
+type streamHash struct {
+	mu     sync.Mutex
+	hashes map[string]hash.Hash
+	w      io.Writer
+	file   io.ReaderAt
+	// Everything before hashed has been fed to the hashes.
+	hashed int64
+	// The [start, end) spans written ahead of hashed, by start and by end.
+	byStart map[int64]int64
+	byEnd   map[int64]int64
+	// Set while a span is read back without the lock, the writes in the meantime are only recorded.
+	catching bool
+	broken   bool
+}
+
+// The chunks' ranges and written counts are those of the download, a resumed one has some bytes on disk already.
+func newStreamHash(hashes map[string]hash.Hash, file io.ReaderAt, ranges [][2]int, written []int64) *streamHash {
+	h := &streamHash{
+		hashes:  hashes,
+		w:       hashesWriter(hashes),
+		file:    file,
+		byStart: map[int64]int64{},
+		byEnd:   map[int64]int64{},
+	}
+	for i, r := range ranges {
+		if written[i] > 0 {
+			h.add(int64(r[0]), int64(r[0])+written[i])
+		}
+	}
+	return h
+}
+
+// Tells the hash p was written to the file at off.
+func (h *streamHash) wrote(off int64, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.broken {
+		return
+	}
+	if off == h.hashed && !h.catching {
+		h.w.Write(p)
+		h.hashed += int64(len(p))
+	} else {
+		h.add(off, off+int64(len(p)))
+	}
+	h.catchUp()
+}
+
+// Records the span [start, end) as written ahead of what's hashed.
+func (h *streamHash) add(start, end int64) {
+	if start < h.hashed {
+		h.broken = true
+		return
+	}
+	if from, ok := h.byEnd[start]; ok {
+		delete(h.byEnd, start)
+		start = from
+	} else {
+		for s, e := range h.byStart {
+			if start < e && s < end {
+				h.broken = true
+				return
+			}
+		}
+	}
+	if to, ok := h.byStart[end]; ok {
+		delete(h.byStart, end)
+		delete(h.byEnd, to)
+		end = to
+	}
+	h.byStart[start] = end
+	h.byEnd[end] = start
+}
+
+// Reads back the spans that now follow what's hashed, without holding the lock so the other chunks carry on.
+// Called with the lock held.
+func (h *streamHash) catchUp() {
+	for !h.catching && !h.broken {
+		end, ok := h.byStart[h.hashed]
+		if !ok {
+			return
+		}
+		delete(h.byStart, h.hashed)
+		delete(h.byEnd, end)
+		// Counted as hashed already, so writing over the span breaks the hash
+		from := h.hashed
+		h.hashed = end
+		h.catching = true
+		h.mu.Unlock()
+		_, err := io.Copy(h.w, io.NewSectionReader(h.file, from, end-from))
+		h.mu.Lock()
+		h.catching = false
+		if err != nil {
+			h.broken = true
+		}
+	}
+}
+
+// Hashes what's left of the file once it's all written and returns the hashes, starting over from the beginning
+// when the bytes couldn't be followed.
+func (h *streamHash) finish() (map[string]hash.Hash, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.broken {
+		for _, hh := range h.hashes {
+			hh.Reset()
+		}
+		h.hashed = 0
+	}
+	if _, err := io.Copy(h.w, io.NewSectionReader(h.file, h.hashed, math.MaxInt64-h.hashed)); err != nil {
+		return nil, err
+	}
+	return h.hashes, nil
+}
+
+type streamHashWriter struct {
+	w   io.Writer
+	h   *streamHash
+	off int64
+}
+
+func (sw *streamHashWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	sw.h.wrote(sw.off, p[:n])
+	sw.off += int64(n)
+	return n, err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// Counts the bytes read through it.
+type countingReaderAt struct {
+	r    io.ReaderAt
+	read atomic.Int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func TestStreamHash(t *testing.T) {
+	data := testContent(10000)
+	sum := sha256.Sum256(data)
+	type write struct{ start, end int64 }
+	tests := []struct {
+		name    string
+		ranges  [][2]int
+		written []int64
+		writes  []write
+		// How much of the file has to be read back
+		read int64
+	}{
+		{"in order", nil, nil, []write{{0, 4000}, {4000, 10000}}, 0},
+		{"second chunk first", nil, nil, []write{{5000, 7000}, {7000, 10000}, {0, 5000}}, 5000},
+		{"second chunk unfinished", nil, nil, []write{{5000, 7000}, {0, 5000}, {7000, 10000}}, 2000},
+		{"last chunk first", nil, nil, []write{{8000, 10000}, {4000, 8000}, {0, 4000}}, 6000},
+		{"started over", nil, nil, []write{{0, 4000}, {0, 10000}}, 10000},
+		{"written twice ahead", nil, nil, []write{{5000, 7000}, {6000, 10000}, {0, 5000}}, 10000},
+		{"resumed", [][2]int{{0, 4999}, {5000, 9999}}, []int64{3000, 1000}, []write{{3000, 5000}, {6000, 10000}}, 6000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := &countingReaderAt{r: bytes.NewReader(data)}
+			written := tt.written
+			if written == nil {
+				written = make([]int64, len(tt.ranges))
+			}
+			h := newStreamHash(map[string]hash.Hash{"sha256": sha256.New()}, file, tt.ranges, written)
+			for _, w := range tt.writes {
+				h.wrote(w.start, data[w.start:w.end])
+			}
+			hashes, err := h.finish()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hashes["sha256"].Sum(nil); !bytes.Equal(got, sum[:]) {
+				t.Errorf("got %x, want %x", got, sum)
+			}
+			if got := file.read.Load(); got != tt.read {
+				t.Errorf("read back %d bytes, want %d", got, tt.read)
+			}
+		})
+	}
+}
+
+// Counts the bytes read from the files it opens.
+type readCountingFS struct {
+	*memFS
+	read atomic.Int64
+}
+
+type readCountingFile struct {
+	File
+	fs *readCountingFS
+}
+
+func (f *readCountingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := f.memFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &readCountingFile{File: file, fs: f}, nil
+}
+
+func (f *readCountingFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	f.fs.read.Add(int64(n))
+	return n, err
+}
+
+func (f *readCountingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.fs.read.Add(int64(n))
+	return n, err
+}
+
+func TestStreamHashDownload(t *testing.T) {
+	data := testContent(200000)
+	sum := sha256.Sum256(data)
+	srv := serveContent(data)
+	defer srv.Close()
+
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			fsys := &readCountingFS{memFS: newMemFS()}
+			d := newTestDownloader(workers)
+			d.WithFileSystem(fsys)
+			d.WithMemoryBuffering(0)
+			d.WithChecksum("sha256", hex.EncodeToString(sum[:]))
+			d.WithCreateDirs(true)
+			d.WithOutput("/downloads/file.bin")
+			if _, err := d.Download(srv.URL + "/file.bin"); err != nil {
+				t.Fatal(err)
+			}
+			// Only the chunks written ahead of the first one are read back, a single stream none at all
+			read := fsys.read.Load()
+			if workers == 1 && read != 0 || read >= int64(len(data)) {
+				t.Errorf("read back %d bytes of %d", read, len(data))
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Writes the partial files of the downloads, and their resume state, in dir instead of next to their
+// destination, like a local disk when the destination is a slow network mount. Finished files are moved in
+// place, and copied over when dir is on another device than the destination, which takes longer.
+func (d *downloader) WithTempDir(dir string) {
+	d.tempDir = dir
+}
+
+// Returns where the partial file of a download saved at filePath is written. In the temp dir its name carries
+// a hash of the destination, so files of the same name bound for different directories don't share one,
+// while the same destination always gets the same name for a resumed download to find.
+func (d *downloader) partPath(filePath string) string {
+	if d.tempDir == "" {
+		return filePath + ".part"
+	}
+	dest, err := filepath.Abs(filePath)
+	if err != nil {
+		dest = filePath
+	}
+	sum := sha256.Sum256([]byte(dest))
+	return filepath.Join(d.tempDir, fmt.Sprintf("%s.%x.part", filepath.Base(filePath), sum[:6]))
+}
+
+// Moves the finished file at from to filePath, copying it over when a rename can't cross the devices they're on.
+func (d *downloader) moveFile(from, filePath string) error {
+	err := d.fs.Rename(from, filePath)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+
+	d.logger.Debugf("%s is on another device than %s, copying it", from, filePath)
+	// Copied next to the destination first, so the whole file still shows up at once
+	next := filePath + ".part"
+	if err := d.copyFile(from, next); err != nil {
+		d.fs.Remove(next)
+		return err
+	}
+	if err := d.fs.Rename(next, filePath); err != nil {
+		d.fs.Remove(next)
+		return err
+	}
+	return d.fs.Remove(from)
+}
+
+func (d *downloader) copyFile(from, to string) error {
+	source, err := d.fs.OpenFile(from, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := createFile(d.fs, to)
+	if err != nil {
+		return err
+	}
+	if _, err := d.copyBody(target, source); err != nil {
+		target.Close()
+		return err
+	}
+	return target.Close()
+}
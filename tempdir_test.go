@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Refuses to rename out of tempDir, as if it were on another device than the rest.
+type crossDeviceFS struct {
+	osFileSystem
+	tempDir string
+	refused *atomic.Int64
+}
+
+func (fs crossDeviceFS) Rename(oldPath, newPath string) error {
+	if filepath.Dir(oldPath) == filepath.Clean(fs.tempDir) && filepath.Dir(newPath) != filepath.Clean(fs.tempDir) {
+		fs.refused.Add(1)
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: errCrossDevice}
+	}
+	return fs.osFileSystem.Rename(oldPath, newPath)
+}
+
+func TestTempDir(t *testing.T) {
+	data := testContent(50000)
+	srv := serveContent(data)
+	defer srv.Close()
+
+	// Streamed to disk and buffered in memory
+	for _, memory := range []int{0, 1 << 20} {
+		for _, crossDevice := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%d/%v", memory, crossDevice), func(t *testing.T) {
+				inTempDir(t)
+				tempDir := t.TempDir()
+				var refused atomic.Int64
+				d := newTestDownloader(3)
+				d.WithMemoryBuffering(memory)
+				d.WithTempDir(tempDir)
+				if crossDevice {
+					d.WithFileSystem(crossDeviceFS{tempDir: tempDir, refused: &refused})
+				}
+				// The partial file has to be in the temp directory while the download runs
+				var partials atomic.Int64
+				d.WithProgress(true, 1)
+				d.WithProgressCallback(func(Progress) {
+					if names, _ := filepath.Glob(filepath.Join(tempDir, "*.part")); len(names) == 1 {
+						partials.Add(1)
+					}
+				})
+
+				path, err := d.Download(srv.URL + "/file.bin")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+					t.Fatal("downloaded file doesn't match")
+				}
+				if (refused.Load() == 1) != crossDevice {
+					t.Errorf("got %d refused renames, crossing devices: %v", refused.Load(), crossDevice)
+				}
+				if memory == 0 && partials.Load() == 0 {
+					t.Error("the partial file never showed up in the temp directory")
+				}
+				left, _ := filepath.Glob(filepath.Join(tempDir, "*"))
+				here, _ := filepath.Glob("*")
+				if len(left) != 0 || len(here) != 1 {
+					t.Errorf("left %v in the temp directory and %v in the destination", left, here)
+				}
+			})
+		}
+	}
+}
+
+func TestTempDirResume(t *testing.T) {
+	inTempDir(t)
+	tempDir := t.TempDir()
+	data := testContent(10000)
+	s, srv := newCuttingServer(data, 1000)
+	defer srv.Close()
+
+	d := newTestDownloader(2)
+	d.WithTempDir(tempDir)
+	d.WithResume(true)
+	if _, err := d.Download(srv.URL + "/file.bin"); err == nil {
+		t.Fatal("the cut off download succeeded")
+	}
+	for _, name := range []string{d.partPath("file.bin"), d.resumeStatePath("file.bin")} {
+		if _, err := os.Stat(name); err != nil || filepath.Dir(name) != tempDir {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	s.cut.Store(0)
+	s.served.Store(0)
+	d = newTestDownloader(2)
+	d.WithTempDir(tempDir)
+	d.WithResume(true)
+	path, err := d.Download(srv.URL + "/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatal("resumed file doesn't match")
+	}
+	if want := int64(len(data) - 2000); s.served.Load() != want {
+		t.Errorf("the resumed download fetched %d bytes, want %d", s.served.Load(), want)
+	}
+}
+
+func TestTempDirPartPath(t *testing.T) {
+	d := newTestDownloader(1)
+	d.WithTempDir("tmp")
+	a, b := d.partPath(filepath.Join("a", "file.bin")), d.partPath(filepath.Join("b", "file.bin"))
+	if a == b {
+		t.Errorf("a/file.bin and b/file.bin share the partial file %s", a)
+	}
+	for _, p := range []string{a, b} {
+		if filepath.Dir(p) != "tmp" || !strings.HasPrefix(filepath.Base(p), "file.bin.") || !strings.HasSuffix(p, ".part") {
+			t.Errorf("got %s", p)
+		}
+	}
+	if again := d.partPath(filepath.Join("a", "..", "a", "file.bin")); again != a {
+		t.Errorf("the same destination got %s and %s", a, again)
+	}
+}
+
+// A partial file left in the temp directory survives a file of the same name downloaded elsewhere.
+func TestTempDirSameName(t *testing.T) {
+	inTempDir(t)
+	tempDir := t.TempDir()
+	data, other := testContent(10000), testContent(12000)[2000:]
+	s, srv := newCuttingServer(data, 1000)
+	defer srv.Close()
+	otherSrv := serveContent(other)
+	defer otherSrv.Close()
+
+	download := func(url, dir string) (string, error) {
+		d := newTestDownloader(2)
+		d.WithTempDir(tempDir)
+		d.WithResume(true)
+		d.WithOutput(dir + string(filepath.Separator))
+		d.WithCreateDirs(true)
+		return d.Download(url + "/file.bin")
+	}
+	if _, err := download(srv.URL, "a"); err == nil {
+		t.Fatal("the cut off download succeeded")
+	}
+	if path, err := download(otherSrv.URL, "b"); err != nil {
+		t.Fatal(err)
+	} else if got, _ := os.ReadFile(path); !bytes.Equal(got, other) {
+		t.Fatal("the other file doesn't match")
+	}
+
+	s.cut.Store(0)
+	s.served.Store(0)
+	path, err := download(srv.URL, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatal("resumed file doesn't match")
+	}
+	if want := int64(len(data) - 2000); s.served.Load() != want {
+		t.Errorf("the resumed download fetched %d bytes, want %d", s.served.Load(), want)
+	}
+}
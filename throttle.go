@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Returned for a 429 or 503 response, the server asking us to slow down,
+// retryAfter is what its Retry-After header asked us to wait, if anything.
+type throttledError struct {
+	status     int
+	retryAfter time.Duration
+	response   *http.Response
+}
+
+func (e *throttledError) Error() string {
+	return fmt.Sprintf("server is limiting the requests with status %d, try fewer workers or more retries", e.status)
+}
+
+// Returns a throttledError when response asks us to slow down.
+func checkThrottled(response *http.Response) error {
+	if response.StatusCode != http.StatusTooManyRequests && response.StatusCode != http.StatusServiceUnavailable {
+		return nil
+	}
+	return &throttledError{
+		status:     response.StatusCode,
+		retryAfter: parseRetryAfter(response.Header.Get("Retry-After"), time.Now()),
+		response:   response,
+	}
+}
+
+// Accepts both forms of Retry-After, a number of seconds or an HTTP date, and returns 0 for anything else.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+func isThrottled(err error) bool {
+	var throttled *throttledError
+	return errors.As(err, &throttled)
+}
+
+// Returns how long the server asked to wait before err's request is tried again.
+func retryAfter(err error) time.Duration {
+	var throttled *throttledError
+	if errors.As(err, &throttled) {
+		return throttled.retryAfter
+	}
+	return 0
+}
+
+// Lets at most limit range requests run at once, starting with every worker and halving each time
+// the server throttles us, so the remaining ranges and their retries go easier on it.
+type concurrencyGate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newConcurrencyGate(limit int) *concurrencyGate {
+	g := &concurrencyGate{limit: limit}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+func (g *concurrencyGate) acquire() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.active >= g.limit {
+		g.cond.Wait()
+	}
+	g.active++
+}
+
+func (g *concurrencyGate) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active--
+	g.cond.Broadcast()
+}
+
+// Halves the limit, down to a single request at a time, and reports the new limit.
+func (g *concurrencyGate) reduce() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.limit > 1 {
+		g.limit /= 2
+	}
+	return g.limit
+}
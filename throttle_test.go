@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Serves data like serveContent, answering 429 to the GETs beyond the first limit running at once.
+func throttlingServer(data []byte, limit int64, throttled *atomic.Int64) *httptest.Server {
+	var active atomic.Int64
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			defer active.Add(-1)
+			if active.Add(1) > limit {
+				throttled.Add(1)
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+}
+
+func TestThrottled(t *testing.T) {
+	inTempDir(t)
+	data := testContent(8000)
+	var throttled atomic.Int64
+	srv := throttlingServer(data, 2, &throttled)
+	defer srv.Close()
+
+	d := newTestDownloader(8)
+	d.WithRetries(3, 10*time.Millisecond)
+	path, err := d.Download(srv.URL + "/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatal("downloaded file doesn't match")
+	}
+	if throttled.Load() == 0 {
+		t.Error("the server never throttled the download, the test doesn't test anything")
+	}
+}
+
+func TestThrottledRunsOut(t *testing.T) {
+	inTempDir(t)
+	var throttled atomic.Int64
+	srv := throttlingServer(testContent(8000), 0, &throttled)
+	defer srv.Close()
+
+	d := newTestDownloader(8)
+	d.WithRetries(1, time.Millisecond)
+	if _, err := d.Download(srv.URL + "/file.bin"); !isThrottled(err) {
+		t.Errorf("got %v, want the throttling reported", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2015, 10, 21, 7, 27, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"0", 0},
+		{"-1", 0},
+		{"Wed, 21 Oct 2015 07:28:00 GMT", time.Minute},
+		// Already passed
+		{"Wed, 21 Oct 2015 07:26:00 GMT", 0},
+		{"soon", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := parseRetryAfter(tt.header, now); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConcurrencyGate(t *testing.T) {
+	g := newConcurrencyGate(5)
+	for _, want := range []int{2, 1, 1} {
+		if got := g.reduce(); got != want {
+			t.Errorf("reduced to %d, want %d", got, want)
+		}
+	}
+
+	g.acquire()
+	acquired := make(chan struct{})
+	go func() {
+		g.acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("a second request got past a limit of 1")
+	case <-time.After(20 * time.Millisecond):
+	}
+	g.release()
+	<-acquired
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// Uses config for the TLS connections of every request, a copy is kept so changing config later has no effect.
+// WithInsecureSkipVerify and WithRootCAs called afterwards adjust that copy.
+func (d *downloader) WithTLSConfig(config *tls.Config) {
+	d.transport().TLSClientConfig = config.Clone()
+}
+
+// Accepts any certificate the server presents, only meant for testing or servers you trust anyway.
+func (d *downloader) WithInsecureSkipVerify(enabled bool) {
+	d.tlsConfig().InsecureSkipVerify = enabled
+}
+
+// Verifies servers against the certificates in pool instead of the system ones, like a private CA.
+func (d *downloader) WithRootCAs(pool *x509.CertPool) {
+	d.tlsConfig().RootCAs = pool
+}
+
+// Returns the TLS config of the transport, creating an empty one first if needed.
+func (d *downloader) tlsConfig() *tls.Config {
+	t := d.transport()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	return t.TLSClientConfig
+}
+
+// Reads the PEM encoded certificates of the --cacert file.
+func loadCertPool(name string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", name)
+	}
+	return pool, nil
+}
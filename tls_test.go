@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTLS(t *testing.T) {
+	data := testContent(20000)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	// The refused handshakes are what's tested
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	withCA := func(d *downloader) {
+		pool := x509.NewCertPool()
+		pool.AddCert(srv.Certificate())
+		d.WithRootCAs(pool)
+	}
+	withCAFile := func(d *downloader) {
+		file := "ca.pem"
+		pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+		if err := os.WriteFile(file, pemData, 0644); err != nil {
+			t.Fatal(err)
+		}
+		pool, err := loadCertPool(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.WithRootCAs(pool)
+	}
+	tests := []struct {
+		name string
+		set  func(d *downloader)
+		ok   bool
+	}{
+		{"system CAs", func(d *downloader) {}, false},
+		{"proper CA", withCA, true},
+		{"CA file", withCAFile, true},
+		{"insecure", func(d *downloader) { d.WithInsecureSkipVerify(true) }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			d := newTestDownloader(3)
+			// The TLS options keep what the others set up
+			d.WithTimeout(5 * time.Second)
+			tt.set(d)
+			_, err := d.Download(srv.URL + "/file.bin")
+			if tt.ok != (err == nil) {
+				t.Fatalf("got %v", err)
+			}
+			if d.client.Timeout != 5*time.Second {
+				t.Error("the timeout was lost")
+			}
+		})
+	}
+
+	if config := http.DefaultTransport.(*http.Transport).TLSClientConfig; config != nil && (config.RootCAs != nil || config.InsecureSkipVerify) {
+		t.Error("the default transport was changed")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// Gives up on any single request, including reading its body, that takes longer than timeout.
+// A worker running out of time fails its chunk like any other error, so it's retried if retries are enabled.
+func (d *downloader) WithTimeout(timeout time.Duration) {
+	d.client.Timeout = timeout
+}
+
+// Gives up on the requests asking the server about the file before downloading it, the HEAD and the ranged GET
+// tried when it fails, that take longer than timeout each, so a server that doesn't answer is noticed right away
+// rather than after the timeout of the download. 0, the default, leaves them to WithTimeout like the others.
+func (d *downloader) WithProbeTimeout(timeout time.Duration) {
+	d.probeTimeout = timeout
+}
+
+// Applies the probe timeout to the context of a request asking about the file.
+func (d *downloader) probeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.probeTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d.probeTimeout)
+}
+
+// Limits how long a whole download may take, across all of its workers and retries.
+func (d *downloader) WithTotalTimeout(timeout time.Duration) {
+	d.totalTimeout = timeout
+}
+
+// Applies the total timeout to the context of a download.
+func (d *downloader) downloadContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.totalTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d.totalTimeout)
+}
+
+// Same limit as the default policy of http.Client.
+const defaultMaxRedirects = 10
+
+// Follows at most n redirects, 0 disables them. They're resolved once while asking the server about the file,
+// so the workers all request the final URL and range support is measured on the server that serves them.
+func (d *downloader) WithMaxRedirects(n int) {
+	d.maxRedirects = n
+	d.client.CheckRedirect = d.checkRedirect
+}
+
+// Refuses redirects leading to another host than the one of the requested URL.
+func (d *downloader) WithSameHostRedirects(enabled bool) {
+	d.sameHostRedirects = enabled
+	d.client.CheckRedirect = d.checkRedirect
+}
+
+func (d *downloader) checkRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) > d.maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", d.maxRedirects)
+	}
+	if d.sameHostRedirects && request.URL.Hostname() != via[0].URL.Hostname() {
+		return fmt.Errorf("redirect from %s to another host %s isn't allowed", via[0].URL.Hostname(), request.URL.Hostname())
+	}
+	return nil
+}
+
+// Sends every request through the proxy at proxyURL, http://, https:// and socks5:// proxies are supported.
+// Without it the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are respected.
+// An invalid proxyURL makes every request fail with the reason.
+func (d *downloader) WithProxy(proxyURL string) {
+	proxy, err := parseProxyURL(proxyURL)
+	d.transport().Proxy = func(*http.Request) (*url.URL, error) {
+		return proxy, err
+	}
+}
+
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	proxy, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", proxyURL, err)
+	}
+
+	switch proxy.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, use http, https or socks5", proxy.Scheme)
+	}
+
+	if proxy.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q: missing host", proxyURL)
+	}
+
+	return proxy, nil
+}
+
+// Allows at most maxPerHost connections to the same host, idle or not, and keeps up to that many of them
+// open between requests. Workers wait for a free connection once all of them are in use, so it's best
+// not to go below the workers count. By default there's no limit and a connection per worker is kept idle.
+// Like the other transport options, it has no effect on a custom client whose transport isn't an *http.Transport.
+func (d *downloader) WithConnectionPool(maxPerHost int) {
+	d.connectionPool = maxPerHost
+	t := d.transport()
+	t.MaxConnsPerHost = maxPerHost
+	t.MaxIdleConnsPerHost = maxPerHost
+	if t.MaxIdleConns != 0 && t.MaxIdleConns < maxPerHost {
+		t.MaxIdleConns = maxPerHost
+	}
+}
+
+// Sizes the pool for workers requests to the same host at once, a connection each and as many kept idle,
+// so the ranges of a file don't each open their own, http.Transport keeps only 2 per host by default.
+// The pool only ever grows, a transport that isn't ours is left as is.
+func (d *downloader) growConnectionPool(workers int) {
+	t := d.pooledTransport
+	if t == nil || d.client.Transport != t || d.connectionPool > 0 {
+		return
+	}
+	if workers > t.MaxIdleConnsPerHost {
+		t.MaxIdleConnsPerHost = workers
+	}
+	// More than that wouldn't be used, a worker waits for its range before asking for another
+	if workers > t.MaxConnsPerHost {
+		t.MaxConnsPerHost = workers
+	}
+	if t.MaxIdleConns != 0 && workers > t.MaxIdleConns {
+		t.MaxIdleConns = workers
+	}
+}
+
+// Sticks to HTTP/1.1 instead of negotiating HTTP/2, for servers that reset or corrupt streams when
+// many ranges are requested over the same HTTP/2 connection. Each worker then gets a connection of its own.
+func (d *downloader) WithForceHTTP1(enabled bool) {
+	t := d.transport()
+	t.ForceAttemptHTTP2 = !enabled
+	if !enabled {
+		t.TLSNextProto = nil
+		return
+	}
+
+	// A non-nil map is what tells the transport to leave HTTP/2 out
+	t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	// A transport copied after it was used already offers h2 in its TLS config
+	if config := t.TLSClientConfig; config != nil {
+		config.NextProtos = slices.DeleteFunc(slices.Clone(config.NextProtos), func(proto string) bool {
+			return proto == "h2"
+		})
+	}
+}
+
+// Returns the transport of the client so options can tune it, a client using the default
+// transport gets its own copy of it first, so the shared http.DefaultTransport is never modified.
+// Options have no effect on a custom client whose transport isn't an *http.Transport.
+func (d *downloader) transport() *http.Transport {
+	switch t := d.client.Transport.(type) {
+	case nil:
+	case *http.Transport:
+		if t != http.DefaultTransport {
+			return t
+		}
+	default:
+		return &http.Transport{}
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	d.client.Transport = t
+	return t
+}
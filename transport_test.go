@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Serves data like serveContent, counting the connections opened to it.
+func connCountingServer(data []byte, opened *atomic.Int64) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			opened.Add(1)
+		}
+	}
+	srv.Start()
+	return srv
+}
+
+func TestConnectionPoolReuse(t *testing.T) {
+	const workers = 8
+	data := testContent(8 << 20)
+	var opened atomic.Int64
+	srv := connCountingServer(data, &opened)
+	defer srv.Close()
+
+	download := func(d *downloader) {
+		t.Helper()
+		for i := 0; i < 3; i++ {
+			if err := d.DownloadToWriter(context.Background(), srv.URL+"/file.bin", io.Discard); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	download(newTestDownloader(workers))
+	if n := opened.Load(); n > workers {
+		t.Errorf("3 downloads with %d workers opened %d connections, want at most one per worker", workers, n)
+	}
+
+	// http.Transport keeps 2 idle connections per host by default, the others are opened again every time
+	opened.Store(0)
+	d := newTestDownloader(workers)
+	d.WithCustomHttpClient(&http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()})
+	download(d)
+	if n := opened.Load(); n <= workers {
+		t.Errorf("the default transport opened only %d connections", n)
+	}
+}
+
+func TestConnectionPoolSizing(t *testing.T) {
+	d := NewDownloader(12)
+	transport := d.client.Transport.(*http.Transport)
+	if transport.MaxIdleConnsPerHost != 12 || transport.MaxConnsPerHost != 12 || transport.MaxIdleConns < 12 {
+		t.Errorf("got %d idle per host, %d per host and %d idle, want room for 12 workers",
+			transport.MaxIdleConnsPerHost, transport.MaxConnsPerHost, transport.MaxIdleConns)
+	}
+
+	d.WithMaxConcurrency(20)
+	if transport.MaxIdleConnsPerHost != 20 || transport.MaxConnsPerHost != 20 {
+		t.Errorf("the pool didn't grow with the concurrency: %d idle per host, %d per host",
+			transport.MaxIdleConnsPerHost, transport.MaxConnsPerHost)
+	}
+
+	d.WithConnectionPool(4)
+	d.WithMaxConcurrency(30)
+	if transport.MaxIdleConnsPerHost != 4 || transport.MaxConnsPerHost != 4 {
+		t.Error("the pool grew past WithConnectionPool")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	inTempDir(t)
+	data := testContent(3000)
+	var proxied atomic.Int64
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests to a proxy carry the whole URL
+		if r.URL.Host == "files.example" {
+			proxied.Add(1)
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer proxy.Close()
+
+	d := newTestDownloader(3)
+	d.WithProxy(proxy.URL)
+	path, err := d.Download("http://files.example/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatal("downloaded file doesn't match")
+	}
+	// The HEAD and the three ranges
+	if proxied.Load() != 4 {
+		t.Errorf("%d requests went through the proxy, want 4", proxied.Load())
+	}
+	if http.DefaultTransport.(*http.Transport).Proxy == nil {
+		t.Error("the proxy of the default transport was changed")
+	}
+
+	d = newTestDownloader(3)
+	d.WithProxy("ftp://proxy.example")
+	if _, err := d.Download("http://files.example/file.bin"); err == nil || !strings.Contains(err.Error(), "unsupported proxy scheme") {
+		t.Errorf("got %v, want the scheme refused", err)
+	}
+}
+
+// Serves data like serveContent, answering HEAD right away and the GETs only after delay.
+func stallingServer(data []byte, delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+}
+
+func TestTimeouts(t *testing.T) {
+	srv := stallingServer(testContent(3000), 5*time.Second)
+	defer srv.Close()
+	tests := []struct {
+		name string
+		set  func(d *downloader)
+	}{
+		{"per request", func(d *downloader) { d.WithTimeout(200 * time.Millisecond) }},
+		{"total", func(d *downloader) { d.WithTotalTimeout(200 * time.Millisecond) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			d := newTestDownloader(3)
+			tt.set(d)
+			start := time.Now()
+			_, err := d.Download(srv.URL + "/file.bin")
+			if err == nil {
+				t.Fatal("a stalled download succeeded")
+			}
+			var netErr net.Error
+			if !errors.Is(err, context.DeadlineExceeded) && !(errors.As(err, &netErr) && netErr.Timeout()) {
+				t.Errorf("got %v, want a timeout", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("aborted after %s", elapsed)
+			}
+			if names, _ := filepath.Glob("*"); len(names) != 0 {
+				t.Errorf("left %v behind", names)
+			}
+		})
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	data := testContent(1 << 20)
+	// Hangs on the HEAD only, the ranged GET tried after it gets the details
+	hangingHead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			<-r.Context().Done()
+			return
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer hangingHead.Close()
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer dead.Close()
+
+	tests := []struct {
+		name string
+		url  string
+		ok   bool
+	}{
+		{"hanging HEAD", hangingHead.URL, true},
+		{"dead server", dead.URL, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			d := newTestDownloader(2)
+			d.WithProbeTimeout(200 * time.Millisecond)
+			start := time.Now()
+			_, err := d.Download(tt.url + "/file.bin")
+			if tt.ok && err != nil {
+				t.Fatal(err)
+			}
+			if !tt.ok && !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("got %v, want the probe timed out", err)
+			}
+			// Both the HEAD and the GET after it time out on the dead server
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("took %s with a probe timeout of 200ms", elapsed)
+			}
+		})
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	data := testContent(5000)
+	var finalHits, hopHits atomic.Int64
+	final := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		finalHits.Add(1)
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer final.Close()
+	hop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hopHits.Add(1)
+		http.Redirect(w, r, final.URL+"/real.bin", http.StatusFound)
+	}))
+	defer hop.Close()
+	// On another host name than the rest
+	start := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, strings.Replace(hop.URL, "127.0.0.1", "localhost", 1)+"/hop", http.StatusFound)
+	}))
+	defer start.Close()
+
+	inTempDir(t)
+	path, err := newTestDownloader(4).Download(start.URL + "/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatal("downloaded file doesn't match")
+	}
+	// Only the HEAD follows the chain, the four workers go to the final URL
+	if hopHits.Load() != 1 || finalHits.Load() != 5 {
+		t.Errorf("the chain was followed %d times and the final host got %d requests, want 1 and 5", hopHits.Load(), finalHits.Load())
+	}
+
+	d := newTestDownloader(4)
+	d.WithMaxRedirects(1)
+	if _, err := d.Download(start.URL + "/other.bin"); err == nil {
+		t.Error("two redirects were followed with a max of 1")
+	}
+
+	d = newTestDownloader(4)
+	d.WithSameHostRedirects(true)
+	if _, err := d.Download(start.URL + "/other.bin"); err == nil {
+		t.Error("a redirect to another host was followed")
+	}
+}
+
+func TestForceHTTP1(t *testing.T) {
+	data := testContent(3000)
+	for _, force := range []bool{false, true} {
+		t.Run(fmt.Sprint(force), func(t *testing.T) {
+			inTempDir(t)
+			var http1, http2 atomic.Int64
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.ProtoMajor == 2 {
+					http2.Add(1)
+				} else {
+					http1.Add(1)
+				}
+				http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+			}))
+			srv.EnableHTTP2 = true
+			srv.StartTLS()
+			defer srv.Close()
+
+			d := newTestDownloader(3)
+			d.WithRootCAs(srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs)
+			d.WithForceHTTP1(force)
+			path, err := d.Download(srv.URL + "/file.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+				t.Fatal("downloaded file doesn't match")
+			}
+			if force && (http1.Load() == 0 || http2.Load() != 0) || !force && (http2.Load() == 0 || http1.Load() != 0) {
+				t.Errorf("got %d HTTP/1.1 and %d HTTP/2 requests, forced HTTP/1.1: %v", http1.Load(), http2.Load(), force)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time along with version, like -ldflags "-X main.commit=$(git rev-parse HEAD) -X main.date=...".
+var (
+	commit = ""
+	date   = ""
+)
+
+// Describes the running build, what -ldflags didn't set is taken from the build info Go records
+// when it's built from a module or a checkout.
+func versionInfo() string {
+	v, c, built := version, commit, date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && c == "":
+				c = setting.Value
+			case setting.Key == "vcs.time" && built == "":
+				built = setting.Value
+			}
+		}
+	}
+
+	if len(c) > 12 {
+		c = c[:12]
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	if built == "" {
+		built = "unknown"
+	}
+	return fmt.Sprintf("%s (commit %s, built %s, %s %s/%s)", v, c, built, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestVersionCommand(t *testing.T) {
+	for _, args := range [][]string{{"version"}, {"--version"}} {
+		t.Run(args[0], func(t *testing.T) {
+			stdout, stderr, code := runCommand(t, t.TempDir(), nil, args...)
+			if code != 0 {
+				t.Fatalf("exited with %d: %s", code, stderr)
+			}
+			if !strings.HasPrefix(stdout, "downloader "+version+" (commit ") || !strings.Contains(stdout, runtime.Version()) {
+				t.Errorf("got %q", stdout)
+			}
+		})
+	}
+}
+
+func TestVersionInfo(t *testing.T) {
+	defer func(original string) { commit = original }(commit)
+	commit = "0123456789abcdef0123"
+	// Shortened like git does
+	if info := versionInfo(); !strings.Contains(info, "(commit 0123456789ab, built ") {
+		t.Errorf("got %q", info)
+	}
+}
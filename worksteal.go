@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Splits files into many more chunks than workers, a first round of equal ones followed by chunks shrinking
+// towards the end of the file, and hands them out by how fast each worker turned out to be. The fast ones
+// take the biggest chunks left and the slow ones the smallest, so a slow connection doesn't end up holding
+// the last big part of the file while the others are done. It has no effect along with WithChunkSize.
+func (d *downloader) WithWorkStealing(enabled bool) {
+	d.workStealing = enabled
+}
+
+// Splits total bytes for count workers, the first count chunks cover half of the file and each of the next ones
+// takes a 2*count-th of what's left, so they get smaller and smaller down to minSize.
+func stealingRanges(total, count, minSize int) [][2]int {
+	minSize = max(minSize, 1)
+	ranges := splitRanges(total/2, count)
+
+	for start := total / 2; start < total; {
+		end := start + max((total-start)/(2*count), minSize) - 1
+		// What would be left is too small for a chunk of its own
+		if total-end-1 < minSize {
+			end = total - 1
+		}
+		ranges = append(ranges, [2]int{start, end})
+		start = end + 1
+	}
+	return ranges
+}
+
+// Hands the chunks out to the workers of processMultiple, in order, unless adaptive is set and a worker has
+// proved a lot slower than the others, which then gets the smallest chunk left, the last one.
+type workQueue struct {
+	mu       sync.Mutex
+	pending  []int
+	adaptive bool
+	// Bytes per second of every worker over the chunks it finished, 0 until it finished one.
+	speeds []float64
+}
+
+func newWorkQueue(chunks, workers int, adaptive bool) *workQueue {
+	q := &workQueue{pending: make([]int, chunks), adaptive: adaptive, speeds: make([]float64, workers)}
+	for i := range q.pending {
+		q.pending[i] = i
+	}
+	return q
+}
+
+// Returns the next chunk worker should download, ok is false once there's none left.
+func (q *workQueue) next(worker int) (index int, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return 0, false
+	}
+
+	if q.adaptive && q.slow(worker) {
+		index = q.pending[len(q.pending)-1]
+		q.pending = q.pending[:len(q.pending)-1]
+		return index, true
+	}
+	index = q.pending[0]
+	q.pending = q.pending[1:]
+	return index, true
+}
+
+// Reports whether worker runs at less than half the median speed of the measured workers.
+func (q *workQueue) slow(worker int) bool {
+	if q.speeds[worker] == 0 {
+		return false
+	}
+
+	var measured []float64
+	for _, speed := range q.speeds {
+		if speed > 0 {
+			measured = append(measured, speed)
+		}
+	}
+	// Nothing to compare with yet
+	if len(measured) < 2 {
+		return false
+	}
+	sort.Float64s(measured)
+	return q.speeds[worker] < measured[len(measured)/2]/2
+}
+
+// Counts bytes downloaded by worker in elapsed towards its speed, the latest chunk weighing as much as all the earlier ones.
+func (q *workQueue) record(worker int, bytes int64, elapsed time.Duration) {
+	if bytes <= 0 || elapsed <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	speed := float64(bytes) / elapsed.Seconds()
+	if q.speeds[worker] > 0 {
+		speed = (q.speeds[worker] + speed) / 2
+	}
+	q.speeds[worker] = speed
+}
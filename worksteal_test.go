@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStealingRanges(t *testing.T) {
+	tests := []struct {
+		total, count, minSize int
+	}{
+		{100 << 20, 5, 1 << 20},
+		{2500000, 2, 1 << 20},
+		{10 << 20, 8, 1 << 20},
+		{1000, 4, 0},
+		{7, 3, 1},
+		{1, 3, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d/%d/%d", tt.total, tt.count, tt.minSize), func(t *testing.T) {
+			ranges := stealingRanges(tt.total, tt.count, tt.minSize)
+			next := 0
+			for i, r := range ranges {
+				if r[0] != next || r[1] < r[0] {
+					t.Fatalf("range %d is %v after %d bytes", i, r, next)
+				}
+				// Past the first round, every chunk is at most as big as the one before, but the last one taking in the rest
+				if i > tt.count && i < len(ranges)-1 && r[1]-r[0] > ranges[i-1][1]-ranges[i-1][0] {
+					t.Errorf("range %d of %v is bigger than the one before", i, r)
+				}
+				next = r[1] + 1
+			}
+			if next != tt.total {
+				t.Errorf("the ranges cover %d bytes, want %d", next, tt.total)
+			}
+		})
+	}
+}
+
+func TestWorkQueue(t *testing.T) {
+	q := newWorkQueue(6, 3, true)
+	for worker := 0; worker < 3; worker++ {
+		if index, _ := q.next(worker); index != worker {
+			t.Fatalf("worker %d got chunk %d", worker, index)
+		}
+	}
+	q.record(0, 1000, time.Second)
+	q.record(1, 1000, time.Second)
+	q.record(2, 100, time.Second)
+
+	// The slow worker is handed the last chunk, the others go on in order
+	if index, _ := q.next(2); index != 5 {
+		t.Errorf("the slow worker got chunk %d, want 5", index)
+	}
+	if index, _ := q.next(0); index != 3 {
+		t.Errorf("a fast worker got chunk %d, want 3", index)
+	}
+	q.next(1)
+	if _, ok := q.next(0); ok {
+		t.Error("got a chunk of an empty queue")
+	}
+}
+
+func TestWorkStealing(t *testing.T) {
+	data := testContent(4 << 20)
+	var slow atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			// The first connection runs at about a megabyte a second, the others as fast as they can
+			slow.CompareAndSwap(nil, r.RemoteAddr)
+			if slow.Load() == r.RemoteAddr {
+				start, end, _ := strings.Cut(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), "-")
+				first, _ := strconv.Atoi(start)
+				last, _ := strconv.Atoi(end)
+				time.Sleep(time.Duration(last-first+1) * time.Microsecond)
+			}
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	elapsed := map[bool]time.Duration{}
+	for _, stealing := range []bool{false, true} {
+		slow = atomic.Value{}
+		d := newTestDownloader(4)
+		d.WithMinChunkSize(64 << 10)
+		d.WithWorkStealing(stealing)
+		var buf bytes.Buffer
+		started := time.Now()
+		if err := d.DownloadToWriter(context.Background(), srv.URL+"/file.bin", &buf); err != nil {
+			t.Fatal(err)
+		}
+		elapsed[stealing] = time.Since(started)
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Fatalf("downloaded bytes don't match with stealing %v", stealing)
+		}
+	}
+
+	// Equal chunks wait for the slow connection to get through a quarter of the file, stealing only an eighth
+	if elapsed[true] > elapsed[false]*3/4 {
+		t.Errorf("took %v with stealing and %v without", elapsed[true], elapsed[false])
+	}
+}